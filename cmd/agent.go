@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"password-manager/internal/agent"
+	"password-manager/internal/crypto"
+	"password-manager/internal/database"
+	"password-manager/internal/handlers"
+)
+
+// agentKeyFD is the file descriptor a background agent reads its unlock key
+// from
+const agentKeyFD = 3
+
+// agentUsage lists the agent subcommands
+const agentUsage = `Usage: %[1]s agent start [--idle-timeout DURATION] [--foreground]
+       %[1]s agent lock
+       %[1]s agent status
+       %[1]s agent stop
+`
+
+// runAgent runs an agent subcommand and returns its exit code
+func runAgent(dbPath string, args []string, keyFilePath string, passwordFD int, force bool) int {
+	name := filepath.Base(os.Args[0])
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, agentUsage, name)
+		return handlers.ExitUsage
+	}
+
+	socketPath, err := agent.SocketPath(dbPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s agent: %v\n", name, err)
+		return handlers.ExitError
+	}
+	client := agent.NewClient(socketPath)
+
+	switch args[0] {
+	case "start":
+		err = startAgent(dbPath, socketPath, args[1:], keyFilePath, passwordFD, force)
+	case "serve":
+		// Started by "agent start" in the background
+		err = serveBackgroundAgent(dbPath, socketPath, args[1:])
+	case "lock":
+		if err = client.Lock(); err == nil {
+			fmt.Fprintln(os.Stderr, "🔒 Agent locked")
+		}
+	case "status":
+		var status *agent.Status
+		if status, err = client.Status(); err == nil {
+			printAgentStatus(status)
+		}
+	case "stop":
+		if err = client.Stop(); err == nil {
+			fmt.Fprintln(os.Stderr, "✅ Agent stopped")
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "%s agent: unknown command %q\n", name, args[0])
+		fmt.Fprintf(os.Stderr, agentUsage, name)
+		return handlers.ExitUsage
+	}
+
+	var usage *agentUsageError
+	switch {
+	case err == nil:
+		return handlers.ExitOK
+	case errors.Is(err, flag.ErrHelp):
+		return handlers.ExitOK
+	case errors.As(err, &usage):
+		fmt.Fprintf(os.Stderr, "%s agent %s: %v\n", name, args[0], err)
+		fmt.Fprintf(os.Stderr, agentUsage, name)
+		return handlers.ExitUsage
+	default:
+		fmt.Fprintf(os.Stderr, "%s agent %s: %v\n", name, args[0], err)
+		return handlers.ExitError
+	}
+}
+
+// agentUsageError is an invalid agent command line
+type agentUsageError struct {
+	message string
+}
+
+func (e *agentUsageError) Error() string {
+	return e.message
+}
+
+// parseAgentFlags parses the flags of an agent command. Parse errors are
+// reported by runAgent rather than by the flag package.
+func parseAgentFlags(fs *flag.FlagSet, args []string) error {
+	fs.SetOutput(io.Discard)
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintf(os.Stderr, agentUsage, filepath.Base(os.Args[0]))
+		fs.SetOutput(os.Stderr)
+		fs.PrintDefaults()
+		return err
+	}
+	if err != nil {
+		return &agentUsageError{err.Error()}
+	}
+	return nil
+}
+
+// startAgent unlocks the vault and starts an agent holding its unlock key, in
+// the background unless --foreground is given. A locked agent is given the
+// key instead.
+func startAgent(dbPath, socketPath string, args []string, keyFilePath string, passwordFD int, force bool) error {
+	fs := flag.NewFlagSet("agent start", flag.ContinueOnError)
+	idleTimeout := fs.Duration("idle-timeout", agent.DefaultIdleTimeout, "lock the agent after this long without requests, or never if 0")
+	foreground := fs.Bool("foreground", false, "serve in the foreground instead of starting a background process")
+	if err := parseAgentFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return &agentUsageError{"agent start takes no arguments"}
+	}
+	if *idleTimeout < 0 {
+		return &agentUsageError{"--idle-timeout cannot be negative"}
+	}
+
+	client := agent.NewClient(socketPath)
+	status, err := client.Status()
+	running := err == nil
+	if running && !status.Locked {
+		fmt.Fprintln(os.Stderr, "🔓 Agent is already running and unlocked")
+		return nil
+	}
+
+	key, err := deriveAgentKey(dbPath, keyFilePath, passwordFD, force)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case running:
+		defer key.Wipe()
+		if err := client.Load(key); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "🔓 Agent unlocked")
+		return nil
+	case *foreground:
+		return serveAgent(dbPath, socketPath, key, *idleTimeout, nil)
+	}
+
+	defer key.Wipe()
+	pid, err := spawnAgent(socketPath, key, *idleTimeout)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "🔓 Agent started (pid %d)", pid)
+	if *idleTimeout > 0 {
+		fmt.Fprintf(os.Stderr, ", locks after %s without use", *idleTimeout)
+	}
+	fmt.Fprintln(os.Stderr)
+	return nil
+}
+
+// deriveAgentKey derives the unlock key of the vault from the master password
+// and opens the vault with it, so that the key is checked, outdated schemas are
+// upgraded and the integrity check honours --force as usual. A vault whose
+// master password verifier predates unlock keys is upgraded by unlocking it
+// with the master password first.
+func deriveAgentKey(dbPath, keyFilePath string, passwordFD int, force bool) (*crypto.UnlockKey, error) {
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, fmt.Errorf("no vault to open: %w", err)
+	}
+
+	var keyFile []byte
+	if keyFilePath != "" {
+		var err error
+		if keyFile, err = crypto.ReadKeyFile(keyFilePath); err != nil {
+			return nil, fmt.Errorf("reading key file: %w", err)
+		}
+		defer crypto.Wipe(keyFile)
+	}
+
+	masterPassword, err := readMasterPassword(passwordFD)
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.Wipe(masterPassword)
+	if len(masterPassword) == 0 {
+		return nil, errors.New("master password cannot be empty")
+	}
+
+	db, key, encryptor, err := openWithUnlockKey(dbPath, masterPassword, keyFile)
+	if errors.Is(err, crypto.ErrUpgradeRequired) {
+		if err = upgradeVerifier(dbPath, masterPassword, keyFile); err == nil {
+			db, key, encryptor, err = openWithUnlockKey(dbPath, masterPassword, keyFile)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	defer encryptor.Close()
+
+	if err := checkIntegrity(encryptor, force); err != nil {
+		key.Wipe()
+		return nil, err
+	}
+	return key, nil
+}
+
+// openWithUnlockKey derives the unlock key of the vault at dbPath and opens
+// the vault with it
+func openWithUnlockKey(dbPath string, masterPassword, keyFile []byte) (*database.DB, *crypto.UnlockKey, *crypto.Encryptor, error) {
+	db, err := database.NewDB(dbPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	key, err := crypto.DeriveUnlockKey(masterPassword, keyFile, db)
+	if err != nil {
+		db.Close()
+		return nil, nil, nil, err
+	}
+	encryptor, err := crypto.NewEncryptorWithKey(key, db)
+	if err != nil {
+		key.Wipe()
+		db.Close()
+		return nil, nil, nil, err
+	}
+	return db, key, encryptor, nil
+}
+
+// upgradeVerifier unlocks the vault at dbPath with the master password, which
+// upgrades a master password verifier that predates unlock keys
+func upgradeVerifier(dbPath string, masterPassword, keyFile []byte) error {
+	db, err := database.NewDB(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	encryptor, err := crypto.NewEncryptor(masterPassword, keyFile, db)
+	if err != nil {
+		return err
+	}
+	encryptor.Close()
+	return nil
+}
+
+// verifyUnlockKey checks that key opens the vault at dbPath
+func verifyUnlockKey(dbPath string, key *crypto.UnlockKey) error {
+	db, err := database.NewDB(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return crypto.VerifyUnlockKey(key, db)
+}
+
+// spawnAgent starts a background agent process holding key and waits until
+// it listens. The key is passed through a pipe, never the command line or the
+// environment.
+func spawnAgent(socketPath string, key *crypto.UnlockKey, idleTimeout time.Duration) (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	keyReader, keyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer keyWriter.Close()
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		keyReader.Close()
+		return 0, err
+	}
+	defer readyReader.Close()
+
+	cmd := exec.Command(executable, "agent", "serve", "--idle-timeout", idleTimeout.String())
+	cmd.ExtraFiles = []*os.File{keyReader} // becomes agentKeyFD
+	cmd.Stdout = readyWriter
+	cmd.SysProcAttr = agent.DetachAttr()
+	err = cmd.Start()
+	keyReader.Close()
+	readyWriter.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	encoded, err := key.MarshalBinary()
+	if err != nil {
+		cmd.Process.Kill()
+		return 0, err
+	}
+	_, err = keyWriter.Write(encoded)
+	crypto.Wipe(encoded)
+	keyWriter.Close()
+	if err != nil {
+		cmd.Process.Kill()
+		return 0, err
+	}
+
+	// The agent reports "ready" once it listens, or the reason it failed
+	line, _ := bufio.NewReader(readyReader).ReadString('\n')
+	line = strings.TrimSpace(line)
+	if line != "ready" {
+		cmd.Wait()
+		if line == "" {
+			line = "agent exited before it was ready"
+		}
+		return 0, errors.New(line)
+	}
+
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+	return pid, nil
+}
+
+// serveBackgroundAgent runs the agent process started by spawnAgent, reading
+// the unlock key from agentKeyFD and reporting on stdout once it listens
+func serveBackgroundAgent(dbPath, socketPath string, args []string) error {
+	fs := flag.NewFlagSet("agent serve", flag.ContinueOnError)
+	idleTimeout := fs.Duration("idle-timeout", agent.DefaultIdleTimeout, "lock the agent after this long without requests, or never if 0")
+	if err := parseAgentFlags(fs, args); err != nil {
+		return err
+	}
+
+	// Failures go to the process that started the agent
+	fail := func(err error) error {
+		fmt.Println(err)
+		return err
+	}
+
+	keyInput := os.NewFile(agentKeyFD, "agent-key")
+	if keyInput == nil {
+		return fail(errors.New("no unlock key given"))
+	}
+	encoded, err := io.ReadAll(keyInput)
+	keyInput.Close()
+	defer crypto.Wipe(encoded)
+	if err != nil {
+		return fail(err)
+	}
+
+	key := &crypto.UnlockKey{}
+	if err := key.UnmarshalBinary(encoded); err != nil {
+		return fail(err)
+	}
+	return serveAgent(dbPath, socketPath, key, *idleTimeout, os.Stdout)
+}
+
+// serveAgent serves key on the agent socket until the agent is stopped or
+// the process is interrupted. The agent takes ownership of key, and only
+// accepts keys loaded later that open the vault at dbPath. If ready is set,
+// "ready" is written to it and it is closed once the socket listens.
+func serveAgent(dbPath, socketPath string, key *crypto.UnlockKey, idleTimeout time.Duration, ready *os.File) error {
+	dbPath, err := filepath.Abs(dbPath)
+	if err != nil {
+		key.Wipe()
+		return err
+	}
+
+	listener, err := agent.Listen(socketPath)
+	if err != nil {
+		key.Wipe()
+		if ready != nil {
+			fmt.Fprintln(ready, err)
+		}
+		return err
+	}
+
+	a := agent.New(key, idleTimeout, func(key *crypto.UnlockKey) error {
+		return verifyUnlockKey(dbPath, key)
+	})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		<-signals
+		a.Stop()
+	}()
+
+	if ready != nil {
+		fmt.Fprintln(ready, "ready")
+		ready.Close()
+	} else {
+		fmt.Fprintf(os.Stderr, "🔓 Agent listening on %s\n", socketPath)
+	}
+	return a.Serve(listener)
+}
+
+// printAgentStatus prints whether the agent is unlocked and when it locks
+func printAgentStatus(status *agent.Status) {
+	switch {
+	case status.Locked:
+		fmt.Printf("🔒 Agent running (pid %d), locked\n", status.PID)
+	case status.IdleTimeout > 0:
+		fmt.Printf("🔓 Agent running (pid %d), unlocked, locks in %s\n", status.PID, status.LocksIn)
+	default:
+		fmt.Printf("🔓 Agent running (pid %d), unlocked\n", status.PID)
+	}
+}
+
+// unlockWithAgent opens the vault with the unlock key of a running agent. It
+// returns no encryptor and no error if there is no unlocked agent, or if its
+// key no longer unlocks the vault, so that the master password is asked for
+// instead.
+func unlockWithAgent(dbPath string, db *database.DB, force bool) (*crypto.Encryptor, error) {
+	socketPath, err := agent.SocketPath(dbPath)
+	if err != nil {
+		return nil, nil
+	}
+
+	key, err := agent.NewClient(socketPath).UnlockKey()
+	if errors.Is(err, agent.ErrNotRunning) || errors.Is(err, agent.ErrLocked) {
+		return nil, nil
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "⚠️  Could not use the agent: %v\n", err)
+		return nil, nil
+	}
+	defer key.Wipe()
+
+	encryptor, err := crypto.NewEncryptorWithKey(key, db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "⚠️  The agent could not unlock the vault: %v\n", err)
+		return nil, nil
+	}
+	if err := checkIntegrity(encryptor, force); err != nil {
+		encryptor.Close()
+		return nil, err
+	}
+	return encryptor, nil
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"password-manager/internal/crypto"
 	"password-manager/internal/database"
 	"password-manager/internal/handlers"
@@ -13,40 +18,376 @@ import (
 	_ "modernc.org/sqlite"
 )
 
+// masterPasswordEnv is the environment variable scripts can pass the master
+// password in. Unlike a password read from a file descriptor, it cannot be
+// wiped: it stays in the environment block the process started with and in
+// the string the runtime copied it to.
+const masterPasswordEnv = "PM_MASTER_PASSWORD"
+
 func main() {
-	// Initialize database first
+	keyFilePath := flag.String("keyfile", "", "path to the key file required to unlock the vault")
+	force := flag.Bool("force", false, "open the vault even if it fails its integrity check")
+	passwordFD := flag.Int("password-fd", -1, "read the master password from this file descriptor; prefer it to "+masterPasswordEnv+", which cannot be wiped from memory")
+	flag.Parse()
+
 	dbPath := "passwords.db"
+	if flag.Arg(0) == "agent" {
+		os.Exit(runAgent(dbPath, flag.Args()[1:], *keyFilePath, *passwordFD, *force))
+	}
+	if command := flag.Arg(0); command != "" && command != "recover" {
+		os.Exit(runCommand(dbPath, command, flag.Args()[1:], *keyFilePath, *passwordFD, *force))
+	}
+
+	// Initialize database first
 	db, err := database.NewDB(dbPath)
 	if err != nil {
 		log.Fatal("Error initializing database:", err)
 	}
-	defer db.Close()
 
-	// Get master password
-	fmt.Print("Enter master password: ")
-	masterPassword, err := term.ReadPassword(int(syscall.Stdin))
-	fmt.Println()
-	if err != nil {
-		log.Fatal("Error reading master password:", err)
+	// Read the key file used as a second factor
+	var keyFile []byte
+	if *keyFilePath != "" {
+		keyFile, err = crypto.ReadKeyFile(*keyFilePath)
+		if err != nil {
+			log.Fatal("Error reading key file:", err)
+		}
 	}
 
-	if len(masterPassword) == 0 {
-		log.Fatal("Master password cannot be empty")
+	var encryptor *crypto.Encryptor
+	switch flag.Arg(0) {
+	case "":
+		encryptor, err = unlock(db, keyFile, *passwordFD, *force)
+	case "recover":
+		recoverFlags := flag.NewFlagSet("recover", flag.ExitOnError)
+		useShares := recoverFlags.Bool("shares", false, "recover by combining recovery key shares")
+		recoverFlags.Parse(flag.Args()[1:])
+		encryptor, err = recoverVault(db, keyFile, *useShares, *force)
 	}
-
-	// Initialize encryption with database connection
-	encryptor, err := crypto.NewEncryptor(string(masterPassword), db)
+	crypto.Wipe(keyFile)
 	if err != nil {
-		log.Fatal("Error initializing encryption:", err)
+		log.Fatal("Error opening vault: ", err)
 	}
 
 	// Initialize services
-	passwordService := services.NewPasswordService(db, encryptor)
+	passwordService, err := services.NewPasswordService(db, encryptor)
+	if err != nil {
+		log.Fatal("Error opening vault:", err)
+	}
 	generatorService := services.NewGeneratorService()
 
-	// Initialize CLI handler
-	cliHandler := handlers.NewCLIHandler(passwordService, generatorService)
+	// Initialize CLI handler, which closes the vault when it locks or exits
+	cliHandler := handlers.NewCLIHandler(passwordService, generatorService, func(masterPassword []byte) (*services.PasswordService, error) {
+		return reopenVault(dbPath, *keyFilePath, masterPassword)
+	})
 
 	// Start CLI
 	cliHandler.Start()
 }
+
+// reopenVault opens the vault again after the menu locked it. The key file is
+// read again, so it must still be at hand, and a failed integrity check is an
+// error even with --force, as the vault changed while it was locked.
+func reopenVault(dbPath, keyFilePath string, masterPassword []byte) (*services.PasswordService, error) {
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, fmt.Errorf("no vault to open: %w", err)
+	}
+
+	var keyFile []byte
+	if keyFilePath != "" {
+		var err error
+		if keyFile, err = crypto.ReadKeyFile(keyFilePath); err != nil {
+			return nil, fmt.Errorf("reading key file: %w", err)
+		}
+		defer crypto.Wipe(keyFile)
+	}
+
+	db, err := database.NewDB(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	encryptor, err := crypto.NewEncryptor(masterPassword, keyFile, db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := encryptor.IntegrityError(); err != nil {
+		encryptor.Close()
+		db.Close()
+		return nil, err
+	}
+
+	passwordService, err := services.NewPasswordService(db, encryptor)
+	if err != nil {
+		encryptor.Close()
+		db.Close()
+		return nil, err
+	}
+	return passwordService, nil
+}
+
+// runCommand runs a non-interactive subcommand and returns its exit code. The
+// vault is only opened if the command needs it, with the unlock key held by
+// the agent if one is running.
+func runCommand(dbPath, command string, args []string, keyFilePath string, passwordFD int, force bool) int {
+	var db *database.DB
+	var encryptor *crypto.Encryptor
+	defer func() {
+		if encryptor != nil {
+			encryptor.Close()
+		}
+		if db != nil {
+			db.Close()
+		}
+	}()
+
+	openVault := func() (*services.PasswordService, error) {
+		// Scripts never create a vault, as its recovery key could not be shown
+		if _, err := os.Stat(dbPath); err != nil {
+			return nil, fmt.Errorf("no vault to open: %w", err)
+		}
+
+		var err error
+		if db, err = database.NewDB(dbPath); err != nil {
+			return nil, err
+		}
+
+		if encryptor, err = unlockWithAgent(dbPath, db, force); err != nil {
+			return nil, err
+		}
+		if encryptor != nil {
+			return services.NewPasswordService(db, encryptor)
+		}
+
+		var keyFile []byte
+		if keyFilePath != "" {
+			if keyFile, err = crypto.ReadKeyFile(keyFilePath); err != nil {
+				return nil, fmt.Errorf("reading key file: %w", err)
+			}
+			defer crypto.Wipe(keyFile)
+		}
+
+		if encryptor, err = unlock(db, keyFile, passwordFD, force); err != nil {
+			return nil, err
+		}
+		return services.NewPasswordService(db, encryptor)
+	}
+
+	return handlers.NewCommandHandler(openVault, services.NewGeneratorService()).Run(command, args)
+}
+
+// unlock opens the vault with the master password
+func unlock(db *database.DB, keyFile []byte, passwordFD int, force bool) (*crypto.Encryptor, error) {
+	// Get master password
+	masterPassword, err := readMasterPassword(passwordFD)
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.Wipe(masterPassword)
+	if len(masterPassword) == 0 {
+		return nil, errors.New("master password cannot be empty")
+	}
+
+	// Initialize encryption with database connection
+	encryptor, err := crypto.NewEncryptor(masterPassword, keyFile, db)
+	if err != nil {
+		return nil, fmt.Errorf("initializing encryption: %w", err)
+	}
+	if err := checkIntegrity(encryptor, force); err != nil {
+		encryptor.Close()
+		return nil, err
+	}
+	return encryptor, nil
+}
+
+// checkIntegrity returns the error of a vault that failed its integrity
+// check, unless forced
+func checkIntegrity(encryptor *crypto.Encryptor, force bool) error {
+	err := encryptor.IntegrityError()
+	if err == nil {
+		return nil
+	}
+	if !force {
+		return fmt.Errorf("%w (use --force to open it anyway)", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "⚠️  %v\n", err)
+	fmt.Fprintln(os.Stderr, "Continuing because of --force. The current contents are now trusted.")
+	if err := encryptor.AcceptIntegrity(); err != nil {
+		return fmt.Errorf("updating vault integrity: %w", err)
+	}
+	return nil
+}
+
+// recoverVault opens the vault with the recovery key, or with its shares, and
+// sets a new master password. The key file given with --keyfile, if any,
+// becomes required.
+func recoverVault(db *database.DB, keyFile []byte, useShares, force bool) (*crypto.Encryptor, error) {
+	var recoveryKey []byte
+	var err error
+	if useShares {
+		recoveryKey, err = readShares()
+	} else {
+		var encoded []byte
+		if encoded, err = readSecret("Enter recovery key: "); err == nil {
+			recoveryKey, err = crypto.ParseRecoveryKey(encoded)
+			crypto.Wipe(encoded)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading recovery key: %w", err)
+	}
+	defer crypto.Wipe(recoveryKey)
+
+	encryptor, err := crypto.RecoverEncryptor(recoveryKey, db)
+	if err != nil {
+		return nil, fmt.Errorf("recovering vault: %w", err)
+	}
+	if err := resetMasterPassword(encryptor, keyFile, force); err != nil {
+		encryptor.Close()
+		return nil, err
+	}
+
+	fmt.Println("✅ Master password reset. Consider rotating the recovery key from the Vault security menu.")
+	return encryptor, nil
+}
+
+// resetMasterPassword checks the integrity of a vault opened with its
+// recovery key and sets the new master password read from the terminal
+func resetMasterPassword(encryptor *crypto.Encryptor, keyFile []byte, force bool) error {
+	if err := checkIntegrity(encryptor, force); err != nil {
+		return err
+	}
+
+	newPassword, err := readSecret("New master password: ")
+	if err != nil {
+		return err
+	}
+	defer crypto.Wipe(newPassword)
+	if len(newPassword) == 0 {
+		return errors.New("master password cannot be empty")
+	}
+	confirmPassword, err := readSecret("Confirm new master password: ")
+	if err != nil {
+		return err
+	}
+	defer crypto.Wipe(confirmPassword)
+	if !bytes.Equal(newPassword, confirmPassword) {
+		return errors.New("passwords do not match")
+	}
+
+	if err := encryptor.ResetMasterPassword(newPassword, keyFile); err != nil {
+		return fmt.Errorf("setting master password: %w", err)
+	}
+	return nil
+}
+
+// readShares reads recovery key shares until enough are given to combine them
+func readShares() ([]byte, error) {
+	var shares []crypto.Share
+	defer func() {
+		for _, share := range shares {
+			crypto.Wipe(share.Value)
+		}
+	}()
+
+	for {
+		encoded, err := readSecret(fmt.Sprintf("Enter share %d: ", len(shares)+1))
+		if err != nil {
+			return nil, err
+		}
+		share, err := crypto.ParseShare(encoded)
+		crypto.Wipe(encoded)
+		if err != nil {
+			fmt.Printf("❌ Invalid share: %v\n", err)
+			continue
+		}
+		shares = append(shares, share)
+
+		// The first share decides how many are needed; CombineShares
+		// rejects shares from another split
+		if len(shares) >= shares[0].Threshold {
+			return crypto.CombineShares(shares)
+		}
+		fmt.Printf("%d of %d shares entered.\n", len(shares), shares[0].Threshold)
+	}
+}
+
+// readMasterPassword reads the master password from the file descriptor given
+// with --password-fd, the PM_MASTER_PASSWORD environment variable or the
+// terminal, in that order
+func readMasterPassword(passwordFD int) ([]byte, error) {
+	if passwordFD >= 0 {
+		f := os.NewFile(uintptr(passwordFD), "password-fd")
+		if f == nil {
+			return nil, fmt.Errorf("reading master password: invalid file descriptor %d", passwordFD)
+		}
+
+		// Only the first line is read, so the writer need not close its end.
+		// The descriptor is ours once given and is closed here.
+		defer f.Close()
+		secret, err := readLine(f)
+		if err != nil {
+			return nil, fmt.Errorf("reading master password: %w", err)
+		}
+		return secret, nil
+	}
+
+	if value, ok := os.LookupEnv(masterPasswordEnv); ok {
+		// Keep it from child processes. The copies in memory remain.
+		os.Unsetenv(masterPasswordEnv)
+		return []byte(value), nil
+	}
+
+	return readSecret("Enter master password: ")
+}
+
+// readLine reads a line from r without its line ending. It reads one byte at
+// a time, so nothing after the line is consumed, and wipes the buffer it
+// outgrows. A last line without a line ending is accepted.
+func readLine(r io.Reader) ([]byte, error) {
+	line := make([]byte, 0, 64)
+	var b [1]byte
+	defer crypto.Wipe(b[:])
+
+	for {
+		n, err := r.Read(b[:])
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			if len(line) == cap(line) {
+				grown := make([]byte, len(line), 2*cap(line))
+				copy(grown, line)
+				crypto.Wipe(line)
+				line = grown
+			}
+			line = append(line, b[0])
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			break
+		}
+		if err != nil {
+			crypto.Wipe(line)
+			return nil, err
+		}
+	}
+
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line[len(line)-1] = 0
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+// readSecret reads a line from the terminal without echoing it. The prompt
+// goes to stderr so it stays out of the output of commands.
+func readSecret(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	secret, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("reading input: %w", err)
+	}
+	return secret, nil
+}
@@ -0,0 +1,309 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"password-manager/internal/crypto"
+)
+
+// DefaultIdleTimeout is how long the agent stays unlocked without requests
+const DefaultIdleTimeout = 15 * time.Minute
+
+// requestTimeout bounds how long a client may take to send a request and
+// read the response
+const requestTimeout = 5 * time.Second
+
+// maxRequestSize bounds the size of a request
+const maxRequestSize = 64 * 1024
+
+// Requests the agent serves
+const (
+	opUnlock = "unlock" // return the unlock key
+	opLoad   = "load"   // replace the unlock key after the agent was locked
+	opLock   = "lock"   // wipe the unlock key
+	opStatus = "status"
+	opStop   = "stop"
+)
+
+// ErrRunning is returned when starting an agent for a vault that already has one
+var ErrRunning = errors.New("agent is already running")
+
+// request is the single JSON line a client sends per connection
+type request struct {
+	Op  string `json:"op"`
+	Key []byte `json:"key,omitempty"` // unlock key for opLoad
+}
+
+// response is the single JSON line the agent answers with
+type response struct {
+	Error  string  `json:"error,omitempty"`
+	Key    []byte  `json:"key,omitempty"` // unlock key for opUnlock
+	Status *Status `json:"status,omitempty"`
+}
+
+// Status describes a running agent
+type Status struct {
+	PID         int           `json:"pid"`
+	Locked      bool          `json:"locked"`
+	IdleTimeout time.Duration `json:"idle_timeout"` // zero if the agent never locks by itself
+	LocksIn     time.Duration `json:"locks_in"`     // time left until the idle lock
+}
+
+// Agent holds the unlock key of a vault and hands it to processes of the same
+// user, so that commands need not ask for the master password. The key is
+// wiped after the idle timeout or when the agent is locked.
+type Agent struct {
+	mu          sync.Mutex
+	key         *crypto.UnlockKey                 // nil while locked
+	verify      func(key *crypto.UnlockKey) error // checks keys loaded later
+	idleTimeout time.Duration
+	expires     time.Time
+	timer       *time.Timer
+	listener    net.Listener
+	stopped     bool
+}
+
+// New creates an agent holding key, which it takes ownership of. An idle
+// timeout of zero keeps the agent unlocked until it is locked or stopped.
+// Keys loaded into a locked agent are only kept if verify accepts them.
+func New(key *crypto.UnlockKey, idleTimeout time.Duration, verify func(key *crypto.UnlockKey) error) *Agent {
+	a := &Agent{key: key, verify: verify, idleTimeout: idleTimeout}
+	a.touch()
+	return a
+}
+
+// SocketPath returns the path of the agent socket for the vault at vaultPath.
+// Each vault has its own agent, found by a hash of its absolute path.
+func SocketPath(vaultPath string) (string, error) {
+	path, err := filepath.Abs(vaultPath)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	sum := sha256.Sum256([]byte(path))
+	name := "agent-" + hex.EncodeToString(sum[:8]) + ".sock"
+
+	// The runtime directory is private to the user; elsewhere the agent
+	// directory is created private
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return filepath.Join(runtimeDir, "password-manager", name), nil
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("password-manager-%d", os.Getuid()), name), nil
+}
+
+// Listen creates the agent socket at path, readable and writable only by the
+// user, in a directory only the user can enter. A socket left behind by an
+// agent that did not stop cleanly is replaced. As only the agent listens,
+// the memory of the process is protected first.
+func Listen(path string) (net.Listener, error) {
+	// Other processes of the user must not read the key out of memory
+	if err := hardenProcess(); err != nil {
+		return nil, fmt.Errorf("protecting agent memory: %w", err)
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() || info.Mode().Perm()&0o077 != 0 || !ownedByUser(info) {
+		return nil, fmt.Errorf("agent directory %s must be a directory private to the user", dir)
+	}
+
+	if conn, err := net.DialTimeout("unix", path, requestTimeout); err == nil {
+		conn.Close()
+		return nil, ErrRunning
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Serve answers requests on listener until the agent is stopped
+func (a *Agent) Serve(listener net.Listener) error {
+	a.mu.Lock()
+	a.listener = listener
+	stopped := a.stopped
+	a.mu.Unlock()
+	if stopped {
+		return listener.Close()
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			a.mu.Lock()
+			stopped := a.stopped
+			a.mu.Unlock()
+			if stopped {
+				return nil
+			}
+			return err
+		}
+		go a.handle(conn)
+	}
+}
+
+// Lock wipes the unlock key. The agent keeps running, but refuses to unlock
+// the vault until a key is loaded again.
+func (a *Agent) Lock() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lock()
+}
+
+// Stop wipes the unlock key and stops serving requests
+func (a *Agent) Stop() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stop()
+}
+
+// handle answers the request of one connection, if it comes from the user
+// the agent runs as
+func (a *Agent) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	uid, err := peerUID(conn)
+	if err != nil || uid != os.Getuid() {
+		writeResponse(conn, &response{Error: "permission denied"})
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(io.LimitReader(conn, maxRequestSize)).Decode(&req); err != nil {
+		writeResponse(conn, &response{Error: "invalid request"})
+		return
+	}
+	defer crypto.Wipe(req.Key)
+
+	resp := a.serve(&req)
+	writeResponse(conn, resp)
+	crypto.Wipe(resp.Key)
+}
+
+// serve answers a request
+func (a *Agent) serve(req *request) *response {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch req.Op {
+	case opUnlock:
+		if a.key == nil {
+			return &response{Error: ErrLocked.Error()}
+		}
+		key, err := a.key.MarshalBinary()
+		if err != nil {
+			return &response{Error: err.Error()}
+		}
+		a.touch()
+		return &response{Key: key}
+	case opLoad:
+		key := &crypto.UnlockKey{}
+		if err := key.UnmarshalBinary(req.Key); err != nil {
+			return &response{Error: err.Error()}
+		}
+		if err := a.verify(key); err != nil {
+			key.Wipe()
+			return &response{Error: "unlock key does not open the vault: " + err.Error()}
+		}
+		a.lock()
+		a.key = key
+		a.touch()
+		return &response{}
+	case opLock:
+		a.lock()
+		return &response{}
+	case opStatus:
+		return &response{Status: a.status()}
+	case opStop:
+		// This connection is still answered after the listener is closed
+		a.stop()
+		return &response{}
+	}
+	return &response{Error: fmt.Sprintf("unknown request %q", req.Op)}
+}
+
+// touch restarts the idle timeout
+func (a *Agent) touch() {
+	if a.idleTimeout <= 0 {
+		return
+	}
+	a.expires = time.Now().Add(a.idleTimeout)
+	if a.timer == nil {
+		a.timer = time.AfterFunc(a.idleTimeout, a.lockIfIdle)
+	} else {
+		a.timer.Reset(a.idleTimeout)
+	}
+}
+
+// lockIfIdle locks the agent once the idle timeout has passed without
+// requests
+func (a *Agent) lockIfIdle() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.key != nil && !time.Now().Before(a.expires) {
+		a.lock()
+	}
+}
+
+// lock wipes the unlock key. The caller holds the mutex.
+func (a *Agent) lock() {
+	if a.key != nil {
+		a.key.Wipe()
+		a.key = nil
+	}
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+}
+
+// stop wipes the unlock key and closes the listener. The caller holds the
+// mutex.
+func (a *Agent) stop() {
+	a.lock()
+	a.stopped = true
+	if a.listener != nil {
+		a.listener.Close()
+	}
+}
+
+// status returns the status of the agent. The caller holds the mutex.
+func (a *Agent) status() *Status {
+	status := &Status{PID: os.Getpid(), Locked: a.key == nil, IdleTimeout: a.idleTimeout}
+	if !status.Locked && a.idleTimeout > 0 {
+		status.LocksIn = time.Until(a.expires).Round(time.Second)
+	}
+	return status
+}
+
+// writeResponse sends a response to the client
+func writeResponse(conn net.Conn, resp *response) {
+	json.NewEncoder(conn).Encode(resp)
+}
@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"password-manager/internal/crypto"
+)
+
+// ErrNotRunning is returned when no agent serves the vault
+var ErrNotRunning = errors.New("agent is not running")
+
+// ErrLocked is returned when asking a locked agent for the unlock key
+var ErrLocked = errors.New("agent is locked")
+
+// Client talks to the agent of a vault
+type Client struct {
+	path string
+}
+
+// NewClient creates a client for the agent listening on the socket at path
+func NewClient(path string) *Client {
+	return &Client{path: path}
+}
+
+// UnlockKey returns the unlock key held by the agent, restarting its idle
+// timeout. Wipe the key after use.
+func (c *Client) UnlockKey() (*crypto.UnlockKey, error) {
+	resp, err := c.call(&request{Op: opUnlock})
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.Wipe(resp.Key)
+
+	key := &crypto.UnlockKey{}
+	if err := key.UnmarshalBinary(resp.Key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Load gives a locked agent a new unlock key
+func (c *Client) Load(key *crypto.UnlockKey) error {
+	encoded, err := key.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	defer crypto.Wipe(encoded)
+
+	_, err = c.call(&request{Op: opLoad, Key: encoded})
+	return err
+}
+
+// Lock makes the agent wipe its unlock key
+func (c *Client) Lock() error {
+	_, err := c.call(&request{Op: opLock})
+	return err
+}
+
+// Status returns the status of the agent
+func (c *Client) Status() (*Status, error) {
+	resp, err := c.call(&request{Op: opStatus})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status == nil {
+		return nil, errors.New("agent sent no status")
+	}
+	return resp.Status, nil
+}
+
+// Stop makes the agent wipe its unlock key and exit
+func (c *Client) Stop() error {
+	_, err := c.call(&request{Op: opStop})
+	return err
+}
+
+// call sends a request to the agent and reads its response. The agent must
+// run as the same user.
+func (c *Client) call(req *request) (*response, error) {
+	conn, err := net.DialTimeout("unix", c.path, requestTimeout)
+	if err != nil {
+		return nil, ErrNotRunning
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	uid, err := peerUID(conn)
+	if err != nil {
+		return nil, err
+	}
+	if uid != os.Getuid() {
+		return nil, errors.New("agent socket belongs to another user")
+	}
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+
+	var resp response
+	if err := json.NewDecoder(io.LimitReader(conn, maxRequestSize)).Decode(&resp); err != nil {
+		crypto.Wipe(resp.Key)
+		return nil, err
+	}
+	switch resp.Error {
+	case "":
+		return &resp, nil
+	case ErrLocked.Error():
+		return nil, ErrLocked
+	}
+	return nil, errors.New(resp.Error)
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+
+package agent
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// errUnsupported is returned where peer credentials cannot be checked
+var errUnsupported = errors.New("the unlock agent is only supported on Linux")
+
+// peerUID is not available, so the agent refuses every connection
+func peerUID(conn net.Conn) (int, error) {
+	return 0, errUnsupported
+}
+
+// ownedByUser cannot check file owners, so no agent directory is trusted
+func ownedByUser(info os.FileInfo) bool {
+	return false
+}
+
+// hardenProcess refuses to run the agent
+func hardenProcess() error {
+	return errUnsupported
+}
+
+// DetachAttr returns no process attributes
+func DetachAttr() *syscall.SysProcAttr {
+	return nil
+}
@@ -0,0 +1,131 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strconv"
+
+	"password-manager/internal/database"
+)
+
+// vaultIDMetadataKey is the vault metadata key holding the vault ID
+const vaultIDMetadataKey = "vault_id"
+
+// Contexts prefixing the associated data of entry ciphertexts
+const (
+	entryAADContext      = "password-manager entry v1"
+	fieldAADContext      = "password-manager field v1"
+	labelAADContext      = "password-manager label v1"
+	attachmentAADContext = "password-manager attachment v1"
+)
+
+// ErrTampered is returned when a ciphertext does not belong to the entry it
+// was read from
+var ErrTampered = errors.New("entry failed integrity check (possible tampering)")
+
+// loadVaultID returns the random ID of the vault, creating it on first use
+func loadVaultID(db *database.DB) (string, error) {
+	vaultID, found, err := db.GetMetadata(vaultIDMetadataKey)
+	if err != nil || found {
+		return vaultID, err
+	}
+
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", err
+	}
+	vaultID = hex.EncodeToString(id)
+
+	if err := db.SetMetadata(vaultIDMetadataKey, vaultID); err != nil {
+		return "", err
+	}
+	return vaultID, nil
+}
+
+// EntryAAD returns the associated data binding a ciphertext to the vault and
+// to the entry with the given ID, service and username
+func (e *Encryptor) EntryAAD(entryID int, service, username string) []byte {
+	return associatedData(entryAADContext, e.vaultID, strconv.Itoa(entryID), service, username)
+}
+
+// FieldAAD returns the associated data binding an encrypted metadata field to
+// the vault, the entry with the given ID and the field name
+func (e *Encryptor) FieldAAD(entryID int, field string) []byte {
+	return associatedData(fieldAADContext, e.vaultID, strconv.Itoa(entryID), field)
+}
+
+// LabelAAD returns the associated data binding the encrypted name of a folder
+// or tag to the vault and to the label with the given kind and ID
+func (e *Encryptor) LabelAAD(kind string, id int) []byte {
+	return associatedData(labelAADContext, e.vaultID, kind, strconv.Itoa(id))
+}
+
+// AttachmentAAD returns the associated data binding part of an attachment,
+// such as its metadata or one of its chunks, to the vault, the attachment
+// and the entry it belongs to
+func (e *Encryptor) AttachmentAAD(attachmentID, entryID int, part string) []byte {
+	return associatedData(attachmentAADContext, e.vaultID, strconv.Itoa(attachmentID), strconv.Itoa(entryID), part)
+}
+
+// associatedData encodes a context and its parts as associated data
+func associatedData(context string, parts ...string) []byte {
+	var aad bytes.Buffer
+	aad.WriteString(context)
+	for _, part := range parts {
+		// Length-prefix each part so that no two inputs share an encoding
+		binary.Write(&aad, binary.BigEndian, uint32(len(part)))
+		aad.WriteString(part)
+	}
+	return aad.Bytes()
+}
+
+// EncryptWithAAD encrypts the given plaintext bound to associated data
+func (e *Encryptor) EncryptWithAAD(plaintext, additionalData []byte) (string, error) {
+	if e.key == nil {
+		return "", ErrLocked
+	}
+	return seal(e.aead, keyIDDataKey, e.key, plaintext, additionalData)
+}
+
+// DecryptWithAAD decrypts a ciphertext produced by EncryptWithAAD. It returns
+// ErrTampered if the associated data does not match. Wipe the plaintext after
+// use.
+func (e *Encryptor) DecryptWithAAD(ciphertext string, additionalData []byte) ([]byte, error) {
+	if e.key == nil {
+		return nil, ErrLocked
+	}
+
+	plaintext, err := open(keyIDDataKey, e.key, ciphertext, additionalData)
+	if errors.Is(err, errAuthentication) {
+		return nil, ErrTampered
+	}
+	return plaintext, err
+}
+
+// EncryptBytesWithAAD encrypts the given plaintext bound to associated data
+// into a binary envelope, for ciphertexts stored as BLOBs
+func (e *Encryptor) EncryptBytesWithAAD(plaintext, additionalData []byte) ([]byte, error) {
+	if e.key == nil {
+		return nil, ErrLocked
+	}
+	return sealBytes(e.aead, keyIDDataKey, e.key, plaintext, additionalData)
+}
+
+// DecryptBytesWithAAD decrypts a binary envelope produced by
+// EncryptBytesWithAAD. It returns ErrTampered if the associated data does not
+// match. Wipe the plaintext after use.
+func (e *Encryptor) DecryptBytesWithAAD(ciphertext, additionalData []byte) ([]byte, error) {
+	if e.key == nil {
+		return nil, ErrLocked
+	}
+
+	plaintext, err := openBytes(keyIDDataKey, e.key, ciphertext, additionalData)
+	if errors.Is(err, errAuthentication) {
+		return nil, ErrTampered
+	}
+	return plaintext, err
+}
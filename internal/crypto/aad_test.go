@@ -0,0 +1,81 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+// newTestEncryptor returns an unlocked encryptor for a vault with the given
+// ID, sealing with alg under a random data key
+func newTestEncryptor(t *testing.T, vaultID string, alg AEAD) *Encryptor {
+	t.Helper()
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return &Encryptor{key: key, vaultID: vaultID, aead: alg}
+}
+
+func TestAADSwap(t *testing.T) {
+	e := newTestEncryptor(t, "vault-a", DefaultAEAD())
+	// The same key under another vault ID, as if the row was copied over
+	other := &Encryptor{key: e.key, vaultID: "vault-b", aead: e.aead}
+
+	tests := []struct {
+		name      string
+		sealed    []byte
+		opened    []byte
+		decryptor *Encryptor
+	}{
+		{"entry ID", e.EntryAAD(1, "example", "alice"), e.EntryAAD(2, "example", "alice"), e},
+		{"service", e.EntryAAD(1, "example", "alice"), e.EntryAAD(1, "other", "alice"), e},
+		{"username", e.EntryAAD(1, "example", "alice"), e.EntryAAD(1, "example", "bob"), e},
+		{"field", e.FieldAAD(1, "url"), e.FieldAAD(1, "notes"), e},
+		{"field entry ID", e.FieldAAD(1, "url"), e.FieldAAD(2, "url"), e},
+		{"label kind", e.LabelAAD("folder", 1), e.LabelAAD("tag", 1), e},
+		{"attachment chunk", e.AttachmentAAD(1, 1, "chunk 0"), e.AttachmentAAD(1, 1, "chunk 1"), e},
+		{"attachment entry ID", e.AttachmentAAD(1, 1, "metadata"), e.AttachmentAAD(1, 2, "metadata"), e},
+		{"cross-vault", e.EntryAAD(1, "example", "alice"), other.EntryAAD(1, "example", "alice"), other},
+		// Length prefixes keep parts from running into each other
+		{"part boundary", e.EntryAAD(1, "ab", "c"), e.EntryAAD(1, "a", "bc"), e},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ciphertext, err := e.EncryptWithAAD([]byte("secret"), tt.sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plaintext, err := e.DecryptWithAAD(ciphertext, tt.sealed)
+			if err != nil || string(plaintext) != "secret" {
+				t.Fatalf("DecryptWithAAD with the sealing AAD = %q, %v", plaintext, err)
+			}
+			if _, err := tt.decryptor.DecryptWithAAD(ciphertext, tt.opened); !errors.Is(err, ErrTampered) {
+				t.Errorf("DecryptWithAAD with swapped AAD: got error %v, want %v", err, ErrTampered)
+			}
+
+			data, err := e.EncryptBytesWithAAD([]byte("secret"), tt.sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tt.decryptor.DecryptBytesWithAAD(data, tt.opened); !errors.Is(err, ErrTampered) {
+				t.Errorf("DecryptBytesWithAAD with swapped AAD: got error %v, want %v", err, ErrTampered)
+			}
+		})
+	}
+}
+
+func TestAADOtherVaultKey(t *testing.T) {
+	// Two vaults with the same ID still have their own data keys
+	a := newTestEncryptor(t, "vault", DefaultAEAD())
+	b := newTestEncryptor(t, "vault", DefaultAEAD())
+
+	aad := a.EntryAAD(1, "example", "alice")
+	ciphertext, err := a.EncryptWithAAD([]byte("secret"), aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.DecryptWithAAD(ciphertext, b.EntryAAD(1, "example", "alice")); !errors.Is(err, ErrTampered) {
+		t.Errorf("ciphertext of another vault: got error %v, want %v", err, ErrTampered)
+	}
+}
@@ -0,0 +1,85 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+
+	"password-manager/internal/database"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Algorithm identifiers recorded in ciphertext envelopes
+const (
+	AlgorithmAES256GCM         byte = 1
+	AlgorithmXChaCha20Poly1305 byte = 2
+)
+
+// cipherMetadataKey is the vault metadata key naming the AEAD for new ciphertexts
+const cipherMetadataKey = "cipher"
+
+// AEAD is an authenticated cipher that vault ciphertexts can be sealed with
+type AEAD interface {
+	// ID returns the algorithm identifier written to ciphertext envelopes
+	ID() byte
+	// Name returns the name stored in the vault metadata
+	Name() string
+	// New returns the cipher for a 256-bit key
+	New(key []byte) (cipher.AEAD, error)
+}
+
+type aes256GCM struct{}
+
+func (aes256GCM) ID() byte     { return AlgorithmAES256GCM }
+func (aes256GCM) Name() string { return "aes-256-gcm" }
+
+func (aes256GCM) New(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type xChaCha20Poly1305 struct{}
+
+func (xChaCha20Poly1305) ID() byte     { return AlgorithmXChaCha20Poly1305 }
+func (xChaCha20Poly1305) Name() string { return "xchacha20-poly1305" }
+
+func (xChaCha20Poly1305) New(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.NewX(key)
+}
+
+// algorithms lists the supported AEADs by envelope identifier
+var algorithms = map[byte]AEAD{
+	AlgorithmAES256GCM:         aes256GCM{},
+	AlgorithmXChaCha20Poly1305: xChaCha20Poly1305{},
+}
+
+// DefaultAEAD returns the AEAD used by vaults that have not chosen one
+func DefaultAEAD() AEAD {
+	return aes256GCM{}
+}
+
+// AEADByName returns the supported AEAD with the given name
+func AEADByName(name string) (AEAD, error) {
+	for _, alg := range algorithms {
+		if alg.Name() == name {
+			return alg, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported cipher: %s", name)
+}
+
+// loadAEAD returns the AEAD the vault seals new ciphertexts with
+func loadAEAD(db *database.DB) (AEAD, error) {
+	name, found, err := db.GetMetadata(cipherMetadataKey)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return DefaultAEAD(), nil
+	}
+	return AEADByName(name)
+}
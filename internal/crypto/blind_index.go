@@ -0,0 +1,29 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// blindIndexContext derives the blind index key from the vault data key
+const blindIndexContext = "password-manager blind index v1"
+
+// deriveIndexKey derives the key used for blind indexes from the data key
+func deriveIndexKey(dataKey []byte) []byte {
+	mac := hmac.New(sha256.New, dataKey)
+	mac.Write([]byte(blindIndexContext))
+	return mac.Sum(nil)
+}
+
+// BlindIndex returns a keyed hash of a service and username, used to look up
+// and deduplicate entries without storing either in plaintext
+func (e *Encryptor) BlindIndex(service, username string) (string, error) {
+	if e.indexKey == nil {
+		return "", ErrLocked
+	}
+
+	mac := hmac.New(sha256.New, e.indexKey)
+	mac.Write(associatedData(blindIndexContext, service, username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
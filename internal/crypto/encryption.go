@@ -1,128 +1,389 @@
 package crypto
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
-	"database/sql"
 	"encoding/base64"
 	"errors"
 	"io"
 
 	"password-manager/internal/database"
-
-	"golang.org/x/crypto/pbkdf2"
 )
 
 type Encryptor struct {
-	key []byte
-	db  *database.DB
+	key          []byte      // vault data key
+	indexKey     []byte      // blind index key
+	keyFile      []byte      // key file digest, if the vault requires one
+	integrityKey []byte      // key of the vault integrity root
+	integrityErr error       // set if the vault failed its integrity check
+	aead         AEAD        // cipher for new ciphertexts
+	file         *fileCipher // set once the whole vault file is encrypted
+	vaultID      string
+	created      bool // vault was created by this unlock
+	db           *database.DB
 }
 
-// HashPassword creates a hash of the master password
-func HashPassword(password string) string {
-	hash := sha256.Sum256([]byte(password))
-	return base64.StdEncoding.EncodeToString(hash[:])
-}
+// errAuthentication is returned by open when the ciphertext fails to verify
+var errAuthentication = errors.New("message authentication failed")
 
-// NewEncryptor creates a new encryptor with the given master password
-func NewEncryptor(masterPassword string, db *database.DB) (*Encryptor, error) {
-	// Hash the master password
-	passwordHash := HashPassword(masterPassword)
+// ErrLocked is returned when using an encryptor after Lock
+var ErrLocked = errors.New("vault is locked")
+
+// NewEncryptor creates a new encryptor with the given master password and the
+// digest of the key file returned by ReadKeyFile, or nil if no key file is
+// used. A key file given when the vault is created is required from then on.
+func NewEncryptor(masterPassword, keyFile []byte, db *database.DB) (*Encryptor, error) {
+	// Check if this is the first run. The verifier of an encrypted vault file
+	// is only readable once the file is decrypted.
+	sealed := db.IsSealed()
+	initialized := sealed
+	if !sealed {
+		var err error
+		if _, initialized, err = db.GetMasterPassword(); err != nil {
+			return nil, err
+		}
+	}
 
-	// Check if this is the first run
-	verified, err := db.VerifyMasterPassword(passwordHash)
+	// Derive the key encryption key from the master password and key file
+	kek, params, err := deriveVaultKEK(db, masterPassword, keyFile, initialized)
 	if err != nil {
 		return nil, err
 	}
+	defer Wipe(kek)
+	verifier := computeVerifier(kek)
+
+	// Decrypt an encrypted vault file with the data key wrapped in its header
+	var file *fileCipher
+	if sealed {
+		file, err = unsealWithKEK(db, kek)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	storedVerifier, _, err := db.GetMasterPassword()
+	if err != nil {
+		return nil, err
+	}
+
+	// Vaults with an integrity root are marked by their verifier
+	integrityRequired := hasIntegrityVerifier(storedVerifier)
 
-	// If not verified and no master password exists, set it
-	if !verified {
-		var storedHash string
-		err := db.Conn.QueryRow("SELECT password_hash FROM master_password ORDER BY id DESC LIMIT 1").Scan(&storedHash)
-		if err == sql.ErrNoRows {
-			// First run, set the master password
-			if err := db.SetMasterPassword(passwordHash); err != nil {
+	switch {
+	case !initialized:
+		// First run, set the master password
+		if err := db.SetMasterPassword(verifier); err != nil {
+			return nil, err
+		}
+		if keyFile != nil {
+			if err := db.SetMetadata(keyFileMetadataKey, "1"); err != nil {
 				return nil, err
 			}
-		} else if err != nil {
+		}
+	case isLegacyVerifier(storedVerifier):
+		// Replace the unsalted hash with a key-derived verifier
+		if !verifyLegacyHash(masterPassword, storedVerifier) {
+			return nil, errors.New("incorrect master password")
+		}
+		if err := db.SetMasterPassword(verifier); err != nil {
 			return nil, err
-		} else {
-			// Master password exists but doesn't match
+		}
+	case isV1Verifier(storedVerifier):
+		// Vaults from before the integrity root get one below
+		if !verifyV1Verifier(kek, storedVerifier) {
+			return nil, errors.New("incorrect master password")
+		}
+		if err := db.SetMasterPassword(verifier); err != nil {
+			return nil, err
+		}
+	default:
+		verified, err := db.VerifyMasterPassword(verifier)
+		if err != nil {
+			return nil, err
+		}
+		if !verified {
 			return nil, errors.New("incorrect master password")
 		}
 	}
 
-	// Get salt from database
-	saltStr, err := db.GetSalt()
+	aead, err := loadAEAD(db)
 	if err != nil {
 		return nil, err
 	}
 
-	salt, err := base64.StdEncoding.DecodeString(saltStr)
+	// Unwrap the vault data key, creating it for new and pre-envelope vaults
+	key, err := loadDataKey(db, kek, aead)
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(key)
+
+	vaultID, err := loadVaultID(db)
 	if err != nil {
 		return nil, err
 	}
 
-	// Generate a key from the master password using PBKDF2
-	key := pbkdf2.Key([]byte(masterPassword), salt, 100000, 32, sha256.New)
+	encryptor := &Encryptor{
+		key:          lockedCopy(key),
+		indexKey:     deriveIndexKey(key),
+		keyFile:      lockedCopy(keyFile),
+		integrityKey: deriveIntegrityKey(key),
+		aead:         aead,
+		file:         file,
+		vaultID:      vaultID,
+		created:      !initialized,
+		db:           db,
+	}
 
-	return &Encryptor{
-		key: key,
-		db:  db,
-	}, nil
+	if err := encryptor.checkIntegrity(integrityRequired); err != nil {
+		encryptor.Lock()
+		return nil, err
+	}
+
+	// Upgrade vaults using outdated KDF parameters in place, unless writes are
+	// blocked by a failed integrity check
+	if params != DefaultKDFParams() && encryptor.integrityErr == nil {
+		if err := encryptor.rekey(masterPassword, keyFile); err != nil {
+			encryptor.Lock()
+			return nil, err
+		}
+	}
+
+	return encryptor, nil
 }
 
-// Encrypt encrypts the given plaintext
-func (e *Encryptor) Encrypt(plaintext string) (string, error) {
-	block, err := aes.NewCipher(e.key)
+// VerifyMasterPassword reports whether password is the current master password
+func (e *Encryptor) VerifyMasterPassword(password []byte) (bool, error) {
+	if e.key == nil {
+		return false, ErrLocked
+	}
+
+	saltStr, err := e.db.GetSalt()
 	if err != nil {
-		return "", err
+		return false, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	salt, err := base64.StdEncoding.DecodeString(saltStr)
 	if err != nil {
-		return "", err
+		return false, err
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", err
+	params, found, err := loadKDFParams(e.db)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		return false, errors.New("vault has no KDF parameters")
+	}
+
+	kek, err := deriveKEK(params, password, salt, e.keyFile)
+	if err != nil {
+		return false, err
 	}
+	defer Wipe(kek)
 
-	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
+	return e.db.VerifyMasterPassword(computeVerifier(kek))
 }
 
-// Decrypt decrypts the given ciphertext
-func (e *Encryptor) Decrypt(ciphertext string) (string, error) {
-	data, err := base64.StdEncoding.DecodeString(ciphertext)
+// ChangeMasterPassword rewraps the vault data key under a key derived from
+// the new master password, keeping any key file requirement
+func (e *Encryptor) ChangeMasterPassword(newPassword []byte) error {
+	return e.rekey(newPassword, e.keyFile)
+}
+
+// SetKeyFile rewraps the vault data key so that unlocking requires the key
+// file with the given digest in addition to the master password. A nil
+// digest removes the key file requirement.
+func (e *Encryptor) SetKeyFile(masterPassword, keyFile []byte) error {
+	return e.rekey(masterPassword, keyFile)
+}
+
+// ResetMasterPassword sets a new master password and key file digest (nil
+// for none) without checking the old ones, after unlocking with a recovery key
+func (e *Encryptor) ResetMasterPassword(newPassword, keyFile []byte) error {
+	return e.rekey(newPassword, keyFile)
+}
+
+// VaultID returns the random ID of the vault
+func (e *Encryptor) VaultID() string {
+	return e.vaultID
+}
+
+// IsNew reports whether the vault was created when this encryptor unlocked it
+func (e *Encryptor) IsNew() bool {
+	return e.created
+}
+
+// KeyFileRequired reports whether unlocking the vault requires a key file
+func (e *Encryptor) KeyFileRequired() bool {
+	return e.keyFile != nil
+}
+
+// deriveVaultKEK checks the key file requirement of the vault and derives its
+// key encryption key with the KDF parameters it records. Parameters are
+// recorded for new vaults; vaults from before they were recorded use PBKDF2.
+func deriveVaultKEK(db *database.DB, masterPassword, keyFile []byte, initialized bool) ([]byte, KDFParams, error) {
+	keyFileRequired, err := isKeyFileRequired(db)
 	if err != nil {
-		return "", err
+		return nil, KDFParams{}, err
+	}
+	if initialized && keyFileRequired && keyFile == nil {
+		return nil, KDFParams{}, ErrKeyFileRequired
+	}
+	if initialized && !keyFileRequired && keyFile != nil {
+		return nil, KDFParams{}, errors.New("this vault does not use a key file")
+	}
+
+	// Get salt from database
+	saltStr, err := db.GetSalt()
+	if err != nil {
+		return nil, KDFParams{}, err
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(saltStr)
+	if err != nil {
+		return nil, KDFParams{}, err
+	}
+
+	params, found, err := loadKDFParams(db)
+	if err != nil {
+		return nil, KDFParams{}, err
+	}
+	if !found {
+		if initialized {
+			params = LegacyKDFParams()
+		} else {
+			params = DefaultKDFParams()
+			if err := storeKDFParams(db, params); err != nil {
+				return nil, KDFParams{}, err
+			}
+		}
+	}
+
+	kek, err := deriveKEK(params, masterPassword, salt, keyFile)
+	if err != nil {
+		return nil, KDFParams{}, err
+	}
+	return kek, params, nil
+}
+
+// deriveKEK derives the key encryption key from the master password, mixing
+// in the key file digest if there is one
+func deriveKEK(params KDFParams, masterPassword, salt, keyFile []byte) ([]byte, error) {
+	kek, err := params.DeriveKey(masterPassword, salt)
+	if err != nil || keyFile == nil {
+		return kek, err
 	}
+	defer Wipe(kek)
+	return mixKeyFile(kek, keyFile), nil
+}
+
+// rekey derives a new key encryption key with the default KDF parameters and
+// a fresh salt, rewrapping the data key and replacing the verifier in a single
+// transaction
+func (e *Encryptor) rekey(masterPassword, keyFile []byte) error {
+	if e.key == nil {
+		return ErrLocked
+	}
+
+	params := DefaultKDFParams()
 
-	block, err := aes.NewCipher(e.key)
+	salt := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+
+	kek, err := deriveKEK(params, masterPassword, salt, keyFile)
 	if err != nil {
-		return "", err
+		return err
 	}
+	defer Wipe(kek)
 
-	gcm, err := cipher.NewGCM(block)
+	wrappedKey, err := wrapKey(e.aead, kek, e.key, MasterKeySlot)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	nonceSize := gcm.NonceSize()
-	if len(data) < nonceSize {
-		return "", errors.New("ciphertext too short")
+	keyFileRequired := "0"
+	if keyFile != nil {
+		keyFileRequired = "1"
 	}
 
-	nonce := data[:nonceSize]
-	ciphertextBytes := data[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertextBytes, nil)
+	err = e.db.Transaction(func(tx *database.DB) error {
+		if err := tx.SetKey(MasterKeySlot, wrappedKey); err != nil {
+			return err
+		}
+		if err := tx.SetSalt(base64.StdEncoding.EncodeToString(salt)); err != nil {
+			return err
+		}
+		if err := tx.SetMasterPassword(computeVerifier(kek)); err != nil {
+			return err
+		}
+		if err := tx.SetMetadata(keyFileMetadataKey, keyFileRequired); err != nil {
+			return err
+		}
+		return storeKDFParams(tx, params)
+	})
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	return string(plaintext), nil
+	releaseLocked(e.keyFile)
+	e.keyFile = lockedCopy(keyFile)
+	return nil
+}
+
+// SetCipher selects the AEAD new ciphertexts are sealed with. Existing
+// ciphertexts keep their algorithm and stay readable.
+func (e *Encryptor) SetCipher(name string) error {
+	aead, err := AEADByName(name)
+	if err != nil {
+		return err
+	}
+	if err := e.db.SetMetadata(cipherMetadataKey, aead.Name()); err != nil {
+		return err
+	}
+
+	e.aead = aead
+	if e.file != nil {
+		e.file.aead = aead
+	}
+	return nil
+}
+
+// Lock wipes the data key and other key material from memory. The encryptor
+// cannot be used afterwards; unlock the vault again to get a new one.
+func (e *Encryptor) Lock() {
+	releaseLocked(e.key)
+	releaseLocked(e.keyFile)
+	releaseLocked(e.integrityKey)
+	Wipe(e.indexKey)
+	if e.file != nil {
+		e.file.lock()
+	}
+	e.key = nil
+	e.keyFile = nil
+	e.integrityKey = nil
+	e.indexKey = nil
+}
+
+// Close locks the encryptor
+func (e *Encryptor) Close() error {
+	e.Lock()
+	return nil
+}
+
+// Encrypt encrypts the given plaintext
+func (e *Encryptor) Encrypt(plaintext []byte) (string, error) {
+	if e.key == nil {
+		return "", ErrLocked
+	}
+	return seal(e.aead, keyIDDataKey, e.key, plaintext, nil)
+}
+
+// Decrypt decrypts the given ciphertext. Wipe the plaintext after use.
+func (e *Encryptor) Decrypt(ciphertext string) ([]byte, error) {
+	if e.key == nil {
+		return nil, ErrLocked
+	}
+	return open(keyIDDataKey, e.key, ciphertext, nil)
 }
@@ -0,0 +1,147 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// envelopePrefix marks versioned ciphertexts. It contains a character outside
+// the base64 alphabet, so bare legacy ciphertexts never start with it.
+const envelopePrefix = "pm:"
+
+// envelopeVersion is the envelope format written by seal
+const envelopeVersion = 1
+
+// envelopeHeaderSize is the size of version, algorithm ID and key ID
+const envelopeHeaderSize = 6
+
+// Key IDs recorded in ciphertext envelopes
+const (
+	keyIDKeyEncryptionKey uint32 = 0 // keys derived from an unlock secret
+	keyIDDataKey          uint32 = 1 // the vault data key
+	keyIDVaultFile        uint32 = 2 // the key of encrypted vault files
+)
+
+// seal encrypts plaintext into a versioned envelope:
+// prefix + base64(version || algorithm ID || key ID || nonce || ciphertext).
+// The header is authenticated along with the associated data.
+func seal(alg AEAD, keyID uint32, key, plaintext, additionalData []byte) (string, error) {
+	data, err := sealBytes(alg, keyID, key, plaintext, additionalData)
+	if err != nil {
+		return "", err
+	}
+	return envelopePrefix + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// sealBytes encrypts plaintext into a binary envelope, as seal without the
+// prefix and encoding
+func sealBytes(alg AEAD, keyID uint32, key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := alg.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, envelopeHeaderSize, envelopeHeaderSize+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	header[0] = envelopeVersion
+	header[1] = alg.ID()
+	binary.BigEndian.PutUint32(header[2:], keyID)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	aad := append(header[:envelopeHeaderSize:envelopeHeaderSize], additionalData...)
+	data := append(header, nonce...)
+	return aead.Seal(data, nonce, plaintext, aad), nil
+}
+
+// open decrypts a ciphertext produced by seal, dispatching on the envelope
+// header. Bare ciphertexts written before envelopes are opened as AES-256-GCM.
+func open(keyID uint32, key []byte, ciphertext string, additionalData []byte) ([]byte, error) {
+	if !strings.HasPrefix(ciphertext, envelopePrefix) {
+		return openLegacy(key, ciphertext, additionalData)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ciphertext, envelopePrefix))
+	if err != nil {
+		return nil, err
+	}
+	return openBytes(keyID, key, data, additionalData)
+}
+
+// openBytes decrypts a binary envelope produced by sealBytes
+func openBytes(keyID uint32, key, data, additionalData []byte) ([]byte, error) {
+	if len(data) < envelopeHeaderSize {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	header := data[:envelopeHeaderSize]
+	if header[0] != envelopeVersion {
+		return nil, fmt.Errorf("unsupported ciphertext version %d", header[0])
+	}
+	alg, ok := algorithms[header[1]]
+	if !ok {
+		return nil, fmt.Errorf("unsupported cipher algorithm %d", header[1])
+	}
+	if id := binary.BigEndian.Uint32(header[2:]); id != keyID {
+		return nil, fmt.Errorf("ciphertext encrypted under unknown key %d", id)
+	}
+
+	aead, err := alg.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	body := data[envelopeHeaderSize:]
+	if len(body) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	aad := append(header[:envelopeHeaderSize:envelopeHeaderSize], additionalData...)
+	plaintext, err := aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], aad)
+	if err != nil {
+		return nil, errAuthentication
+	}
+
+	return plaintext, nil
+}
+
+// openLegacy decrypts a bare base64(nonce||ciphertext) AES-256-GCM ciphertext
+func openLegacy(key []byte, ciphertext string, additionalData []byte) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := gcm.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce := data[:nonceSize]
+	ciphertextBytes := data[nonceSize:]
+	plaintext, err := gcm.Open(nil, nonce, ciphertextBytes, additionalData)
+	if err != nil {
+		return nil, errAuthentication
+	}
+
+	return plaintext, nil
+}
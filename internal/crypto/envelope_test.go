@@ -0,0 +1,104 @@
+package crypto
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// decodeEnvelope returns the binary envelope of a string ciphertext
+func decodeEnvelope(t *testing.T, ciphertext string) []byte {
+	t.Helper()
+	if !strings.HasPrefix(ciphertext, envelopePrefix) {
+		t.Fatalf("ciphertext %q has no envelope prefix", ciphertext)
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ciphertext, envelopePrefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// encodeEnvelope returns a binary envelope as a string ciphertext
+func encodeEnvelope(data []byte) string {
+	return envelopePrefix + base64.StdEncoding.EncodeToString(data)
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	for _, alg := range algorithms {
+		t.Run(alg.Name(), func(t *testing.T) {
+			e := newTestEncryptor(t, "vault", alg)
+			aad := e.FieldAAD(1, "notes")
+			ciphertext, err := e.EncryptWithAAD([]byte("secret"), aad)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			header := decodeEnvelope(t, ciphertext)[:envelopeHeaderSize]
+			if header[0] != envelopeVersion || header[1] != alg.ID() || binary.BigEndian.Uint32(header[2:]) != keyIDDataKey {
+				t.Errorf("envelope header %v", header)
+			}
+
+			// Envelopes are opened with the algorithm they name, whatever
+			// the vault seals new ciphertexts with
+			for _, current := range algorithms {
+				reader := &Encryptor{key: e.key, vaultID: e.vaultID, aead: current}
+				plaintext, err := reader.DecryptWithAAD(ciphertext, aad)
+				if err != nil || string(plaintext) != "secret" {
+					t.Errorf("opened by a %s vault: %q, %v", current.Name(), plaintext, err)
+				}
+			}
+		})
+	}
+}
+
+func TestEnvelopeTampering(t *testing.T) {
+	e := newTestEncryptor(t, "vault", DefaultAEAD())
+	aad := e.EntryAAD(1, "example", "alice")
+	ciphertext, err := e.EncryptWithAAD([]byte("secret"), aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := decodeEnvelope(t, ciphertext)
+
+	tests := []struct {
+		name   string
+		tamper func(data []byte) []byte
+		want   string // the error message, or "" for ErrTampered
+	}{
+		{"empty", func(data []byte) []byte { return data[:0] }, "ciphertext too short"},
+		{"truncated header", func(data []byte) []byte { return data[:envelopeHeaderSize-1] }, "ciphertext too short"},
+		{"truncated nonce", func(data []byte) []byte { return data[:envelopeHeaderSize+4] }, "ciphertext too short"},
+		{"truncated tag", func(data []byte) []byte { return data[:len(data)-1] }, ""},
+		{"unknown version", func(data []byte) []byte { data[0] = envelopeVersion + 1; return data }, "unsupported ciphertext version 2"},
+		{"unknown algorithm", func(data []byte) []byte { data[1] = 0xff; return data }, "unsupported cipher algorithm 255"},
+		{"unknown key ID", func(data []byte) []byte {
+			binary.BigEndian.PutUint32(data[2:], keyIDVaultFile)
+			return data
+		}, "ciphertext encrypted under unknown key 2"},
+		// The header is authenticated, so naming the other algorithm fails
+		// rather than decrypting under it
+		{"other algorithm", func(data []byte) []byte { data[1] = AlgorithmXChaCha20Poly1305; return data }, ""},
+		{"flipped ciphertext bit", func(data []byte) []byte { data[len(data)-1] ^= 1; return data }, ""},
+		{"flipped nonce bit", func(data []byte) []byte { data[envelopeHeaderSize] ^= 1; return data }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := tt.tamper(append([]byte(nil), data...))
+
+			for _, err := range []error{
+				func() error { _, err := e.DecryptWithAAD(encodeEnvelope(tampered), aad); return err }(),
+				func() error { _, err := e.DecryptBytesWithAAD(tampered, aad); return err }(),
+			} {
+				switch {
+				case tt.want == "" && !errors.Is(err, ErrTampered):
+					t.Errorf("got error %v, want %v", err, ErrTampered)
+				case tt.want != "" && (err == nil || err.Error() != tt.want):
+					t.Errorf("got error %v, want %s", err, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+// integrityContext derives the vault integrity key from the data key
+const integrityContext = "password-manager vault integrity v1"
+
+// ErrIntegrity is returned when the vault contents do not match their
+// integrity root
+var ErrIntegrity = errors.New("vault integrity check failed: entries may have been deleted, reordered or rolled back")
+
+// deriveIntegrityKey derives the key of the vault integrity root from the
+// data key
+func deriveIntegrityKey(dataKey []byte) []byte {
+	mac := hmac.New(sha256.New, dataKey)
+	mac.Write([]byte(integrityContext))
+	key := mac.Sum(nil)
+	defer Wipe(key)
+	return lockedCopy(key)
+}
+
+// integrityMAC computes the MACs of the vault integrity root
+func (e *Encryptor) integrityMAC(data []byte) ([]byte, error) {
+	if e.integrityKey == nil {
+		return nil, ErrLocked
+	}
+
+	mac := hmac.New(sha256.New, e.integrityKey)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+// checkIntegrity verifies the integrity root before anything else is written
+// and makes every later write update it. Vaults without a root get one,
+// unless required says the root was removed. A vault older than the newest
+// revision recorded on this machine is rejected as rolled back. After a
+// failed check writes are refused until AcceptIntegrity.
+func (e *Encryptor) checkIntegrity(required bool) error {
+	found, valid, err := e.db.VerifyIntegrity(e.integrityMAC)
+	if err != nil {
+		return err
+	}
+
+	if (found && !valid) || (!found && required) {
+		e.refuseWrites(ErrIntegrity)
+		return nil
+	}
+
+	revision, err := e.db.IntegrityRevision()
+	if err != nil {
+		return err
+	}
+	seen, err := seenRevision(e.vaultID)
+	if err != nil {
+		return err
+	}
+	if revision < seen {
+		e.refuseWrites(ErrRollback)
+		return nil
+	}
+
+	// Rows changed by a schema upgrade get a new root once the old one checks
+	e.db.SetIntegrityMAC(e.integrityMAC)
+	e.db.SetRevisionRecorder(e.rememberRevision)
+	if !found || e.db.SchemaUpgraded() {
+		return e.db.UpdateIntegrity()
+	}
+	e.rememberRevision(revision)
+	return nil
+}
+
+// refuseWrites records why the vault failed its integrity check and makes
+// every write fail with that error
+func (e *Encryptor) refuseWrites(err error) {
+	e.integrityErr = err
+	e.db.SetIntegrityMAC(func([]byte) ([]byte, error) {
+		return nil, err
+	})
+}
+
+// IntegrityError returns ErrIntegrity or ErrRollback if the vault failed its
+// integrity check on unlock, and nil otherwise
+func (e *Encryptor) IntegrityError() error {
+	return e.integrityErr
+}
+
+// AcceptIntegrity trusts the current vault contents after a failed integrity
+// check, recording a new integrity root for them. The revision recorded on
+// this machine is replaced by the new one, even if it was newer.
+func (e *Encryptor) AcceptIntegrity() error {
+	if e.integrityKey == nil {
+		return ErrLocked
+	}
+
+	e.integrityErr = nil
+	e.db.SetIntegrityMAC(e.integrityMAC)
+	e.db.SetRevisionRecorder(e.rememberRevision)
+	if err := e.db.UpdateIntegrity(); err != nil {
+		return err
+	}
+
+	revision, err := e.db.IntegrityRevision()
+	if err != nil {
+		return err
+	}
+	return storeSeenRevision(e.vaultID, revision, true)
+}
+
+// IntegrityRevision returns the vault revision counter, incremented by every
+// write
+func (e *Encryptor) IntegrityRevision() (int64, error) {
+	return e.db.IntegrityRevision()
+}
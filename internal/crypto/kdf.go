@@ -0,0 +1,103 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+
+	"password-manager/internal/database"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// KDF algorithm identifiers recorded in the vault metadata
+const (
+	KDFPBKDF2SHA256 = "pbkdf2-sha256"
+	KDFArgon2id     = "argon2id"
+)
+
+// kdfParamsVersion is the format version of the stored KDF parameters
+const kdfParamsVersion = 1
+
+// kdfMetadataKey is the vault metadata key holding the KDF parameters
+const kdfMetadataKey = "kdf_params"
+
+// KDFParams describes how the key is derived from the master password
+type KDFParams struct {
+	Version     int    `json:"version"`
+	Algorithm   string `json:"algorithm"`
+	Time        uint32 `json:"time"`                  // Argon2 passes or PBKDF2 iterations
+	Memory      uint32 `json:"memory,omitempty"`      // Argon2 memory in KiB
+	Parallelism uint8  `json:"parallelism,omitempty"` // Argon2 lanes
+	KeyLength   uint32 `json:"key_length"`
+}
+
+// DefaultKDFParams returns the parameters used for new and upgraded vaults
+func DefaultKDFParams() KDFParams {
+	return KDFParams{
+		Version:     kdfParamsVersion,
+		Algorithm:   KDFArgon2id,
+		Time:        3,
+		Memory:      64 * 1024,
+		Parallelism: 4,
+		KeyLength:   32,
+	}
+}
+
+// LegacyKDFParams returns the parameters of vaults created before the KDF
+// parameters were recorded in the vault metadata
+func LegacyKDFParams() KDFParams {
+	return KDFParams{
+		Version:   kdfParamsVersion,
+		Algorithm: KDFPBKDF2SHA256,
+		Time:      100000,
+		KeyLength: 32,
+	}
+}
+
+// DeriveKey derives a key from the password and salt using these parameters
+func (p KDFParams) DeriveKey(password, salt []byte) ([]byte, error) {
+	if p.KeyLength == 0 || p.Time == 0 {
+		return nil, fmt.Errorf("invalid KDF parameters for %s", p.Algorithm)
+	}
+
+	switch p.Algorithm {
+	case KDFArgon2id:
+		if p.Memory == 0 || p.Parallelism == 0 {
+			return nil, fmt.Errorf("invalid KDF parameters for %s", p.Algorithm)
+		}
+		return argon2.IDKey(password, salt, p.Time, p.Memory, p.Parallelism, p.KeyLength), nil
+	case KDFPBKDF2SHA256:
+		return pbkdf2.Key(password, salt, int(p.Time), int(p.KeyLength), sha256.New), nil
+	default:
+		return nil, fmt.Errorf("unsupported KDF algorithm: %s", p.Algorithm)
+	}
+}
+
+// loadKDFParams reads the KDF parameters stored in the vault metadata
+func loadKDFParams(db *database.DB) (KDFParams, bool, error) {
+	value, found, err := db.GetMetadata(kdfMetadataKey)
+	if err != nil || !found {
+		return KDFParams{}, false, err
+	}
+
+	var params KDFParams
+	if err := json.Unmarshal([]byte(value), &params); err != nil {
+		return KDFParams{}, false, fmt.Errorf("invalid KDF parameters in vault: %w", err)
+	}
+	if params.Version > kdfParamsVersion {
+		return KDFParams{}, false, fmt.Errorf("unsupported KDF parameters version %d", params.Version)
+	}
+
+	return params, true, nil
+}
+
+// storeKDFParams writes the KDF parameters to the vault metadata
+func storeKDFParams(db *database.DB, params KDFParams) error {
+	value, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return db.SetMetadata(kdfMetadataKey, string(value))
+}
@@ -0,0 +1,210 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"password-manager/internal/database"
+	"password-manager/internal/models"
+)
+
+var testPassword = []byte("correct horse battery")
+
+// openTestDB opens the database at path and closes it once the test ends
+func openTestDB(t *testing.T, path string) *database.DB {
+	t.Helper()
+	db, err := database.NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// legacyEncrypt encrypts plaintext as vaults did before envelopes and data
+// keys: a bare base64(nonce||ciphertext) under the key encryption key
+func legacyEncrypt(t *testing.T, key, plaintext []byte) string {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, nil))
+}
+
+// testSalt returns the salt of a vault, creating it if needed
+func testSalt(t *testing.T, db *database.DB) []byte {
+	t.Helper()
+	encoded, err := db.GetSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return salt
+}
+
+// storedVerifier returns the master password verifier stored in a vault
+func storedVerifier(t *testing.T, db *database.DB) string {
+	t.Helper()
+	verifier, found, err := db.GetMasterPassword()
+	if err != nil || !found {
+		t.Fatalf("no verifier: %v", err)
+	}
+	return verifier
+}
+
+// newBaselineVault creates a vault as the baseline wrote it: PBKDF2 without
+// recorded parameters, the verifier written by verifier from the derived key,
+// and one entry encrypted directly under that key
+func newBaselineVault(t *testing.T, verifier func(kek []byte) string) *database.DB {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	db := openTestDB(t, filepath.Join(dir, "vault.db"))
+
+	kek, err := LegacyKDFParams().DeriveKey(testPassword, testSalt(t, db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetMasterPassword(verifier(kek)); err != nil {
+		t.Fatal(err)
+	}
+	entry := &models.Password{Service: "example", Username: "alice", Password: []byte(legacyEncrypt(t, kek, []byte("secret")))}
+	if err := db.CreatePassword(entry); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// v1Verifier returns the verifier written before the integrity root
+func v1Verifier(kek []byte) string {
+	return verifierV1Prefix + verifierMAC(kek, verifierV1Context)
+}
+
+// checkEntry checks that the entry of a baseline vault still decrypts
+func checkEntry(t *testing.T, encryptor *Encryptor, db *database.DB) {
+	t.Helper()
+	stored, err := db.ListPasswords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := encryptor.Decrypt(string(stored[0].Password))
+	if err != nil || string(plaintext) != "secret" {
+		t.Errorf("entry: %q, %v", plaintext, err)
+	}
+}
+
+func TestUpgradeLegacyKDF(t *testing.T) {
+	db := newBaselineVault(t, v1Verifier)
+	salt := testSalt(t, db)
+
+	encryptor, err := NewEncryptor(testPassword, nil, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, found, err := loadKDFParams(db)
+	if err != nil || !found || params != DefaultKDFParams() || params.Algorithm != KDFArgon2id {
+		t.Errorf("KDF parameters after the upgrade: %+v, %v, %v", params, found, err)
+	}
+	if string(testSalt(t, db)) == string(salt) {
+		t.Error("salt was kept by the upgrade")
+	}
+	checkEntry(t, encryptor, db)
+	encryptor.Lock()
+
+	// The upgraded vault derives its key with Argon2id from the same password
+	reopened, err := NewEncryptor(testPassword, nil, db)
+	if err != nil {
+		t.Fatalf("upgraded vault does not open with its password: %v", err)
+	}
+	defer reopened.Lock()
+	checkEntry(t, reopened, db)
+}
+
+func TestRekeyOnParameterChange(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	db := openTestDB(t, filepath.Join(dir, "vault.db"))
+
+	// A vault written with cheaper Argon2id parameters than the current ones
+	cheap := KDFParams{Version: kdfParamsVersion, Algorithm: KDFArgon2id, Time: 1, Memory: 8 * 1024, Parallelism: 1, KeyLength: 32}
+	salt := testSalt(t, db)
+	kek, err := cheap.DeriveKey(testPassword, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := wrapKey(DefaultAEAD(), kek, dataKey, MasterKeySlot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := seal(DefaultAEAD(), keyIDDataKey, dataKey, []byte("secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storeKDFParams(db, cheap); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetKey(MasterKeySlot, wrapped); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetMasterPassword(v1Verifier(kek)); err != nil {
+		t.Fatal(err)
+	}
+
+	encryptor, err := NewEncryptor(testPassword, nil, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, _, err := loadKDFParams(db)
+	if err != nil || params != DefaultKDFParams() {
+		t.Errorf("KDF parameters after the rekey: %+v, %v", params, err)
+	}
+	if string(testSalt(t, db)) == string(salt) {
+		t.Error("salt was kept by the rekey")
+	}
+	if rewrapped, _, _ := db.GetKey(MasterKeySlot); rewrapped == wrapped {
+		t.Error("data key was not rewrapped")
+	}
+	if verifier := storedVerifier(t, db); !strings.HasPrefix(verifier, verifierPrefix) {
+		t.Errorf("verifier after the rekey: %q", verifier)
+	}
+
+	// The data key itself is kept, so ciphertexts stay readable
+	plaintext, err := encryptor.Decrypt(ciphertext)
+	if err != nil || string(plaintext) != "secret" {
+		t.Errorf("ciphertext after the rekey: %q, %v", plaintext, err)
+	}
+	encryptor.Lock()
+
+	if _, err := NewEncryptor([]byte("wrong password"), nil, db); err == nil {
+		t.Error("wrong password opened the rekeyed vault")
+	}
+	reopened, err := NewEncryptor(testPassword, nil, db)
+	if err != nil {
+		t.Fatalf("rekeyed vault does not open with its password: %v", err)
+	}
+	defer reopened.Lock()
+	if plaintext, err := reopened.Decrypt(ciphertext); err != nil || string(plaintext) != "secret" {
+		t.Errorf("ciphertext after reopening: %q, %v", plaintext, err)
+	}
+}
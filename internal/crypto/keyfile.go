@@ -0,0 +1,84 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+
+	"password-manager/internal/database"
+)
+
+// keyFileMetadataKey is the vault metadata key recording whether unlocking
+// requires a key file
+const keyFileMetadataKey = "keyfile_required"
+
+// keyFileContext prefixes key file contents when they are hashed
+const keyFileContext = "password-manager key file v1"
+
+// keyFileSize is the size of key files created by CreateKeyFile
+const keyFileSize = 64
+
+// ErrKeyFileRequired is returned when unlocking a vault that requires a key
+// file without one
+var ErrKeyFileRequired = errors.New("this vault requires a key file")
+
+// ReadKeyFile reads a key file and returns the digest that is mixed into the
+// key encryption key. Any non-empty file can serve as a key file.
+func ReadKeyFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	hash.Write([]byte(keyFileContext))
+	n, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, errors.New("key file is empty")
+	}
+
+	return hash.Sum(nil), nil
+}
+
+// CreateKeyFile writes a new random key file, refusing to overwrite an
+// existing file
+func CreateKeyFile(path string) error {
+	contents := make([]byte, keyFileSize)
+	if _, err := io.ReadFull(rand.Reader, contents); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(contents); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// mixKeyFile combines a key derived from the master password with a key file
+// digest, so that both are needed to reproduce the result
+func mixKeyFile(kek, keyFile []byte) []byte {
+	mac := hmac.New(sha256.New, kek)
+	mac.Write(keyFile)
+	return mac.Sum(nil)
+}
+
+// isKeyFileRequired reports whether unlocking the vault requires a key file
+func isKeyFileRequired(db *database.DB) (bool, error) {
+	value, found, err := db.GetMetadata(keyFileMetadataKey)
+	if err != nil {
+		return false, err
+	}
+	return found && value == "1", nil
+}
@@ -0,0 +1,78 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"password-manager/internal/database"
+	"password-manager/internal/models"
+)
+
+// MasterKeySlot is the key slot holding the data key wrapped under the key
+// derived from the master password
+const MasterKeySlot = "master"
+
+// dataKeySize is the size of the vault data key in bytes
+const dataKeySize = 32
+
+// ErrKeyUnwrap is returned when a wrapped key cannot be decrypted
+var ErrKeyUnwrap = errors.New("unable to unwrap vault key")
+
+// wrapKey encrypts a data key under a key encryption key, binding it to slot
+func wrapKey(alg AEAD, kek, dataKey []byte, slot string) (string, error) {
+	return seal(alg, keyIDKeyEncryptionKey, kek, dataKey, []byte("key-slot:"+slot))
+}
+
+// unwrapKey decrypts a data key wrapped by wrapKey
+func unwrapKey(kek []byte, wrappedKey, slot string) ([]byte, error) {
+	dataKey, err := open(keyIDKeyEncryptionKey, kek, wrappedKey, []byte("key-slot:"+slot))
+	if err != nil {
+		return nil, ErrKeyUnwrap
+	}
+	return dataKey, nil
+}
+
+// loadDataKey unwraps the vault data key from the master key slot. Vaults
+// without one get a fresh random data key, and any entries encrypted directly
+// under the key encryption key are re-encrypted under it in the same
+// transaction that stores the wrapped key.
+func loadDataKey(db *database.DB, kek []byte, alg AEAD) ([]byte, error) {
+	wrappedKey, found, err := db.GetKey(MasterKeySlot)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return unwrapKey(kek, wrappedKey, MasterKeySlot)
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err = wrapKey(alg, kek, dataKey, MasterKeySlot)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Transaction(func(tx *database.DB) error {
+		err := tx.ReencryptPasswords(func(entry *models.Password) (string, error) {
+			plaintext, err := openLegacy(kek, string(entry.Password), nil)
+			if err != nil {
+				return "", err
+			}
+			defer Wipe(plaintext)
+			return seal(alg, keyIDDataKey, dataKey, plaintext, nil)
+		})
+		if err != nil {
+			return err
+		}
+		return tx.SetKey(MasterKeySlot, wrappedKey)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return dataKey, nil
+}
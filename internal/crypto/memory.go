@@ -0,0 +1,33 @@
+package crypto
+
+import "runtime"
+
+// Wipe overwrites a secret with zeros. Callers wipe plaintext secrets as soon
+// as they are no longer needed.
+func Wipe(secret []byte) {
+	clear(secret)
+	runtime.KeepAlive(secret)
+}
+
+// lockedCopy returns a copy of a secret in memory that is locked against
+// swapping where the OS allows it. Release it with releaseLocked.
+func lockedCopy(secret []byte) []byte {
+	if secret == nil {
+		return nil
+	}
+
+	locked := make([]byte, len(secret))
+	copy(locked, secret)
+	lockMemory(locked)
+	return locked
+}
+
+// releaseLocked wipes and unlocks memory returned by lockedCopy
+func releaseLocked(secret []byte) {
+	if secret == nil {
+		return
+	}
+
+	Wipe(secret)
+	unlockMemory(secret)
+}
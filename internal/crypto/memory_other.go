@@ -0,0 +1,9 @@
+//go:build !unix
+
+package crypto
+
+// lockMemory is a no-op where mlock is not available
+func lockMemory(secret []byte) {}
+
+// unlockMemory is a no-op where mlock is not available
+func unlockMemory(secret []byte) {}
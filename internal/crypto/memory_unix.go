@@ -0,0 +1,20 @@
+//go:build unix
+
+package crypto
+
+import "golang.org/x/sys/unix"
+
+// lockMemory keeps a secret out of swap. Failures are ignored, as mlock is
+// limited by RLIMIT_MEMLOCK and the secret is still wiped on release.
+func lockMemory(secret []byte) {
+	if len(secret) > 0 {
+		unix.Mlock(secret)
+	}
+}
+
+// unlockMemory releases memory locked by lockMemory
+func unlockMemory(secret []byte) {
+	if len(secret) > 0 {
+		unix.Munlock(secret)
+	}
+}
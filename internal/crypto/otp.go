@@ -0,0 +1,79 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"time"
+)
+
+// One-time password hash algorithms, named as in otpauth:// URIs
+const (
+	OTPSHA1   = "SHA1"
+	OTPSHA256 = "SHA256"
+	OTPSHA512 = "SHA512"
+)
+
+// Limits on the number of digits of a one-time password
+const (
+	MinOTPDigits = 6
+	MaxOTPDigits = 8
+)
+
+// HOTP computes the RFC 4226 one-time password for a counter
+func HOTP(secret []byte, counter uint64, digits int, algorithm string) (string, error) {
+	var newHash func() hash.Hash
+	switch algorithm {
+	case OTPSHA1:
+		newHash = sha1.New
+	case OTPSHA256:
+		newHash = sha256.New
+	case OTPSHA512:
+		newHash = sha512.New
+	default:
+		return "", fmt.Errorf("unsupported OTP algorithm %q", algorithm)
+	}
+	if digits < MinOTPDigits || digits > MaxOTPDigits {
+		return "", fmt.Errorf("OTP digits must be between %d and %d", MinOTPDigits, MaxOTPDigits)
+	}
+
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], counter)
+	mac := hmac.New(newHash, secret)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulus := uint32(1)
+	for range digits {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%modulus), nil
+}
+
+// TOTP computes the RFC 6238 one-time password for time t and returns the
+// number of seconds it stays valid
+func TOTP(secret []byte, t time.Time, period, digits int, algorithm string) (string, int, error) {
+	if period <= 0 {
+		return "", 0, errors.New("OTP period must be positive")
+	}
+
+	seconds := t.Unix()
+	if seconds < 0 {
+		return "", 0, errors.New("time is before the Unix epoch")
+	}
+
+	code, err := HOTP(secret, uint64(seconds)/uint64(period), digits, algorithm)
+	if err != nil {
+		return "", 0, err
+	}
+	return code, period - int(seconds%int64(period)), nil
+}
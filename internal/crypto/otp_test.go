@@ -0,0 +1,98 @@
+package crypto
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHOTP(t *testing.T) {
+	// RFC 4226 appendix D
+	secret := []byte("12345678901234567890")
+	want := []string{
+		"755224", "287082", "359152", "969429", "338314",
+		"254676", "287922", "162583", "399871", "520489",
+	}
+	for counter, code := range want {
+		got, err := HOTP(secret, uint64(counter), 6, OTPSHA1)
+		if err != nil {
+			t.Fatalf("HOTP(counter %d): %v", counter, err)
+		}
+		if got != code {
+			t.Errorf("HOTP(counter %d) = %s, want %s", counter, got, code)
+		}
+	}
+}
+
+// rfc6238Secrets are the seeds of RFC 6238 appendix B by algorithm
+var rfc6238Secrets = map[string][]byte{
+	OTPSHA1:   []byte("12345678901234567890"),
+	OTPSHA256: []byte("12345678901234567890123456789012"),
+	OTPSHA512: []byte("1234567890123456789012345678901234567890123456789012345678901234"),
+}
+
+// rfc6238Vectors are the test vectors of RFC 6238 appendix B
+var rfc6238Vectors = []struct {
+	unix      int64
+	algorithm string
+	code      string
+}{
+	{59, OTPSHA1, "94287082"},
+	{59, OTPSHA256, "46119246"},
+	{59, OTPSHA512, "90693936"},
+	{1111111109, OTPSHA1, "07081804"},
+	{1111111109, OTPSHA256, "68084774"},
+	{1111111109, OTPSHA512, "25091201"},
+	{1111111111, OTPSHA1, "14050471"},
+	{1111111111, OTPSHA256, "67062674"},
+	{1111111111, OTPSHA512, "99943326"},
+	{1234567890, OTPSHA1, "89005924"},
+	{1234567890, OTPSHA256, "91819424"},
+	{1234567890, OTPSHA512, "93441116"},
+	{2000000000, OTPSHA1, "69279037"},
+	{2000000000, OTPSHA256, "90698825"},
+	{2000000000, OTPSHA512, "38618901"},
+	{20000000000, OTPSHA1, "65353130"},
+	{20000000000, OTPSHA256, "77737706"},
+	{20000000000, OTPSHA512, "47863826"},
+}
+
+func TestTOTP(t *testing.T) {
+	for _, tt := range rfc6238Vectors {
+		code, remaining, err := TOTP(rfc6238Secrets[tt.algorithm], time.Unix(tt.unix, 0), 30, 8, tt.algorithm)
+		if err != nil {
+			t.Fatalf("TOTP(%d, %s): %v", tt.unix, tt.algorithm, err)
+		}
+		if code != tt.code {
+			t.Errorf("TOTP(%d, %s) = %s, want %s", tt.unix, tt.algorithm, code, tt.code)
+		}
+		if want := 30 - int(tt.unix%30); remaining != want {
+			t.Errorf("TOTP(%d, %s) remaining = %d, want %d", tt.unix, tt.algorithm, remaining, want)
+		}
+	}
+}
+
+func TestOTPInvalidParameters(t *testing.T) {
+	secret := rfc6238Secrets[OTPSHA1]
+	now := time.Unix(59, 0)
+
+	tests := []struct {
+		name      string
+		t         time.Time
+		period    int
+		digits    int
+		algorithm string
+	}{
+		{"too few digits", now, 30, MinOTPDigits - 1, OTPSHA1},
+		{"too many digits", now, 30, MaxOTPDigits + 1, OTPSHA1},
+		{"unknown algorithm", now, 30, 6, "MD5"},
+		{"lower case algorithm", now, 30, 6, "sha1"},
+		{"zero period", now, 0, 6, OTPSHA1},
+		{"negative period", now, -30, 6, OTPSHA1},
+		{"before the epoch", time.Unix(-1, 0), 30, 6, OTPSHA1},
+	}
+	for _, tt := range tests {
+		if _, _, err := TOTP(secret, tt.t, tt.period, tt.digits, tt.algorithm); err == nil {
+			t.Errorf("TOTP with %s succeeded", tt.name)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"io"
+	"strings"
+
+	"password-manager/internal/database"
+)
+
+// RecoveryKeySlot is the key slot holding the data key wrapped under the key
+// derived from the recovery key
+const RecoveryKeySlot = "recovery"
+
+// RecoveryKeySize is the size of a raw recovery key in bytes
+const RecoveryKeySize = 32
+
+// recoveryKeyContext derives the recovery key encryption key
+const recoveryKeyContext = "password-manager recovery key v1"
+
+// recoveryChecksumSize is the number of checksum bytes in an encoded key
+const recoveryChecksumSize = 2
+
+// recoveryGroupSize is the number of characters per group in an encoded key
+const recoveryGroupSize = 5
+
+// ErrNoRecoveryKey is returned when recovering a vault without a recovery key
+var ErrNoRecoveryKey = errors.New("vault has no recovery key")
+
+// recoveryEncoding encodes recovery keys without padding
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateRecoveryKey returns a new random raw recovery key
+func GenerateRecoveryKey() ([]byte, error) {
+	recoveryKey := make([]byte, RecoveryKeySize)
+	if _, err := io.ReadFull(rand.Reader, recoveryKey); err != nil {
+		return nil, err
+	}
+	return recoveryKey, nil
+}
+
+// FormatRecoveryKey encodes a raw recovery key with a checksum as grouped
+// base32, e.g. ABCDE-FGHIJ-...
+func FormatRecoveryKey(recoveryKey []byte) string {
+	return formatPrintable(recoveryKey)
+}
+
+// ParseRecoveryKey decodes a recovery key formatted by FormatRecoveryKey.
+// Case, spaces and dashes are ignored. Wipe the result after use.
+func ParseRecoveryKey(encoded []byte) ([]byte, error) {
+	recoveryKey, err := parsePrintable(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(recoveryKey) != RecoveryKeySize {
+		return nil, errors.New("invalid recovery key format")
+	}
+	return recoveryKey, nil
+}
+
+// formatPrintable encodes data with a checksum as dash-separated groups of
+// base32 characters
+func formatPrintable(data []byte) string {
+	checksum := sha256.Sum256(data)
+	data = append(append([]byte{}, data...), checksum[:recoveryChecksumSize]...)
+	encoded := recoveryEncoding.EncodeToString(data)
+
+	var groups []string
+	for len(encoded) > recoveryGroupSize {
+		groups = append(groups, encoded[:recoveryGroupSize])
+		encoded = encoded[recoveryGroupSize:]
+	}
+	groups = append(groups, encoded)
+	return strings.Join(groups, "-")
+}
+
+// parsePrintable decodes and checks data encoded by formatPrintable
+func parsePrintable(encoded []byte) ([]byte, error) {
+	normalized := make([]byte, 0, len(encoded))
+	for _, c := range encoded {
+		switch {
+		case c == '-' || c == ' ' || c == '\t':
+		case c >= 'a' && c <= 'z':
+			normalized = append(normalized, c-'a'+'A')
+		default:
+			normalized = append(normalized, c)
+		}
+	}
+	defer Wipe(normalized)
+
+	data := make([]byte, recoveryEncoding.DecodedLen(len(normalized)))
+	n, err := recoveryEncoding.Decode(data, normalized)
+	if err != nil || n <= recoveryChecksumSize {
+		Wipe(data)
+		return nil, errors.New("invalid format")
+	}
+	data = data[:n]
+
+	payload := data[:len(data)-recoveryChecksumSize]
+	checksum := sha256.Sum256(payload)
+	if !hmac.Equal(checksum[:recoveryChecksumSize], data[len(payload):]) {
+		return nil, errors.New("checksum mismatch (check for typos)")
+	}
+
+	return payload, nil
+}
+
+// deriveRecoveryKEK derives the key encryption key for a raw recovery key.
+// Recovery keys are uniformly random, so no salt or cost factor is needed.
+func deriveRecoveryKEK(recoveryKey []byte) []byte {
+	mac := hmac.New(sha256.New, recoveryKey)
+	mac.Write([]byte(recoveryKeyContext))
+	return mac.Sum(nil)
+}
+
+// RecoverEncryptor unlocks the vault with a raw recovery key. The master
+// password should then be reset with ResetMasterPassword.
+func RecoverEncryptor(recoveryKey []byte, db *database.DB) (*Encryptor, error) {
+	wrappedKey, found, err := db.GetKey(RecoveryKeySlot)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrNoRecoveryKey
+	}
+
+	kek := deriveRecoveryKEK(recoveryKey)
+	defer Wipe(kek)
+
+	key, err := unwrapKey(kek, wrappedKey, RecoveryKeySlot)
+	if err != nil {
+		return nil, errors.New("incorrect recovery key")
+	}
+	defer Wipe(key)
+
+	// Decrypt an encrypted vault file with the recovered data key
+	var file *fileCipher
+	if db.IsSealed() {
+		if file, err = unsealVaultFile(db, key); err != nil {
+			return nil, err
+		}
+	}
+
+	aead, err := loadAEAD(db)
+	if err != nil {
+		return nil, err
+	}
+
+	vaultID, err := loadVaultID(db)
+	if err != nil {
+		return nil, err
+	}
+
+	storedVerifier, _, err := db.GetMasterPassword()
+	if err != nil {
+		return nil, err
+	}
+
+	encryptor := &Encryptor{
+		key:          lockedCopy(key),
+		indexKey:     deriveIndexKey(key),
+		integrityKey: deriveIntegrityKey(key),
+		aead:         aead,
+		file:         file,
+		vaultID:      vaultID,
+		db:           db,
+	}
+
+	if err := encryptor.checkIntegrity(hasIntegrityVerifier(storedVerifier)); err != nil {
+		encryptor.Lock()
+		return nil, err
+	}
+	return encryptor, nil
+}
+
+// SetRecoveryKey wraps the vault data key under a raw recovery key, replacing
+// and thereby revoking any previous recovery key
+func (e *Encryptor) SetRecoveryKey(recoveryKey []byte) error {
+	if e.key == nil {
+		return ErrLocked
+	}
+
+	kek := deriveRecoveryKEK(recoveryKey)
+	defer Wipe(kek)
+
+	wrappedKey, err := wrapKey(e.aead, kek, e.key, RecoveryKeySlot)
+	if err != nil {
+		return err
+	}
+	return e.db.SetKey(RecoveryKeySlot, wrappedKey)
+}
+
+// RemoveRecoveryKey revokes the recovery key
+func (e *Encryptor) RemoveRecoveryKey() error {
+	return e.db.DeleteKey(RecoveryKeySlot)
+}
+
+// HasRecoveryKey reports whether the vault has a recovery key
+func (e *Encryptor) HasRecoveryKey() (bool, error) {
+	_, found, err := e.db.GetKey(RecoveryKeySlot)
+	return found, err
+}
@@ -0,0 +1,105 @@
+package crypto
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// revisionsFile is the file in the user config directory recording the newest
+// revision seen of each vault on this machine, by vault ID. It is kept outside
+// the vault, so that restoring an older copy of the whole vault file, which
+// is consistent with its own integrity root, is still noticed.
+const revisionsFile = "password-manager/revisions.json"
+
+// ErrRollback is returned when the vault is older than a revision already
+// seen on this machine
+var ErrRollback = errors.New("vault integrity check failed: the vault is older than a revision already seen on this machine (possible rollback)")
+
+// revisionsPath returns the path of the revisions file
+func revisionsPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, revisionsFile), nil
+}
+
+// readRevisions reads the revisions file at path. A missing file records no
+// revisions.
+func readRevisions(path string) (map[string]int64, error) {
+	revisions := make(map[string]int64)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return revisions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &revisions); err != nil {
+		return nil, errors.New("invalid revisions file " + path)
+	}
+	return revisions, nil
+}
+
+// seenRevision returns the newest revision of a vault recorded on this
+// machine, or 0 if none is. Without a user config directory nothing is
+// recorded.
+func seenRevision(vaultID string) (int64, error) {
+	path, err := revisionsPath()
+	if err != nil {
+		return 0, nil
+	}
+	revisions, err := readRevisions(path)
+	if err != nil {
+		return 0, err
+	}
+	return revisions[vaultID], nil
+}
+
+// storeSeenRevision records revision as the newest seen of a vault. A newer
+// revision already recorded is kept, unless replace is set.
+func storeSeenRevision(vaultID string, revision int64, replace bool) error {
+	path, err := revisionsPath()
+	if err != nil {
+		return nil
+	}
+	revisions, err := readRevisions(path)
+	if err != nil {
+		return err
+	}
+	if !replace && revisions[vaultID] >= revision {
+		return nil
+	}
+	revisions[vaultID] = revision
+
+	data, err := json.Marshal(revisions)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	// Replace the file in one step, so a crash never leaves it half written
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// rememberRevision records a revision written by this process. Failing to
+// record it only weakens rollback detection, so errors are ignored.
+func (e *Encryptor) rememberRevision(revision int64) {
+	storeSeenRevision(e.vaultID, revision, false)
+}
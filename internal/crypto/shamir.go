@@ -0,0 +1,197 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// shareVersion is the format version of encoded recovery key shares
+const shareVersion = 1
+
+// shareHeaderSize is the size of version, split ID, threshold and index
+const shareHeaderSize = 5
+
+// MaxShares is the largest number of shares a secret can be split into
+const MaxShares = 255
+
+// Share is one share of a recovery key split with Shamir secret sharing
+type Share struct {
+	SplitID   uint16 // identifies the shares created by one split
+	Threshold int    // number of shares needed to recover the secret
+	Index     int    // x coordinate of the share, 1-255
+	Value     []byte
+}
+
+// SplitSecret splits a secret into n shares, any threshold of which recover
+// it, using Shamir secret sharing over GF(256)
+func SplitSecret(secret []byte, n, threshold int) ([]Share, error) {
+	if threshold < 2 || threshold > n || n > MaxShares {
+		return nil, fmt.Errorf("invalid share parameters: need 2 <= threshold (%d) <= shares (%d) <= %d", threshold, n, MaxShares)
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("secret is empty")
+	}
+
+	var id [2]byte
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		return nil, err
+	}
+	splitID := binary.BigEndian.Uint16(id[:])
+
+	shares := make([]Share, n)
+	for i := range shares {
+		shares[i] = Share{
+			SplitID:   splitID,
+			Threshold: threshold,
+			Index:     i + 1,
+			Value:     make([]byte, len(secret)),
+		}
+	}
+
+	// Each secret byte is the constant term of its own random polynomial
+	coefficients := make([]byte, threshold)
+	defer Wipe(coefficients)
+	for b, secretByte := range secret {
+		coefficients[0] = secretByte
+		if _, err := io.ReadFull(rand.Reader, coefficients[1:]); err != nil {
+			return nil, err
+		}
+
+		for i := range shares {
+			shares[i].Value[b] = evaluatePolynomial(coefficients, byte(shares[i].Index))
+		}
+	}
+
+	return shares, nil
+}
+
+// CombineShares recovers a secret from at least threshold of its shares.
+// Wipe the result after use.
+func CombineShares(shares []Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares given")
+	}
+
+	first := shares[0]
+	if first.Threshold < 2 || first.Threshold > MaxShares {
+		return nil, fmt.Errorf("invalid share threshold %d", first.Threshold)
+	}
+	if len(shares) < first.Threshold {
+		return nil, fmt.Errorf("need %d shares, got %d", first.Threshold, len(shares))
+	}
+
+	seen := make(map[int]bool)
+	for _, share := range shares {
+		if share.SplitID != first.SplitID || share.Threshold != first.Threshold {
+			return nil, errors.New("shares do not belong to the same split")
+		}
+		if len(share.Value) != len(first.Value) {
+			return nil, errors.New("shares have different lengths")
+		}
+		if share.Index < 1 || share.Index > MaxShares {
+			return nil, fmt.Errorf("invalid share index %d", share.Index)
+		}
+		if seen[share.Index] {
+			return nil, fmt.Errorf("share %d given twice", share.Index)
+		}
+		seen[share.Index] = true
+	}
+
+	// Lagrange interpolation at x = 0; subtraction in GF(256) is XOR
+	secret := make([]byte, len(first.Value))
+	for i, share := range shares {
+		xi := byte(share.Index)
+		basis := byte(1)
+		for j, other := range shares {
+			if i == j {
+				continue
+			}
+			xj := byte(other.Index)
+			basis = gfMul(basis, gfMul(xj, gfInverse(xj^xi)))
+		}
+
+		for b := range secret {
+			secret[b] ^= gfMul(share.Value[b], basis)
+		}
+	}
+
+	return secret, nil
+}
+
+// FormatShare encodes a share with a checksum as grouped base32
+func FormatShare(share Share) string {
+	data := make([]byte, shareHeaderSize, shareHeaderSize+len(share.Value))
+	data[0] = shareVersion
+	binary.BigEndian.PutUint16(data[1:], share.SplitID)
+	data[3] = byte(share.Threshold)
+	data[4] = byte(share.Index)
+	return formatPrintable(append(data, share.Value...))
+}
+
+// ParseShare decodes a share formatted by FormatShare. Case, spaces and
+// dashes are ignored. Shares claiming a threshold below 2, which would let a
+// single share recover the secret, are rejected.
+func ParseShare(encoded []byte) (Share, error) {
+	data, err := parsePrintable(encoded)
+	if err != nil {
+		return Share{}, err
+	}
+	if len(data) <= shareHeaderSize {
+		return Share{}, errors.New("invalid share format")
+	}
+	if data[0] != shareVersion {
+		return Share{}, fmt.Errorf("unsupported share version %d", data[0])
+	}
+	if data[3] < 2 {
+		return Share{}, fmt.Errorf("invalid share threshold %d", data[3])
+	}
+	if data[4] == 0 {
+		return Share{}, errors.New("invalid share index 0")
+	}
+
+	return Share{
+		SplitID:   binary.BigEndian.Uint16(data[1:]),
+		Threshold: int(data[3]),
+		Index:     int(data[4]),
+		Value:     data[shareHeaderSize:],
+	}, nil
+}
+
+// evaluatePolynomial evaluates a polynomial over GF(256) at x using Horner's
+// method
+func evaluatePolynomial(coefficients []byte, x byte) byte {
+	var result byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = gfMul(result, x) ^ coefficients[i]
+	}
+	return result
+}
+
+// gfMul multiplies in GF(256) with the AES polynomial x^8+x^4+x^3+x+1,
+// without data-dependent branches or table lookups
+func gfMul(a, b byte) byte {
+	var product byte
+	for i := 0; i < 8; i++ {
+		product ^= a & -(b & 1)
+		carry := a >> 7
+		a = a<<1 ^ 0x1b&-carry
+		b >>= 1
+	}
+	return product
+}
+
+// gfInverse returns the multiplicative inverse in GF(256) as a^254
+func gfInverse(a byte) byte {
+	result := byte(1)
+	power := a
+	for exponent := 254; exponent > 0; exponent >>= 1 {
+		if exponent&1 == 1 {
+			result = gfMul(result, power)
+		}
+		power = gfMul(power, power)
+	}
+	return result
+}
@@ -0,0 +1,159 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGFMul(t *testing.T) {
+	// Products from FIPS-197 section 4.2
+	tests := []struct {
+		a, b, want byte
+	}{
+		{0x57, 0x83, 0xc1},
+		{0x57, 0x13, 0xfe},
+		{0x57, 0x02, 0xae},
+		{0x57, 0x04, 0x47},
+		{0x57, 0x08, 0x8e},
+		{0x57, 0x10, 0x07},
+		{0x53, 0xca, 0x01},
+	}
+	for _, tt := range tests {
+		if got := gfMul(tt.a, tt.b); got != tt.want {
+			t.Errorf("gfMul(%#02x, %#02x) = %#02x, want %#02x", tt.a, tt.b, got, tt.want)
+		}
+	}
+
+	for a := 0; a < 256; a++ {
+		if got := gfMul(byte(a), 0); got != 0 {
+			t.Errorf("gfMul(%#02x, 0) = %#02x, want 0", a, got)
+		}
+		if got := gfMul(byte(a), 1); got != byte(a) {
+			t.Errorf("gfMul(%#02x, 1) = %#02x, want %#02x", a, got, a)
+		}
+		for b := 0; b < 256; b++ {
+			if gfMul(byte(a), byte(b)) != gfMul(byte(b), byte(a)) {
+				t.Fatalf("gfMul is not commutative for %#02x, %#02x", a, b)
+			}
+		}
+	}
+}
+
+func TestGFInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if got := gfMul(byte(a), gfInverse(byte(a))); got != 1 {
+			t.Errorf("%#02x * gfInverse(%#02x) = %#02x, want 1", a, a, got)
+		}
+	}
+}
+
+func TestCombineSharesEverySubset(t *testing.T) {
+	secret := []byte("correct horse battery staple 0123")
+
+	for n := 2; n <= 6; n++ {
+		for k := 2; k <= n; k++ {
+			shares, err := SplitSecret(secret, n, k)
+			if err != nil {
+				t.Fatalf("SplitSecret(n=%d, k=%d): %v", n, k, err)
+			}
+
+			// Every subset of at least k shares recovers the secret
+			for mask := 1; mask < 1<<n; mask++ {
+				subset := subsetOf(shares, mask)
+				if len(subset) < k {
+					continue
+				}
+				got, err := CombineShares(subset)
+				if err != nil {
+					t.Fatalf("n=%d k=%d subset %b: %v", n, k, mask, err)
+				}
+				if !bytes.Equal(got, secret) {
+					t.Fatalf("n=%d k=%d subset %b: recovered %q", n, k, mask, got)
+				}
+			}
+		}
+	}
+}
+
+func TestCombineSharesBelowThreshold(t *testing.T) {
+	secret := []byte("correct horse battery staple 0123")
+	shares, err := SplitSecret(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CombineShares(shares[:2]); err == nil {
+		t.Fatal("CombineShares succeeded with fewer shares than the threshold")
+	}
+
+	// Claiming a lower threshold does not make k-1 shares recover the secret
+	forged := []Share{shares[0], shares[1]}
+	for i := range forged {
+		forged[i].Threshold = 2
+	}
+	got, err := CombineShares(forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(got, secret) {
+		t.Fatal("k-1 shares recovered the secret")
+	}
+}
+
+func TestSplitSecretParameters(t *testing.T) {
+	secret := []byte("secret")
+	tests := []struct {
+		n, threshold int
+	}{
+		{3, 1},
+		{3, 0},
+		{3, 4},
+		{MaxShares + 1, 2},
+	}
+	for _, tt := range tests {
+		if _, err := SplitSecret(secret, tt.n, tt.threshold); err == nil {
+			t.Errorf("SplitSecret(n=%d, threshold=%d) succeeded", tt.n, tt.threshold)
+		}
+	}
+}
+
+func TestParseShare(t *testing.T) {
+	shares, err := SplitSecret([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseShare([]byte(FormatShare(shares[1])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.SplitID != shares[1].SplitID || parsed.Threshold != 2 || parsed.Index != 2 ||
+		!bytes.Equal(parsed.Value, shares[1].Value) {
+		t.Fatalf("ParseShare returned %+v, want %+v", parsed, shares[1])
+	}
+
+	for _, threshold := range []int{0, 1} {
+		share := shares[0]
+		share.Threshold = threshold
+		if _, err := ParseShare([]byte(FormatShare(share))); err == nil {
+			t.Errorf("ParseShare accepted threshold %d", threshold)
+		}
+	}
+
+	share := shares[0]
+	share.Index = 0
+	if _, err := ParseShare([]byte(FormatShare(share))); err == nil {
+		t.Error("ParseShare accepted index 0")
+	}
+}
+
+// subsetOf returns the shares selected by the bits of mask
+func subsetOf(shares []Share, mask int) []Share {
+	var subset []Share
+	for i, share := range shares {
+		if mask&(1<<i) != 0 {
+			subset = append(subset, share)
+		}
+	}
+	return subset
+}
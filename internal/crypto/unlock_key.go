@@ -0,0 +1,193 @@
+package crypto
+
+import (
+	"errors"
+
+	"password-manager/internal/database"
+)
+
+// UnlockKey is the key encryption key derived from the master password and
+// key file. It unlocks the vault without running the KDF again, which lets
+// the unlock agent hold it in place of the master password. Changing the
+// master password or key file invalidates it.
+type UnlockKey struct {
+	kek     []byte
+	keyFile []byte // key file digest, if the vault requires one
+}
+
+// ErrUpgradeRequired is returned when unlocking a vault with an unlock key
+// before the master password has upgraded its verifier
+var ErrUpgradeRequired = errors.New("vault must be unlocked with the master password once to upgrade it")
+
+// DeriveUnlockKey derives the unlock key of an existing vault from the master
+// password and the key file digest, or nil if no key file is used. The key
+// is not checked until it is used by NewEncryptorWithKey.
+func DeriveUnlockKey(masterPassword, keyFile []byte, db *database.DB) (*UnlockKey, error) {
+	initialized := db.IsSealed()
+	if !initialized {
+		var err error
+		if _, initialized, err = db.GetMasterPassword(); err != nil {
+			return nil, err
+		}
+	}
+	if !initialized {
+		return nil, errors.New("vault has no master password yet")
+	}
+
+	kek, _, err := deriveVaultKEK(db, masterPassword, keyFile, true)
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(kek)
+
+	return &UnlockKey{kek: lockedCopy(kek), keyFile: lockedCopy(keyFile)}, nil
+}
+
+// NewEncryptorWithKey unlocks the vault with an unlock key. Unlike
+// NewEncryptor it never creates a vault or upgrades its KDF parameters.
+func NewEncryptorWithKey(unlockKey *UnlockKey, db *database.DB) (*Encryptor, error) {
+	if unlockKey.kek == nil {
+		return nil, ErrLocked
+	}
+
+	// Decrypt an encrypted vault file with the data key wrapped in its header
+	var file *fileCipher
+	if db.IsSealed() {
+		var err error
+		if file, err = unsealWithKEK(db, unlockKey.kek); err != nil {
+			return nil, err
+		}
+	}
+
+	storedVerifier, initialized, err := db.GetMasterPassword()
+	if err != nil {
+		return nil, err
+	}
+	if !initialized {
+		return nil, errors.New("vault has no master password yet")
+	}
+	if !hasIntegrityVerifier(storedVerifier) {
+		return nil, ErrUpgradeRequired
+	}
+
+	verified, err := db.VerifyMasterPassword(computeVerifier(unlockKey.kek))
+	if err != nil {
+		return nil, err
+	}
+	if !verified {
+		return nil, errors.New("incorrect master password")
+	}
+
+	aead, err := loadAEAD(db)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := loadDataKey(db, unlockKey.kek, aead)
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(key)
+
+	vaultID, err := loadVaultID(db)
+	if err != nil {
+		return nil, err
+	}
+
+	encryptor := &Encryptor{
+		key:          lockedCopy(key),
+		indexKey:     deriveIndexKey(key),
+		keyFile:      lockedCopy(unlockKey.keyFile),
+		integrityKey: deriveIntegrityKey(key),
+		aead:         aead,
+		file:         file,
+		vaultID:      vaultID,
+		db:           db,
+	}
+
+	if err := encryptor.checkIntegrity(true); err != nil {
+		encryptor.Lock()
+		return nil, err
+	}
+	return encryptor, nil
+}
+
+// VerifyUnlockKey checks that an unlock key opens the vault without unlocking
+// it. An encrypted vault file is checked against the data key wrapped in its
+// header, so it is not decrypted.
+func VerifyUnlockKey(unlockKey *UnlockKey, db *database.DB) error {
+	if unlockKey.kek == nil {
+		return ErrLocked
+	}
+
+	if db.IsSealed() {
+		wrappedKey, found, err := db.GetKey(MasterKeySlot)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return errors.New("vault file has no master key")
+		}
+		dataKey, err := unwrapKey(unlockKey.kek, wrappedKey, MasterKeySlot)
+		if err != nil {
+			return errors.New("incorrect master password")
+		}
+		Wipe(dataKey)
+		return nil
+	}
+
+	storedVerifier, initialized, err := db.GetMasterPassword()
+	if err != nil {
+		return err
+	}
+	if !initialized {
+		return errors.New("vault has no master password yet")
+	}
+	if !hasIntegrityVerifier(storedVerifier) {
+		return ErrUpgradeRequired
+	}
+	verified, err := db.VerifyMasterPassword(computeVerifier(unlockKey.kek))
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return errors.New("incorrect master password")
+	}
+	return nil
+}
+
+// MarshalBinary encodes the unlock key to hand it between processes. Wipe
+// the result after use.
+func (k *UnlockKey) MarshalBinary() ([]byte, error) {
+	if k.kek == nil {
+		return nil, ErrLocked
+	}
+
+	data := make([]byte, 0, 1+len(k.kek)+len(k.keyFile))
+	data = append(data, byte(len(k.kek)))
+	data = append(data, k.kek...)
+	return append(data, k.keyFile...), nil
+}
+
+// UnmarshalBinary decodes an unlock key encoded by MarshalBinary
+func (k *UnlockKey) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 || int(data[0]) == 0 || len(data) < 1+int(data[0]) {
+		return errors.New("invalid unlock key")
+	}
+
+	k.Wipe()
+	kek, keyFile := data[1:1+int(data[0])], data[1+int(data[0]):]
+	k.kek = lockedCopy(kek)
+	if len(keyFile) > 0 {
+		k.keyFile = lockedCopy(keyFile)
+	}
+	return nil
+}
+
+// Wipe removes the key from memory. The key cannot be used afterwards.
+func (k *UnlockKey) Wipe() {
+	releaseLocked(k.kek)
+	releaseLocked(k.keyFile)
+	k.kek = nil
+	k.keyFile = nil
+}
@@ -0,0 +1,123 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+
+	"password-manager/internal/database"
+)
+
+// vaultFileContext derives the key of encrypted vault files from the data key
+const vaultFileContext = "password-manager vault file v1"
+
+// errVaultFileTampered is returned when an encrypted vault file fails to
+// authenticate under the unwrapped data key
+var errVaultFileTampered = errors.New("vault file failed integrity check (possible tampering)")
+
+// fileCipher encrypts the whole vault file with a key derived from the data
+// key, so every unlock method that yields the data key can also decrypt it
+type fileCipher struct {
+	aead AEAD
+	key  []byte
+}
+
+// newFileCipher derives the vault file key from the data key
+func newFileCipher(alg AEAD, dataKey []byte) *fileCipher {
+	mac := hmac.New(sha256.New, dataKey)
+	mac.Write([]byte(vaultFileContext))
+	key := mac.Sum(nil)
+	defer Wipe(key)
+
+	return &fileCipher{aead: alg, key: lockedCopy(key)}
+}
+
+// Seal encrypts the serialized vault database
+func (c *fileCipher) Seal(plaintext, additionalData []byte) ([]byte, error) {
+	if c.key == nil {
+		return nil, ErrLocked
+	}
+	return sealBytes(c.aead, keyIDVaultFile, c.key, plaintext, additionalData)
+}
+
+// Open decrypts the serialized vault database
+func (c *fileCipher) Open(ciphertext, additionalData []byte) ([]byte, error) {
+	if c.key == nil {
+		return nil, ErrLocked
+	}
+
+	plaintext, err := openBytes(keyIDVaultFile, c.key, ciphertext, additionalData)
+	if err == errAuthentication {
+		return nil, errVaultFileTampered
+	}
+	return plaintext, err
+}
+
+// lock wipes the vault file key
+func (c *fileCipher) lock() {
+	releaseLocked(c.key)
+	c.key = nil
+}
+
+// unsealWithKEK decrypts a sealed vault file with the data key wrapped under
+// the master password key encryption key
+func unsealWithKEK(db *database.DB, kek []byte) (*fileCipher, error) {
+	wrappedKey, found, err := db.GetKey(MasterKeySlot)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("vault file has no master key")
+	}
+
+	dataKey, err := unwrapKey(kek, wrappedKey, MasterKeySlot)
+	if err != nil {
+		return nil, errors.New("incorrect master password")
+	}
+	defer Wipe(dataKey)
+
+	return unsealVaultFile(db, dataKey)
+}
+
+// unsealVaultFile decrypts a sealed vault file with the data key unwrapped
+// from its header
+func unsealVaultFile(db *database.DB, dataKey []byte) (*fileCipher, error) {
+	aead, err := loadAEAD(db)
+	if err != nil {
+		return nil, err
+	}
+
+	file := newFileCipher(aead, dataKey)
+	if err := db.Unseal(file); err != nil {
+		file.lock()
+		return nil, err
+	}
+	return file, nil
+}
+
+// EncryptVaultFile switches the vault to whole-file encryption, so the file
+// on disk reveals nothing beyond the header needed to unlock it
+func (e *Encryptor) EncryptVaultFile() error {
+	if e.key == nil {
+		return ErrLocked
+	}
+
+	if e.file == nil {
+		e.file = newFileCipher(e.aead, e.key)
+	}
+	return e.db.EncryptFile(e.file)
+}
+
+// DecryptVaultFile switches the vault back to a plain SQLite file. Entries
+// stay encrypted.
+func (e *Encryptor) DecryptVaultFile() error {
+	if e.key == nil {
+		return ErrLocked
+	}
+	return e.db.DecryptFile()
+}
+
+// VaultFileEncrypted reports whether the whole vault file is encrypted
+func (e *Encryptor) VaultFileEncrypted() bool {
+	return e.db.IsEncrypted()
+}
@@ -0,0 +1,67 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+)
+
+// verifierPrefix marks master password verifiers of vaults protected by an
+// integrity root. As the verifier cannot be recomputed without the key, the
+// integrity root cannot be stripped by downgrading it.
+const verifierPrefix = "hmac-sha256-v2$"
+
+// verifierV1Prefix marks verifiers written before the integrity root. Stored
+// values with neither prefix are legacy unsalted SHA-256 hashes.
+const verifierV1Prefix = "hmac-sha256$"
+
+// Constants authenticated by the verifiers
+const (
+	verifierContext   = "password-manager master password verifier v2"
+	verifierV1Context = "password-manager master password verifier v1"
+)
+
+// computeVerifier derives the master password verifier from a KDF output key
+func computeVerifier(key []byte) string {
+	return verifierPrefix + verifierMAC(key, verifierContext)
+}
+
+// verifierMAC returns the base64 HMAC of a verifier context under key
+func verifierMAC(key []byte, context string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(context))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// hasIntegrityVerifier reports whether a stored verifier marks a vault that
+// has an integrity root
+func hasIntegrityVerifier(stored string) bool {
+	return strings.HasPrefix(stored, verifierPrefix)
+}
+
+// isV1Verifier reports whether a stored verifier predates the integrity root
+func isV1Verifier(stored string) bool {
+	return strings.HasPrefix(stored, verifierV1Prefix)
+}
+
+// isLegacyVerifier reports whether a stored verifier is a legacy SHA-256 hash
+func isLegacyVerifier(stored string) bool {
+	return !hasIntegrityVerifier(stored) && !isV1Verifier(stored)
+}
+
+// verifyV1Verifier checks a KDF output key against a verifier written before
+// the integrity root in constant time
+func verifyV1Verifier(key []byte, stored string) bool {
+	computed := verifierV1Prefix + verifierMAC(key, verifierV1Context)
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(stored)) == 1
+}
+
+// verifyLegacyHash checks the master password against a legacy unsalted
+// SHA-256 hash in constant time
+func verifyLegacyHash(masterPassword []byte, stored string) bool {
+	hash := sha256.Sum256(masterPassword)
+	encoded := base64.StdEncoding.EncodeToString(hash[:])
+	return subtle.ConstantTimeCompare([]byte(encoded), []byte(stored)) == 1
+}
@@ -0,0 +1,60 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestUpgradeVerifier(t *testing.T) {
+	legacyHash := func([]byte) string {
+		hash := sha256.Sum256(testPassword)
+		return base64.StdEncoding.EncodeToString(hash[:])
+	}
+
+	for name, verifier := range map[string]func(kek []byte) string{"sha256 hash": legacyHash, "verifier v1": v1Verifier} {
+		t.Run(name, func(t *testing.T) {
+			db := newBaselineVault(t, verifier)
+			baseline := storedVerifier(t, db)
+
+			// A wrong password is rejected without upgrading anything
+			if _, err := NewEncryptor([]byte("wrong password"), nil, db); err == nil || !strings.Contains(err.Error(), "incorrect master password") {
+				t.Fatalf("wrong password on the baseline vault: %v", err)
+			}
+			if _, found, _ := loadKDFParams(db); found || storedVerifier(t, db) != baseline {
+				t.Fatal("baseline vault was upgraded by a wrong password")
+			}
+
+			encryptor, err := NewEncryptor(testPassword, nil, db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkEntry(t, encryptor, db)
+			encryptor.Lock()
+			upgraded := storedVerifier(t, db)
+			if !strings.HasPrefix(upgraded, verifierPrefix) {
+				t.Errorf("verifier after the upgrade: %q", upgraded)
+			}
+			if strings.Contains(upgraded, baseline) || strings.Contains(upgraded, legacyHash(nil)) {
+				t.Error("upgraded verifier contains the old one")
+			}
+
+			// The old password still unlocks the vault, and only it does
+			if _, err := NewEncryptor([]byte("wrong password"), nil, db); err == nil || !strings.Contains(err.Error(), "incorrect master password") {
+				t.Errorf("wrong password on the upgraded vault: %v", err)
+			}
+			reopened, err := NewEncryptor(testPassword, nil, db)
+			if err != nil {
+				t.Fatalf("upgraded vault does not open with the old password: %v", err)
+			}
+			defer reopened.Lock()
+			if ok, err := reopened.VerifyMasterPassword(testPassword); err != nil || !ok {
+				t.Errorf("VerifyMasterPassword(old password) = %v, %v", ok, err)
+			}
+			if ok, err := reopened.VerifyMasterPassword([]byte("wrong password")); err != nil || ok {
+				t.Errorf("VerifyMasterPassword(wrong password) = %v, %v", ok, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"time"
+
+	"password-manager/internal/models"
+)
+
+// CreateAttachment creates an attachment of an entry and sets its ID. Its
+// chunks and metadata are written afterwards, in the same transaction.
+func (db *DB) CreateAttachment(attachment *models.Attachment) error {
+	now := time.Now()
+	result, err := db.exec("INSERT INTO attachments (password_id, metadata, created_at) VALUES (?, ?, ?)",
+		attachment.PasswordID, attachment.Metadata, now)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	attachment.ID = int(id)
+	attachment.CreatedAt = now
+	return nil
+}
+
+// SetAttachmentMetadata stores the encrypted metadata of an attachment
+func (db *DB) SetAttachmentMetadata(id int, metadata string) error {
+	_, err := db.exec("UPDATE attachments SET metadata = ? WHERE id = ?", metadata, id)
+	return err
+}
+
+// AddAttachmentChunk stores one encrypted chunk of an attachment as a BLOB
+func (db *DB) AddAttachmentChunk(attachmentID, position int, data []byte) error {
+	_, err := db.exec("INSERT INTO attachment_chunks (attachment_id, position, data) VALUES (?, ?, ?)",
+		attachmentID, position, data)
+	return err
+}
+
+// ListAttachments lists the attachments of an entry
+func (db *DB) ListAttachments(passwordID int) ([]*models.Attachment, error) {
+	rows, err := db.query("SELECT id, password_id, metadata, created_at FROM attachments WHERE password_id = ? ORDER BY id", passwordID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []*models.Attachment
+	for rows.Next() {
+		attachment := &models.Attachment{}
+		if err := rows.Scan(&attachment.ID, &attachment.PasswordID, &attachment.Metadata, &attachment.CreatedAt); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments, rows.Err()
+}
+
+// EachAttachmentChunk calls fn with every encrypted chunk of an attachment in
+// order, reading one chunk at a time. fn must not use the database.
+func (db *DB) EachAttachmentChunk(attachmentID int, fn func(position int, data []byte) error) error {
+	rows, err := db.query("SELECT position, data FROM attachment_chunks WHERE attachment_id = ? ORDER BY position", attachmentID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var position int
+		var data []byte
+		if err := rows.Scan(&position, &data); err != nil {
+			return err
+		}
+		if err := fn(position, data); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// DeleteAttachment deletes an attachment and its chunks
+func (db *DB) DeleteAttachment(id int) error {
+	return db.Transaction(func(tx *DB) error {
+		if _, err := tx.exec("DELETE FROM attachment_chunks WHERE attachment_id = ?", id); err != nil {
+			return err
+		}
+		_, err := tx.exec("DELETE FROM attachments WHERE id = ?", id)
+		return err
+	})
+}
@@ -0,0 +1,165 @@
+package database
+
+import (
+	"time"
+
+	"password-manager/internal/models"
+)
+
+// CreateFolder creates a folder and sets its ID
+func (db *DB) CreateFolder(folder *models.Folder) error {
+	now := time.Now()
+	result, err := db.exec("INSERT INTO folders (parent_id, name, created_at) VALUES (?, ?, ?)",
+		nullableID(folder.ParentID), folder.Name, now)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	folder.ID = int(id)
+	folder.CreatedAt = now
+	return nil
+}
+
+// ListFolders lists all folders
+func (db *DB) ListFolders() ([]*models.Folder, error) {
+	rows, err := db.query("SELECT id, COALESCE(parent_id, 0), name, created_at FROM folders ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var folders []*models.Folder
+	for rows.Next() {
+		folder := &models.Folder{}
+		if err := rows.Scan(&folder.ID, &folder.ParentID, &folder.Name, &folder.CreatedAt); err != nil {
+			return nil, err
+		}
+		folders = append(folders, folder)
+	}
+
+	return folders, rows.Err()
+}
+
+// RenameFolder sets the encrypted name of a folder
+func (db *DB) RenameFolder(id int, name string) error {
+	_, err := db.exec("UPDATE folders SET name = ? WHERE id = ?", name, id)
+	return err
+}
+
+// DeleteFolder deletes a folder, moving its entries to its parent
+func (db *DB) DeleteFolder(id, parentID int) error {
+	return db.Transaction(func(tx *DB) error {
+		if _, err := tx.exec("UPDATE passwords SET folder_id = ? WHERE folder_id = ?", nullableID(parentID), id); err != nil {
+			return err
+		}
+		_, err := tx.exec("DELETE FROM folders WHERE id = ?", id)
+		return err
+	})
+}
+
+// SetPasswordFolder moves an entry to a folder, or out of any folder if
+// folderID is 0
+func (db *DB) SetPasswordFolder(passwordID, folderID int) error {
+	_, err := db.exec("UPDATE passwords SET folder_id = ? WHERE id = ?", nullableID(folderID), passwordID)
+	return err
+}
+
+// CreateTag creates a tag and sets its ID
+func (db *DB) CreateTag(tag *models.Tag) error {
+	now := time.Now()
+	result, err := db.exec("INSERT INTO tags (name, created_at) VALUES (?, ?)", tag.Name, now)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	tag.ID = int(id)
+	tag.CreatedAt = now
+	return nil
+}
+
+// ListTags lists all tags
+func (db *DB) ListTags() ([]*models.Tag, error) {
+	rows, err := db.query("SELECT id, name, created_at FROM tags ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []*models.Tag
+	for rows.Next() {
+		tag := &models.Tag{}
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.CreatedAt); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+// RenameTag sets the encrypted name of a tag
+func (db *DB) RenameTag(id int, name string) error {
+	_, err := db.exec("UPDATE tags SET name = ? WHERE id = ?", name, id)
+	return err
+}
+
+// DeleteTag deletes a tag and removes it from every entry
+func (db *DB) DeleteTag(id int) error {
+	return db.Transaction(func(tx *DB) error {
+		if _, err := tx.exec("DELETE FROM password_tags WHERE tag_id = ?", id); err != nil {
+			return err
+		}
+		_, err := tx.exec("DELETE FROM tags WHERE id = ?", id)
+		return err
+	})
+}
+
+// AddPasswordTag attaches a tag to an entry
+func (db *DB) AddPasswordTag(passwordID, tagID int) error {
+	_, err := db.exec("INSERT OR IGNORE INTO password_tags (password_id, tag_id) VALUES (?, ?)", passwordID, tagID)
+	return err
+}
+
+// RemovePasswordTag detaches a tag from an entry
+func (db *DB) RemovePasswordTag(passwordID, tagID int) error {
+	_, err := db.exec("DELETE FROM password_tags WHERE password_id = ? AND tag_id = ?", passwordID, tagID)
+	return err
+}
+
+// ListPasswordTags returns the tag IDs of every tagged entry by entry ID
+func (db *DB) ListPasswordTags() (map[int][]int, error) {
+	rows, err := db.query("SELECT password_id, tag_id FROM password_tags ORDER BY password_id, tag_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make(map[int][]int)
+	for rows.Next() {
+		var passwordID, tagID int
+		if err := rows.Scan(&passwordID, &tagID); err != nil {
+			return nil, err
+		}
+		tags[passwordID] = append(tags[passwordID], tagID)
+	}
+
+	return tags, rows.Err()
+}
+
+// nullableID stores an ID of 0 as NULL
+func nullableID(id int) any {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
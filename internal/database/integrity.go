@@ -0,0 +1,384 @@
+package database
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// IntegrityMAC computes a keyed MAC for the vault integrity root. It returns
+// an error when the key is not available, which aborts the write.
+type IntegrityMAC func(data []byte) ([]byte, error)
+
+// RevisionRecorder is called with the new revision once a write that updated
+// the integrity root is committed
+type RevisionRecorder func(revision int64)
+
+// integrityTables are the tables covered by the vault integrity root
+var integrityTables = []string{
+	"passwords", "keys", "master_password", "salts", "vault_metadata", "password_history",
+	"folders", "tags", "password_tags", "attachments", "attachment_chunks",
+	"otp_secrets",
+}
+
+// integrityChangesTable lists the rows of the integrity tables changed since
+// the integrity root was last updated. Triggers on the integrity tables fill
+// it; a row changed twice is listed twice, as a conflict clause on the
+// statement firing a trigger would override one in the trigger.
+const integrityChangesTable = "integrity_changes"
+
+// Domain separation bytes for the MACs of the integrity tree
+const (
+	integrityLeafTag byte = iota
+	integrityNodeTag
+	integrityRootTag
+)
+
+// integrityCache holds the leaf MACs of the rows covered by the integrity root
+// as of a revision, so that a write only recomputes the leaves of the rows it
+// changed
+type integrityCache struct {
+	revision int64
+	leaves   map[string]map[int64][]byte // by table and rowid, nil if unknown
+}
+
+// SetIntegrityMAC makes every following write transaction update the vault
+// integrity root with mac. A nil mac stops the updates.
+func (db *DB) SetIntegrityMAC(mac IntegrityMAC) {
+	db.mac = mac
+}
+
+// SetRevisionRecorder makes every following write that updates the integrity
+// root pass its new revision to record once it is committed
+func (db *DB) SetRevisionRecorder(record RevisionRecorder) {
+	db.recorder = record
+}
+
+// UpdateIntegrity records the integrity root of the current vault contents
+// under the next revision
+func (db *DB) UpdateIntegrity() error {
+	// Every write transaction updates the root, so an empty one is enough
+	return db.Transaction(func(tx *DB) error { return nil })
+}
+
+// VerifyIntegrity recomputes the integrity root with mac and compares it in
+// constant time with the stored one. found is false if the vault has no
+// integrity root yet. The leaf MACs computed are kept for the writes that
+// follow, which must update the root with the same mac.
+func (db *DB) VerifyIntegrity(mac IntegrityMAC) (found, valid bool, err error) {
+	revision, stored, found, err := db.integrityState()
+	if err != nil || !found {
+		return false, false, err
+	}
+
+	// After a schema upgrade, check the rows as they were stored
+	var leaves [][]byte
+	if db.baseline != nil {
+		leaves, err = rowLeaves(mac, db.baseline)
+	} else {
+		var tables map[string]map[int64][]byte
+		if tables, err = db.tableLeaves(mac); err == nil {
+			db.cache.leaves = tables
+			db.cache.revision = revision
+			leaves = orderedLeaves(tables)
+		}
+	}
+	if err != nil {
+		return true, false, err
+	}
+
+	root, err := integrityRoot(mac, revision, leaves)
+	if err != nil {
+		return true, false, err
+	}
+	return true, subtle.ConstantTimeCompare([]byte(root), []byte(stored)) == 1, nil
+}
+
+// IntegrityRevision returns the revision counter of the vault, incremented by
+// every write
+func (db *DB) IntegrityRevision() (int64, error) {
+	revision, _, _, err := db.integrityState()
+	return revision, err
+}
+
+// integrityState returns the stored revision and integrity root
+func (db *DB) integrityState() (int64, string, bool, error) {
+	var revision int64
+	var root string
+	err := db.queryRow("SELECT revision, root FROM vault_integrity WHERE id = 1").Scan(&revision, &root)
+	if err == sql.ErrNoRows {
+		return 0, "", false, nil
+	}
+	if err != nil {
+		return 0, "", false, err
+	}
+	return revision, root, true, nil
+}
+
+// updateIntegrity stores the integrity root of the database under the next
+// revision and returns the revision. It runs inside the write transaction it
+// covers.
+func (db *DB) updateIntegrity() (int64, error) {
+	revision, _, _, err := db.integrityState()
+	if err != nil {
+		return 0, err
+	}
+
+	leaves, err := db.currentLeaves(revision)
+	if err != nil {
+		return 0, err
+	}
+	revision++
+	root, err := integrityRoot(db.mac, revision, leaves)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+    INSERT INTO vault_integrity (id, revision, root, updated_at) VALUES (1, ?, ?, ?)
+    ON CONFLICT(id) DO UPDATE SET revision = excluded.revision, root = excluded.root,
+        updated_at = excluded.updated_at
+    `
+	if _, err := db.exec(query, revision, root, time.Now()); err != nil {
+		return 0, err
+	}
+	db.cache.revision = revision
+	return revision, nil
+}
+
+// currentLeaves brings the cached leaf MACs up to date with the rows changed
+// since revision and returns them in the order of the integrity tree. Unless
+// the cache holds the leaves of that revision, as when another process wrote
+// to the vault since, every leaf is recomputed.
+func (db *DB) currentLeaves(revision int64) ([][]byte, error) {
+	tracked, err := db.tableExists(integrityChangesTable)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := db.cache
+	if cache.leaves == nil || cache.revision != revision || !tracked {
+		if cache.leaves, err = db.tableLeaves(db.mac); err != nil {
+			cache.leaves = nil
+			return nil, err
+		}
+	} else if err := db.updateChangedLeaves(); err != nil {
+		cache.leaves = nil
+		return nil, err
+	}
+
+	if tracked {
+		if _, err := db.exec("DELETE FROM " + integrityChangesTable); err != nil {
+			return nil, err
+		}
+	}
+	return orderedLeaves(cache.leaves), nil
+}
+
+// updateChangedLeaves recomputes the cached leaf MACs of the rows listed in
+// the changes table, dropping those of deleted rows
+func (db *DB) updateChangedLeaves() error {
+	type change struct {
+		table string
+		rowid int64
+	}
+
+	rows, err := db.query("SELECT DISTINCT table_name, row_id FROM " + integrityChangesTable)
+	if err != nil {
+		return err
+	}
+	var changes []change
+	for rows.Next() {
+		var c change
+		if err := rows.Scan(&c.table, &c.rowid); err != nil {
+			rows.Close()
+			return err
+		}
+		changes = append(changes, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range changes {
+		statement, found, err := db.tableRow(c.table, c.rowid)
+		if err != nil {
+			return err
+		}
+
+		leaves := db.cache.leaves[c.table]
+		if !found {
+			delete(leaves, c.rowid)
+			continue
+		}
+		leaf, err := db.mac(append([]byte{integrityLeafTag}, statement...))
+		if err != nil {
+			return err
+		}
+		if leaves == nil {
+			leaves = make(map[int64][]byte)
+			db.cache.leaves[c.table] = leaves
+		}
+		leaves[c.rowid] = leaf
+	}
+	return nil
+}
+
+// trackIntegrityChanges creates triggers recording the rowid of every row of
+// tables that is inserted, updated or deleted in the changes table
+func (db *DB) trackIntegrityChanges(tables ...string) error {
+	for _, table := range tables {
+		name := strings.ReplaceAll(table, "'", "''")
+		record := func(row string) string {
+			return "INSERT INTO " + integrityChangesTable + " (table_name, row_id) VALUES ('" +
+				name + "', " + row + ".rowid);"
+		}
+
+		triggers := map[string]string{
+			"INSERT": record("NEW"),
+			"UPDATE": record("OLD") + " " + record("NEW"),
+			"DELETE": record("OLD"),
+		}
+		for _, event := range []string{"INSERT", "UPDATE", "DELETE"} {
+			trigger := quoteIdentifier("integrity_" + table + "_" + strings.ToLower(event))
+			_, err := db.exec("CREATE TRIGGER IF NOT EXISTS " + trigger + " AFTER " + event + " ON " +
+				quoteIdentifier(table) + " BEGIN " + triggers[event] + " END")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// integrityRows returns the rows of the integrity tables, skipping tables
+// that do not exist yet
+func (db *DB) integrityRows() (map[string][]string, error) {
+	rows := make(map[string][]string)
+	for _, table := range integrityTables {
+		exists, err := db.tableExists(table)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+
+		if rows[table], err = db.tableRows(table); err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+// tableLeaves computes the leaf MAC of every row of the integrity tables, by
+// table and rowid. Rows are read one at a time, so large tables such as
+// attachment chunks are not held in memory.
+func (db *DB) tableLeaves(mac IntegrityMAC) (map[string]map[int64][]byte, error) {
+	tables := make(map[string]map[int64][]byte)
+	for _, table := range integrityTables {
+		exists, err := db.tableExists(table)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+
+		leaves := make(map[int64][]byte)
+		err = db.eachTableRow(table, func(rowid int64, row string) error {
+			leaf, err := mac(append([]byte{integrityLeafTag}, row...))
+			leaves[rowid] = leaf
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		tables[table] = leaves
+	}
+	return tables, nil
+}
+
+// orderedLeaves returns leaf MACs by table and rowid in the order of the
+// integrity tree: by table, then by rowid
+func orderedLeaves(tables map[string]map[int64][]byte) [][]byte {
+	var leaves [][]byte
+	for _, table := range integrityTables {
+		rowids := slices.Sorted(maps.Keys(tables[table]))
+		for _, rowid := range rowids {
+			leaves = append(leaves, tables[table][rowid])
+		}
+	}
+	return leaves
+}
+
+// rowLeaves computes the leaf MACs of rows returned by integrityRows
+func rowLeaves(mac IntegrityMAC, rows map[string][]string) ([][]byte, error) {
+	var leaves [][]byte
+	for _, table := range integrityTables {
+		for _, row := range rows[table] {
+			leaf, err := mac(append([]byte{integrityLeafTag}, row...))
+			if err != nil {
+				return nil, err
+			}
+			leaves = append(leaves, leaf)
+		}
+	}
+	return leaves, nil
+}
+
+// captureIntegrityBaseline keeps the rows covered by the integrity root
+// before a schema upgrade changes them
+func (db *DB) captureIntegrityBaseline() error {
+	exists, err := db.tableExists("vault_integrity")
+	if err != nil || !exists {
+		return err
+	}
+
+	db.baseline, err = db.integrityRows()
+	return err
+}
+
+// integrityRoot computes the MAC of a revision and the Merkle root over the
+// leaf MACs of the rows of the integrity tables. Deleting, reordering or
+// rolling back any row changes the root.
+func integrityRoot(mac IntegrityMAC, revision int64, level [][]byte) (string, error) {
+	leaves := len(level)
+
+	// Pair up nodes until one is left; an odd node moves up unchanged
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			node, err := mac(append(append([]byte{integrityNodeTag}, level[i]...), level[i+1]...))
+			if err != nil {
+				return "", err
+			}
+			next = append(next, node)
+		}
+		level = next
+	}
+
+	data := make([]byte, 17)
+	data[0] = integrityRootTag
+	binary.BigEndian.PutUint64(data[1:], uint64(revision))
+	binary.BigEndian.PutUint64(data[9:], uint64(leaves))
+	if len(level) == 1 {
+		data = append(data, level[0]...)
+	}
+
+	root, err := mac(data)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(root), nil
+}
@@ -0,0 +1,432 @@
+package database
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// migration is one numbered change to the vault schema. Released migrations
+// must never change; schema changes are made by appending a new one.
+type migration struct {
+	version int
+	name    string
+	apply   func(tx *DB) error
+}
+
+// migrations are applied in order, each in its own transaction. The first
+// ones also adopt vaults created before schema versions were recorded, which
+// may already contain their tables.
+var migrations = []migration{
+	{1, "create initial tables", func(tx *DB) error {
+		_, err := tx.exec(`
+        CREATE TABLE IF NOT EXISTS master_password (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            password_hash TEXT NOT NULL,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE TABLE IF NOT EXISTS salts (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            salt TEXT NOT NULL,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE TABLE IF NOT EXISTS passwords (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            service TEXT NOT NULL,
+            username TEXT NOT NULL,
+            password TEXT NOT NULL,
+            url TEXT,
+            notes TEXT,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            UNIQUE(service, username)
+        );
+
+        CREATE INDEX IF NOT EXISTS idx_service ON passwords(service);
+        `)
+		return err
+	}},
+	{2, "add key slots and vault metadata", func(tx *DB) error {
+		_, err := tx.exec(`
+        CREATE TABLE IF NOT EXISTS keys (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            slot TEXT NOT NULL UNIQUE,
+            wrapped_key TEXT NOT NULL,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE TABLE IF NOT EXISTS vault_metadata (
+            key TEXT PRIMARY KEY,
+            value TEXT NOT NULL,
+            updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        );
+        `)
+		return err
+	}},
+	{3, "add entry lookup hash", func(tx *DB) error {
+		// Entries store a blind index of service and username for lookups
+		if err := tx.addColumn("passwords", "lookup_hash", "TEXT"); err != nil {
+			return err
+		}
+		_, err := tx.exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_lookup_hash ON passwords(lookup_hash)")
+		return err
+	}},
+	{4, "add vault integrity root", func(tx *DB) error {
+		_, err := tx.exec(`
+        CREATE TABLE IF NOT EXISTS vault_integrity (
+            id INTEGER PRIMARY KEY CHECK (id = 1),
+            revision INTEGER NOT NULL,
+            root TEXT NOT NULL,
+            updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        );
+        `)
+		return err
+	}},
+	{5, "add password history", func(tx *DB) error {
+		_, err := tx.exec(`
+        CREATE TABLE password_history (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            password_id INTEGER NOT NULL REFERENCES passwords(id),
+            password TEXT NOT NULL,
+            replaced_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE INDEX idx_password_history_entry ON password_history(password_id);
+        `)
+		return err
+	}},
+	{6, "add trash", func(tx *DB) error {
+		// Deleted entries keep their row with deleted_at set until purged
+		return tx.addColumn("passwords", "deleted_at", "DATETIME")
+	}},
+	{7, "add folders and tags", func(tx *DB) error {
+		if err := tx.addColumn("passwords", "folder_id", "INTEGER REFERENCES folders(id)"); err != nil {
+			return err
+		}
+		_, err := tx.exec(`
+        CREATE TABLE folders (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            parent_id INTEGER REFERENCES folders(id),
+            name TEXT NOT NULL,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE TABLE tags (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            name TEXT NOT NULL,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE TABLE password_tags (
+            password_id INTEGER NOT NULL REFERENCES passwords(id),
+            tag_id INTEGER NOT NULL REFERENCES tags(id),
+            PRIMARY KEY (password_id, tag_id)
+        );
+
+        CREATE INDEX idx_password_tags_tag ON password_tags(tag_id);
+        `)
+		return err
+	}},
+	{8, "add custom fields", func(tx *DB) error {
+		// Custom fields are stored together as one encrypted list
+		return tx.addColumn("passwords", "fields", "TEXT")
+	}},
+	{9, "add attachments", func(tx *DB) error {
+		_, err := tx.exec(`
+        CREATE TABLE attachments (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            password_id INTEGER NOT NULL REFERENCES passwords(id),
+            metadata TEXT NOT NULL,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE INDEX idx_attachments_entry ON attachments(password_id);
+
+        CREATE TABLE attachment_chunks (
+            attachment_id INTEGER NOT NULL REFERENCES attachments(id),
+            position INTEGER NOT NULL,
+            data TEXT NOT NULL,
+            PRIMARY KEY (attachment_id, position)
+        );
+        `)
+		return err
+	}},
+	{10, "add entry types", func(tx *DB) error {
+		// Existing entries have neither column set and are logins
+		if err := tx.addColumn("passwords", "entry_type", "TEXT"); err != nil {
+			return err
+		}
+		return tx.addColumn("passwords", "details", "TEXT")
+	}},
+	{11, "add one-time passwords", func(tx *DB) error {
+		// The HOTP counter is kept in plain text so it can be advanced atomically
+		_, err := tx.exec(`
+        CREATE TABLE otp_secrets (
+            password_id INTEGER PRIMARY KEY REFERENCES passwords(id),
+            secret TEXT NOT NULL,
+            counter INTEGER NOT NULL DEFAULT 0
+        );
+        `)
+		return err
+	}},
+	{12, "track rows changed since the integrity root", func(tx *DB) error {
+		// Writes recompute the integrity leaves of the rows listed here only
+		_, err := tx.exec(`
+        CREATE TABLE integrity_changes (
+            table_name TEXT NOT NULL,
+            row_id INTEGER NOT NULL
+        );
+        `)
+		if err != nil {
+			return err
+		}
+		return tx.trackIntegrityChanges(
+			"passwords", "keys", "master_password", "salts", "vault_metadata", "password_history",
+			"folders", "tags", "password_tags", "attachments", "attachment_chunks",
+			"otp_secrets",
+		)
+	}},
+	{13, "store attachment chunks as blobs", func(tx *DB) error {
+		// Chunks were stored as text envelopes, which are the base64 of the
+		// binary envelope after a prefix
+		_, err := tx.exec(`
+        CREATE TABLE attachment_chunks_blob (
+            attachment_id INTEGER NOT NULL REFERENCES attachments(id),
+            position INTEGER NOT NULL,
+            data BLOB NOT NULL,
+            PRIMARY KEY (attachment_id, position)
+        );
+        `)
+		if err != nil {
+			return err
+		}
+		if err := tx.decodeChunks("attachment_chunks", "attachment_chunks_blob", "pm:"); err != nil {
+			return err
+		}
+
+		_, err = tx.exec(`
+        DROP TABLE attachment_chunks;
+        ALTER TABLE attachment_chunks_blob RENAME TO attachment_chunks;
+        `)
+		if err != nil {
+			return err
+		}
+		return tx.trackIntegrityChanges("attachment_chunks")
+	}},
+	{14, "drop the unique constraint on encrypted service and username", func(tx *DB) error {
+		// Service and username are encrypted with random nonces, so
+		// UNIQUE(service, username) and idx_service never match; the unique
+		// lookup hash rejects duplicates instead. SQLite cannot
+		// drop a constraint, so the table is rebuilt with the same rowids, and
+		// its AUTOINCREMENT counter is kept so that the ids of purged entries,
+		// which are bound into their ciphertexts, are never reused.
+		_, err := tx.exec(`
+        CREATE TABLE passwords_rebuilt (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            service TEXT NOT NULL,
+            username TEXT NOT NULL,
+            password TEXT NOT NULL,
+            url TEXT,
+            notes TEXT,
+            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+            lookup_hash TEXT,
+            deleted_at DATETIME,
+            folder_id INTEGER REFERENCES folders(id),
+            fields TEXT,
+            entry_type TEXT,
+            details TEXT
+        );
+
+        INSERT INTO passwords_rebuilt (id, service, username, password, url, notes, created_at, updated_at,
+            lookup_hash, deleted_at, folder_id, fields, entry_type, details)
+        SELECT id, service, username, password, url, notes, created_at, updated_at,
+            lookup_hash, deleted_at, folder_id, fields, entry_type, details
+        FROM passwords;
+
+        DELETE FROM sqlite_sequence WHERE name = 'passwords_rebuilt';
+        UPDATE sqlite_sequence SET name = 'passwords_rebuilt' WHERE name = 'passwords';
+
+        DROP TABLE passwords;
+        ALTER TABLE passwords_rebuilt RENAME TO passwords;
+        CREATE UNIQUE INDEX idx_lookup_hash ON passwords(lookup_hash);
+        `)
+		if err != nil {
+			return err
+		}
+		return tx.trackIntegrityChanges("passwords")
+	}},
+}
+
+// SchemaVersion returns the version of the newest migration applied to the
+// vault, or 0 for vaults created before schema versions were recorded
+func (db *DB) SchemaVersion() (int, error) {
+	exists, err := db.tableExists("schema_version")
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	var version int
+	err = db.queryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// migrate applies pending migrations, backing up the vault file first. Vaults
+// written by a newer schema are refused rather than modified.
+func (db *DB) migrate() error {
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return fmt.Errorf("vault schema version %d is newer than the supported version %d; upgrade password-manager to open it", current, latest)
+	}
+	if current == latest {
+		return nil
+	}
+
+	empty, err := db.isEmpty()
+	if err != nil {
+		return err
+	}
+	if !empty {
+		if err := db.backup(current); err != nil {
+			return fmt.Errorf("backing up vault before upgrade: %w", err)
+		}
+		if err := db.captureIntegrityBaseline(); err != nil {
+			return err
+		}
+	}
+
+	_, err = db.exec(`
+    CREATE TABLE IF NOT EXISTS schema_version (
+        version INTEGER PRIMARY KEY,
+        name TEXT NOT NULL,
+        applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    )`)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		err := db.Transaction(func(tx *DB) error {
+			if err := m.apply(tx); err != nil {
+				return err
+			}
+			_, err := tx.exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)",
+				m.version, m.name, time.Now())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("schema migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+	}
+
+	db.upgraded = !empty
+	return nil
+}
+
+// SchemaUpgraded reports whether opening the vault applied migrations to an
+// existing vault
+func (db *DB) SchemaUpgraded() bool {
+	return db.upgraded
+}
+
+// backup copies the vault file as it is on disk, encrypted or not, next to it
+// before a schema upgrade
+func (db *DB) backup(version int) error {
+	data, err := os.ReadFile(db.path)
+	if err != nil {
+		return err
+	}
+
+	backupPath := fmt.Sprintf("%s.v%d-%s.bak", db.path, version, time.Now().Format("20060102-150405"))
+	f, err := os.OpenFile(backupPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// isEmpty reports whether the database has no tables yet
+func (db *DB) isEmpty() (bool, error) {
+	var count int
+	err := db.queryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'").Scan(&count)
+	return count == 0, err
+}
+
+// tableExists reports whether the database has a table with the given name
+func (db *DB) tableExists(table string) (bool, error) {
+	var count int
+	err := db.queryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count)
+	return count > 0, err
+}
+
+// addColumn adds a column to a table unless it already exists
+func (db *DB) addColumn(table, column, definition string) error {
+	columns, err := db.tableColumns(table)
+	if err != nil {
+		return err
+	}
+	for _, name := range columns {
+		if name == column {
+			return nil
+		}
+	}
+
+	_, err = db.exec("ALTER TABLE " + quoteIdentifier(table) + " ADD COLUMN " + quoteIdentifier(column) + " " + definition)
+	return err
+}
+
+// decodeChunks copies the attachment chunks of table into to, decoding their
+// data from base64 after prefix. Chunks are copied one at a time.
+func (db *DB) decodeChunks(table, to, prefix string) error {
+	rows, err := db.query("SELECT attachment_id, position, data FROM " + quoteIdentifier(table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var attachmentID, position int
+		var encoded string
+		if err := rows.Scan(&attachmentID, &position, &encoded); err != nil {
+			return err
+		}
+
+		if !strings.HasPrefix(encoded, prefix) {
+			return fmt.Errorf("chunk %d of attachment %d is not an envelope", position, attachmentID)
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(encoded, prefix))
+		if err != nil {
+			return fmt.Errorf("chunk %d of attachment %d: %w", position, attachmentID, err)
+		}
+
+		_, err = db.exec("INSERT INTO "+quoteIdentifier(to)+" (attachment_id, position, data) VALUES (?, ?, ?)",
+			attachmentID, position, data)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
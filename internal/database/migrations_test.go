@@ -0,0 +1,173 @@
+package database
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// baselineSchema is the schema of vaults created before schema versions were
+// recorded
+const baselineSchema = `
+    CREATE TABLE IF NOT EXISTS master_password (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        password_hash TEXT NOT NULL,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );
+
+    CREATE TABLE IF NOT EXISTS salts (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        salt TEXT NOT NULL,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );
+
+    CREATE TABLE IF NOT EXISTS passwords (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        service TEXT NOT NULL,
+        username TEXT NOT NULL,
+        password TEXT NOT NULL,
+        url TEXT,
+        notes TEXT,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE(service, username)
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_service ON passwords(service);
+    `
+
+// execSQL runs statements on the SQLite file at path outside of a DB
+func execSQL(t *testing.T, path string, statements ...string) {
+	t.Helper()
+	conn, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, statement := range statements {
+		if _, err := conn.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMigrateBaselineVault(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.db")
+	execSQL(t, path, baselineSchema,
+		`INSERT INTO salts (salt) VALUES ('c2FsdA==')`,
+		`INSERT INTO master_password (password_hash) VALUES ('hash')`,
+		`INSERT INTO passwords (id, service, username, password, url, notes) VALUES (1, 'example', 'alice', 'ciphertext', '', '')`,
+		// The entries with the ids up to 5 were deleted
+		`UPDATE sqlite_sequence SET seq = 5 WHERE name = 'passwords'`,
+	)
+	original, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	version, err := db.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest := migrations[len(migrations)-1].version; version != latest {
+		t.Errorf("schema version %d, want %d", version, latest)
+	}
+	if !db.SchemaUpgraded() {
+		t.Error("SchemaUpgraded is false after upgrading a vault")
+	}
+
+	backups, err := filepath.Glob(path + ".v0-*.bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("got backups %v, want one", backups)
+	}
+	backup, err := os.ReadFile(backups[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(backup, original) {
+		t.Error("backup differs from the vault before the upgrade")
+	}
+
+	passwords, err := db.ListPasswords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passwords) != 1 || passwords[0].ID != 1 || passwords[0].Service != "example" ||
+		passwords[0].Username != "alice" || string(passwords[0].Password) != "ciphertext" {
+		t.Errorf("entries after the upgrade: %+v", passwords)
+	}
+
+	// Migration 14 rebuilt the table; ids of deleted entries stay unused
+	var seq int
+	if err := db.queryRow("SELECT seq FROM sqlite_sequence WHERE name = 'passwords'").Scan(&seq); err != nil {
+		t.Fatal(err)
+	}
+	if seq != 5 {
+		t.Errorf("passwords sequence %d after the upgrade, want 5", seq)
+	}
+}
+
+func TestMigrateNewVault(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.db")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if db.SchemaUpgraded() {
+		t.Error("SchemaUpgraded is true for a new vault")
+	}
+	if backups, _ := filepath.Glob(path + ".v*.bak"); len(backups) != 0 {
+		t.Errorf("new vault was backed up: %v", backups)
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.db")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	newer := migrations[len(migrations)-1].version + 1
+	execSQL(t, path, fmt.Sprintf("INSERT INTO schema_version (version, name) VALUES (%d, 'from the future')", newer))
+	original, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDB(path)
+	if err == nil {
+		db.Close()
+		t.Fatalf("vault with schema version %d was opened", newer)
+	}
+	if !strings.Contains(err.Error(), fmt.Sprintf("version %d is newer", newer)) {
+		t.Errorf("got error %v, want a newer schema error", err)
+	}
+
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after, original) {
+		t.Error("vault with a newer schema was modified")
+	}
+	if backups, _ := filepath.Glob(path + ".v*.bak"); len(backups) != 0 {
+		t.Errorf("vault with a newer schema was backed up: %v", backups)
+	}
+}
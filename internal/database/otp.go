@@ -0,0 +1,45 @@
+package database
+
+import "database/sql"
+
+// SetOTP stores the encrypted one-time password settings of an entry,
+// replacing any earlier ones
+func (db *DB) SetOTP(passwordID int, secret string, counter uint64) error {
+	_, err := db.exec("INSERT OR REPLACE INTO otp_secrets (password_id, secret, counter) VALUES (?, ?, ?)",
+		passwordID, secret, int64(counter))
+	return err
+}
+
+// GetOTP returns the encrypted one-time password settings and HOTP counter of
+// an entry. found is false if the entry has none.
+func (db *DB) GetOTP(passwordID int) (secret string, counter uint64, found bool, err error) {
+	var stored int64
+	err = db.queryRow("SELECT secret, counter FROM otp_secrets WHERE password_id = ?", passwordID).Scan(&secret, &stored)
+	if err == sql.ErrNoRows {
+		return "", 0, false, nil
+	}
+	if err != nil {
+		return "", 0, false, err
+	}
+	return secret, uint64(stored), true, nil
+}
+
+// NextHOTPCounter advances the HOTP counter of an entry and returns the value
+// it had, in one statement so concurrent callers never get the same counter.
+// With an encrypted vault file this holds across processes because writes
+// lock the file and start from its contents on disk, on the platforms that
+// support file locks.
+func (db *DB) NextHOTPCounter(passwordID int) (uint64, error) {
+	var counter int64
+	err := db.Transaction(func(tx *DB) error {
+		return tx.queryRow("UPDATE otp_secrets SET counter = counter + 1 WHERE password_id = ? RETURNING counter - 1",
+			passwordID).Scan(&counter)
+	})
+	return uint64(counter), err
+}
+
+// DeleteOTP removes the one-time password settings of an entry
+func (db *DB) DeleteOTP(passwordID int) error {
+	_, err := db.exec("DELETE FROM otp_secrets WHERE password_id = ?", passwordID)
+	return err
+}
@@ -1,78 +1,197 @@
 package database
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/base64"
-	"math/rand"
 	"password-manager/internal/models"
 	"time"
 
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
 )
 
+func init() {
+	// Writers wait for each other instead of failing with SQLITE_BUSY, so
+	// concurrent writes such as HOTP counter updates all go through. Rows
+	// deleted by REPLACE fire delete triggers, so the integrity root learns
+	// about them.
+	sqlite.RegisterConnectionHook(func(conn sqlite.ExecQuerierContext, _ string) error {
+		_, err := conn.ExecContext(context.Background(), "PRAGMA busy_timeout = 5000; PRAGMA recursive_triggers = ON", nil)
+		return err
+	})
+}
+
 type DB struct {
 	Conn *sql.DB
+	tx   *sql.Tx
+	path string
+	file *vaultFile   // set if the whole vault file is encrypted
+	mac  IntegrityMAC // set once writes update the integrity root
+
+	// Leaf MACs of the integrity root, shared with transactions
+	cache    *integrityCache
+	recorder RevisionRecorder
+
+	// Rows covered by the integrity root before a schema upgrade, so that the
+	// root can still be checked on the unlock that upgrades the vault
+	baseline map[string][]string
+	upgraded bool
 }
 
-// NewDB creates a new database connection
-func NewDB(dataSourceName string) (*DB, error) {
-	conn, err := sql.Open("sqlite", dataSourceName)
+// NewDB opens the vault file at path. Plain SQLite files are opened directly;
+// encrypted vault files are returned sealed until Unseal decrypts them.
+func NewDB(path string) (*DB, error) {
+	encrypted, err := isVaultFile(path)
 	if err != nil {
 		return nil, err
 	}
+	if encrypted {
+		_, header, _, err := readVaultFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return &DB{path: path, file: &vaultFile{header: header}, cache: &integrityCache{}}, nil
+	}
 
-	db := &DB{Conn: conn}
-	if err := db.createTables(); err != nil {
+	conn, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DB{Conn: conn, path: path, cache: &integrityCache{}}
+	if err := db.migrate(); err != nil {
+		conn.Close()
 		return nil, err
 	}
 
 	return db, nil
 }
 
-// createTables creates the necessary tables
-func (db *DB) createTables() error {
-	query := `
-    CREATE TABLE IF NOT EXISTS master_password (
-        id INTEGER PRIMARY KEY AUTOINCREMENT,
-        password_hash TEXT NOT NULL,
-        created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-    );
-
-    CREATE TABLE IF NOT EXISTS salts (
-        id INTEGER PRIMARY KEY AUTOINCREMENT,
-        salt TEXT NOT NULL,
-        created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-    );
-
-    CREATE TABLE IF NOT EXISTS passwords (
-        id INTEGER PRIMARY KEY AUTOINCREMENT,
-        service TEXT NOT NULL,
-        username TEXT NOT NULL,
-        password TEXT NOT NULL,
-        url TEXT,
-        notes TEXT,
-        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-        updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-        UNIQUE(service, username)
-    );
-    
-    CREATE INDEX IF NOT EXISTS idx_service ON passwords(service);
-    `
+// Transaction runs fn inside a single transaction. fn receives a DB bound to
+// the transaction; the transaction is rolled back if fn returns an error.
+func (db *DB) Transaction(fn func(tx *DB) error) error {
+	if db.tx != nil {
+		// Already inside a transaction
+		return fn(db)
+	}
 
-	_, err := db.Conn.Exec(query)
-	return err
+	// Writes to an encrypted vault file replace the whole file, so they
+	// hold its lock and start from what other processes wrote
+	if db.file != nil {
+		unlock, err := db.lockVaultFile()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		if err := db.reload(); err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	txDB := &DB{Conn: db.Conn, tx: tx, path: db.path, file: db.file, mac: db.mac, cache: db.cache}
+	if err := fn(txDB); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// Cover the changes by the integrity root in the same transaction. The
+	// cached leaves then describe the changes, so they are dropped unless
+	// the changes are committed.
+	var revision int64
+	if db.mac != nil {
+		if revision, err = txDB.updateIntegrity(); err != nil {
+			tx.Rollback()
+			db.cache.leaves = nil
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		db.cache.leaves = nil
+		return err
+	}
+	if err := db.persist(); err != nil {
+		return err
+	}
+
+	if db.mac != nil && db.recorder != nil {
+		db.recorder(revision)
+	}
+	return nil
+}
+
+func (db *DB) exec(query string, args ...any) (sql.Result, error) {
+	if db.tx != nil {
+		return db.tx.Exec(query, args...)
+	}
+
+	// Single statements run in a transaction too, so the integrity root and
+	// an encrypted vault file are updated along with them
+	var result sql.Result
+	err := db.Transaction(func(tx *DB) error {
+		var err error
+		result, err = tx.exec(query, args...)
+		return err
+	})
+	return result, err
+}
+
+func (db *DB) query(query string, args ...any) (*sql.Rows, error) {
+	if db.tx != nil {
+		return db.tx.Query(query, args...)
+	}
+	return db.Conn.Query(query, args...)
+}
+
+func (db *DB) queryRow(query string, args ...any) *sql.Row {
+	if db.tx != nil {
+		return db.tx.QueryRow(query, args...)
+	}
+	return db.Conn.QueryRow(query, args...)
+}
+
+// passwordColumns lists the passwords columns read by scanPassword
+const passwordColumns = `id, COALESCE(entry_type, ''), service, username, password, url, notes,
+    COALESCE(fields, ''), COALESCE(details, ''),
+    COALESCE(lookup_hash, ''), COALESCE(folder_id, 0), created_at, updated_at, deleted_at`
+
+// scanPassword scans a row selected with passwordColumns
+func scanPassword(row interface{ Scan(...any) error }) (*models.Password, error) {
+	password := &models.Password{}
+	var deletedAt sql.NullTime
+	err := row.Scan(
+		&password.ID, &password.Type, &password.Service, &password.Username, &password.Password,
+		&password.URL, &password.Notes, &password.SealedFields, &password.SealedDetails, &password.LookupHash, &password.FolderID,
+		&password.CreatedAt, &password.UpdatedAt, &deletedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if deletedAt.Valid {
+		password.DeletedAt = &deletedAt.Time
+	}
+	return password, nil
 }
 
 // CreatePassword creates a new password entry
 func (db *DB) CreatePassword(password *models.Password) error {
 	query := `
-    INSERT INTO passwords (service, username, password, url, notes, created_at, updated_at)
-    VALUES (?, ?, ?, ?, ?, ?, ?)
+    INSERT INTO passwords (entry_type, service, username, password, url, notes, fields, details,
+        lookup_hash, created_at, updated_at)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
     `
 
 	now := time.Now()
-	result, err := db.Conn.Exec(query, password.Service, password.Username,
-		password.Password, password.URL, password.Notes, now, now)
+	result, err := db.exec(query, string(password.Type), password.Service, password.Username,
+		string(password.Password), password.URL, password.Notes, password.SealedFields,
+		password.SealedDetails, password.LookupHash, now, now)
 	if err != nil {
 		return err
 	}
@@ -88,34 +207,17 @@ func (db *DB) CreatePassword(password *models.Password) error {
 	return nil
 }
 
-// GetPassword gets a password by service and username
-func (db *DB) GetPassword(service, username string) (*models.Password, error) {
-	query := `
-    SELECT id, service, username, password, url, notes, created_at, updated_at
-    FROM passwords WHERE service = ? AND username = ?
-    `
-
-	password := &models.Password{}
-	err := db.Conn.QueryRow(query, service, username).Scan(
-		&password.ID, &password.Service, &password.Username, &password.Password,
-		&password.URL, &password.Notes, &password.CreatedAt, &password.UpdatedAt,
-	)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return password, nil
+// GetPassword gets a password by the lookup hash of its service and username
+func (db *DB) GetPassword(lookupHash string) (*models.Password, error) {
+	query := `SELECT ` + passwordColumns + ` FROM passwords WHERE lookup_hash = ?`
+	return scanPassword(db.queryRow(query, lookupHash))
 }
 
-// ListPasswords lists all passwords
+// ListPasswords lists all passwords, including those in the trash
 func (db *DB) ListPasswords() ([]*models.Password, error) {
-	query := `
-    SELECT id, service, username, password, url, notes, created_at, updated_at
-    FROM passwords ORDER BY service, username
-    `
+	query := `SELECT ` + passwordColumns + ` FROM passwords ORDER BY id`
 
-	rows, err := db.Conn.Query(query)
+	rows, err := db.query(query)
 	if err != nil {
 		return nil, err
 	}
@@ -123,11 +225,7 @@ func (db *DB) ListPasswords() ([]*models.Password, error) {
 
 	var passwords []*models.Password
 	for rows.Next() {
-		password := &models.Password{}
-		err := rows.Scan(
-			&password.ID, &password.Service, &password.Username, &password.Password,
-			&password.URL, &password.Notes, &password.CreatedAt, &password.UpdatedAt,
-		)
+		password, err := scanPassword(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -137,61 +235,120 @@ func (db *DB) ListPasswords() ([]*models.Password, error) {
 	return passwords, rows.Err()
 }
 
-// UpdatePassword updates an existing password
-func (db *DB) UpdatePassword(service, username string, updates *models.Password) error {
+// UpdatePassword updates an existing password entry
+func (db *DB) UpdatePassword(id int, updates *models.Password) error {
 	query := `
-    UPDATE passwords SET password = ?, url = ?, notes = ?, updated_at = ?
-    WHERE service = ? AND username = ?
+    UPDATE passwords SET entry_type = ?, service = ?, username = ?, password = ?, url = ?,
+        notes = ?, fields = ?, details = ?, lookup_hash = ?, updated_at = ?
+    WHERE id = ?
     `
 
 	now := time.Now()
-	_, err := db.Conn.Exec(query, updates.Password, updates.URL, updates.Notes,
-		now, service, username)
+	_, err := db.exec(query, string(updates.Type), updates.Service, updates.Username,
+		string(updates.Password), updates.URL, updates.Notes, updates.SealedFields,
+		updates.SealedDetails, updates.LookupHash, now, id)
+	return err
+}
+
+// TrashPassword moves a password entry to the trash
+func (db *DB) TrashPassword(id int) error {
+	_, err := db.exec("UPDATE passwords SET deleted_at = ? WHERE id = ?", time.Now(), id)
+	return err
+}
+
+// RestorePassword moves a password entry out of the trash
+func (db *DB) RestorePassword(id int) error {
+	_, err := db.exec("UPDATE passwords SET deleted_at = NULL WHERE id = ?", id)
 	return err
 }
 
-// DeletePassword deletes a password entry
-func (db *DB) DeletePassword(service, username string) error {
-	query := `DELETE FROM passwords WHERE service = ? AND username = ?`
-	_, err := db.Conn.Exec(query, service, username)
+// DeletePassword permanently deletes a password entry, its history, tags,
+// attachments and one-time password
+func (db *DB) DeletePassword(id int) error {
+	return db.Transaction(func(tx *DB) error {
+		_, err := tx.exec(`
+        DELETE FROM attachment_chunks
+        WHERE attachment_id IN (SELECT id FROM attachments WHERE password_id = ?)
+        `, id)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.exec("DELETE FROM attachments WHERE password_id = ?", id); err != nil {
+			return err
+		}
+		if _, err := tx.exec("DELETE FROM password_history WHERE password_id = ?", id); err != nil {
+			return err
+		}
+		if _, err := tx.exec("DELETE FROM password_tags WHERE password_id = ?", id); err != nil {
+			return err
+		}
+		if _, err := tx.exec("DELETE FROM otp_secrets WHERE password_id = ?", id); err != nil {
+			return err
+		}
+		_, err = tx.exec("DELETE FROM passwords WHERE id = ?", id)
+		return err
+	})
+}
+
+// AddPasswordVersion records an earlier encrypted password of an entry
+func (db *DB) AddPasswordVersion(passwordID int, password string) error {
+	query := `INSERT INTO password_history (password_id, password, replaced_at) VALUES (?, ?, ?)`
+	_, err := db.exec(query, passwordID, password, time.Now())
 	return err
 }
 
-// SearchPasswords searches passwords by service name
-func (db *DB) SearchPasswords(searchTerm string) ([]*models.Password, error) {
+// ListPasswordVersions lists the history of an entry, newest first
+func (db *DB) ListPasswordVersions(passwordID int) ([]*models.PasswordVersion, error) {
 	query := `
-    SELECT id, service, username, password, url, notes, created_at, updated_at
-    FROM passwords WHERE service LIKE ? OR username LIKE ? OR url LIKE ?
-    ORDER BY service, username
+    SELECT id, password_id, password, replaced_at FROM password_history
+    WHERE password_id = ? ORDER BY id DESC
     `
-
-	searchPattern := "%" + searchTerm + "%"
-	rows, err := db.Conn.Query(query, searchPattern, searchPattern, searchPattern)
+	rows, err := db.query(query, passwordID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var passwords []*models.Password
+	var versions []*models.PasswordVersion
 	for rows.Next() {
-		password := &models.Password{}
-		err := rows.Scan(
-			&password.ID, &password.Service, &password.Username, &password.Password,
-			&password.URL, &password.Notes, &password.CreatedAt, &password.UpdatedAt,
-		)
-		if err != nil {
+		version := &models.PasswordVersion{}
+		if err := rows.Scan(&version.ID, &version.PasswordID, &version.Password, &version.ReplacedAt); err != nil {
 			return nil, err
 		}
-		passwords = append(passwords, password)
+		versions = append(versions, version)
 	}
 
-	return passwords, rows.Err()
+	return versions, rows.Err()
+}
+
+// DeletePasswordVersion removes one version from the history of an entry
+func (db *DB) DeletePasswordVersion(id int) error {
+	_, err := db.exec("DELETE FROM password_history WHERE id = ?", id)
+	return err
+}
+
+// PrunePasswordHistory keeps only the newest depth versions of each entry
+func (db *DB) PrunePasswordHistory(depth int) error {
+	query := `
+    DELETE FROM password_history WHERE id IN (
+        SELECT id FROM (
+            SELECT id, ROW_NUMBER() OVER (PARTITION BY password_id ORDER BY id DESC) AS position
+            FROM password_history
+        ) WHERE position > ?
+    )
+    `
+	_, err := db.exec(query, depth)
+	return err
 }
 
 // GetSalt returns the salt for encryption
 func (db *DB) GetSalt() (string, error) {
+	if db.IsSealed() {
+		return db.file.header.Salt, nil
+	}
+
 	var salt string
-	err := db.Conn.QueryRow("SELECT salt FROM salts ORDER BY id DESC LIMIT 1").Scan(&salt)
+	err := db.queryRow("SELECT salt FROM salts ORDER BY id DESC LIMIT 1").Scan(&salt)
 	if err == sql.ErrNoRows {
 		// Generate new salt if none exists
 		newSalt := make([]byte, 32)
@@ -199,7 +356,7 @@ func (db *DB) GetSalt() (string, error) {
 			return "", err
 		}
 		salt = base64.StdEncoding.EncodeToString(newSalt)
-		_, err = db.Conn.Exec("INSERT INTO salts (salt) VALUES (?)", salt)
+		_, err = db.exec("INSERT INTO salts (salt) VALUES (?)", salt)
 		if err != nil {
 			return "", err
 		}
@@ -208,33 +365,138 @@ func (db *DB) GetSalt() (string, error) {
 	return salt, err
 }
 
-// SetMasterPassword sets the master password hash
+// SetMasterPassword sets the master password verifier
 func (db *DB) SetMasterPassword(passwordHash string) error {
-	// Delete any existing master password
-	_, err := db.Conn.Exec("DELETE FROM master_password")
-	if err != nil {
+	return db.Transaction(func(tx *DB) error {
+		// Delete any existing master password
+		if _, err := tx.exec("DELETE FROM master_password"); err != nil {
+			return err
+		}
+
+		// Insert new master password verifier
+		_, err := tx.exec("INSERT INTO master_password (password_hash) VALUES (?)", passwordHash)
 		return err
+	})
+}
+
+// GetMasterPassword returns the stored master password verifier
+func (db *DB) GetMasterPassword() (string, bool, error) {
+	var storedHash string
+	err := db.queryRow("SELECT password_hash FROM master_password ORDER BY id DESC LIMIT 1").Scan(&storedHash)
+	if err == sql.ErrNoRows {
+		return "", false, nil
 	}
+	if err != nil {
+		return "", false, err
+	}
+	return storedHash, true, nil
+}
 
-	// Insert new master password hash
-	_, err = db.Conn.Exec("INSERT INTO master_password (password_hash) VALUES (?)", passwordHash)
+// VerifyMasterPassword verifies in constant time if the given verifier
+// matches the stored one
+func (db *DB) VerifyMasterPassword(passwordHash string) (bool, error) {
+	storedHash, found, err := db.GetMasterPassword()
+	if err != nil || !found {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(storedHash), []byte(passwordHash)) == 1, nil
+}
+
+// ReencryptPasswords rewrites the encrypted password column of every entry
+// using fn, which receives the stored entry and returns the new ciphertext
+func (db *DB) ReencryptPasswords(fn func(entry *models.Password) (string, error)) error {
+	return db.Transaction(func(tx *DB) error {
+		passwords, err := tx.ListPasswords()
+		if err != nil {
+			return err
+		}
+
+		for _, password := range passwords {
+			updated, err := fn(password)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.exec("UPDATE passwords SET password = ? WHERE id = ?", updated, password.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SetSalt stores a new salt, which becomes the one returned by GetSalt
+func (db *DB) SetSalt(salt string) error {
+	_, err := db.exec("INSERT INTO salts (salt) VALUES (?)", salt)
 	return err
 }
 
-// VerifyMasterPassword verifies if the given password hash matches the stored one
-func (db *DB) VerifyMasterPassword(passwordHash string) (bool, error) {
-	var storedHash string
-	err := db.Conn.QueryRow("SELECT password_hash FROM master_password ORDER BY id DESC LIMIT 1").Scan(&storedHash)
+// GetMetadata returns the vault metadata value stored under key
+func (db *DB) GetMetadata(key string) (string, bool, error) {
+	if db.IsSealed() {
+		value, found := db.file.header.Metadata[key]
+		return value, found, nil
+	}
+
+	var value string
+	err := db.queryRow("SELECT value FROM vault_metadata WHERE key = ?", key).Scan(&value)
 	if err == sql.ErrNoRows {
-		return false, nil
+		return "", false, nil
 	}
 	if err != nil {
-		return false, err
+		return "", false, err
 	}
-	return storedHash == passwordHash, nil
+	return value, true, nil
+}
+
+// SetMetadata stores a vault metadata value, replacing any existing one
+func (db *DB) SetMetadata(key, value string) error {
+	query := `
+    INSERT INTO vault_metadata (key, value, updated_at) VALUES (?, ?, ?)
+    ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at
+    `
+	_, err := db.exec(query, key, value, time.Now())
+	return err
+}
+
+// GetKey returns the wrapped key stored in the given key slot
+func (db *DB) GetKey(slot string) (string, bool, error) {
+	if db.IsSealed() {
+		wrappedKey, found := db.file.header.Keys[slot]
+		return wrappedKey, found, nil
+	}
+
+	var wrappedKey string
+	err := db.queryRow("SELECT wrapped_key FROM keys WHERE slot = ?", slot).Scan(&wrappedKey)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return wrappedKey, true, nil
+}
+
+// SetKey stores a wrapped key in the given key slot, replacing any existing one
+func (db *DB) SetKey(slot, wrappedKey string) error {
+	query := `
+    INSERT INTO keys (slot, wrapped_key, created_at, updated_at) VALUES (?, ?, ?, ?)
+    ON CONFLICT(slot) DO UPDATE SET wrapped_key = excluded.wrapped_key, updated_at = excluded.updated_at
+    `
+	now := time.Now()
+	_, err := db.exec(query, slot, wrappedKey, now, now)
+	return err
+}
+
+// DeleteKey removes the wrapped key stored in the given key slot
+func (db *DB) DeleteKey(slot string) error {
+	_, err := db.exec("DELETE FROM keys WHERE slot = ?", slot)
+	return err
 }
 
 // Close closes the database connection
 func (db *DB) Close() error {
+	if db.Conn == nil {
+		return nil
+	}
 	return db.Conn.Close()
 }
@@ -0,0 +1,616 @@
+package database
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// vaultFileMagic starts vault files whose whole database is encrypted. Plain
+// vault files start with the SQLite header instead.
+const vaultFileMagic = "PMVAULT\x00"
+
+// vaultFileVersion is the format version of encrypted vault files. Version 1
+// files hold the SQL dump as is; version 2 files compress it, which mostly
+// undoes the hex encoding of BLOB values in the dump.
+const vaultFileVersion = 2
+
+// headerMetadataKeys are the vault metadata values copied into the header of
+// an encrypted vault file, as they are needed before it can be decrypted
+var headerMetadataKeys = []string{"kdf_params", "keyfile_required", "cipher"}
+
+// VaultHeader is the plaintext header of an encrypted vault file. It holds
+// only what is needed to unwrap the data key; everything else, including the
+// master password verifier, is inside the encrypted database.
+type VaultHeader struct {
+	Version  int               `json:"version"`
+	Salt     string            `json:"salt"`
+	Metadata map[string]string `json:"metadata"`
+	Keys     map[string]string `json:"keys"` // wrapped data keys by slot
+}
+
+// Cipher encrypts and authenticates the database of an encrypted vault file
+type Cipher interface {
+	Seal(plaintext, additionalData []byte) ([]byte, error)
+	Open(ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// vaultFile is the state of an encrypted vault file
+type vaultFile struct {
+	header *VaultHeader // read from disk, until the file is decrypted
+	cipher Cipher
+	digest [sha256.Size]byte // of the file as last read or written
+}
+
+// IsEncrypted reports whether the whole vault file is encrypted
+func (db *DB) IsEncrypted() bool {
+	return db.file != nil
+}
+
+// IsSealed reports whether the vault file is encrypted and not decrypted yet.
+// A sealed DB only serves the salt, header metadata and wrapped keys.
+func (db *DB) IsSealed() bool {
+	return db.file != nil && db.Conn == nil
+}
+
+// Unseal decrypts an encrypted vault file into an in-memory database. Changes
+// are written back to the file, encrypted with cipher.
+func (db *DB) Unseal(cipher Cipher) error {
+	if !db.IsSealed() {
+		return errors.New("vault file is not sealed")
+	}
+
+	conn, digest, err := loadVaultFile(db.path, cipher)
+	if err != nil {
+		return err
+	}
+
+	db.Conn = conn
+	db.file = &vaultFile{cipher: cipher, digest: digest}
+	return db.migrate()
+}
+
+// loadVaultFile decrypts the encrypted vault file at path into an in-memory
+// database and returns it with the digest of the file
+func loadVaultFile(path string, cipher Cipher) (*sql.DB, [sha256.Size]byte, error) {
+	var digest [sha256.Size]byte
+	prefix, header, payload, err := readVaultFile(path)
+	if err != nil {
+		return nil, digest, err
+	}
+	digest = fileDigest(prefix, payload)
+
+	contents, err := cipher.Open(payload, prefix)
+	if err != nil {
+		return nil, digest, err
+	}
+	defer clear(contents)
+
+	if header.Version >= 2 {
+		dump, err := decompressDump(contents)
+		if err != nil {
+			return nil, digest, err
+		}
+		defer clear(dump)
+		contents = dump
+	}
+
+	conn, err := openMemory(contents)
+	return conn, digest, err
+}
+
+// reload replaces the in-memory database with the encrypted vault file on
+// disk if another process wrote it since this one last read or wrote it. It
+// runs with the vault file locked, before a write, so that the write is not
+// lost to the other process's or undoes it. A file older than the database
+// in memory, or upgraded by a newer version, is refused.
+func (db *DB) reload() error {
+	prefix, _, payload, err := readVaultFile(db.path)
+	if err != nil {
+		return err
+	}
+	if fileDigest(prefix, payload) == db.file.digest {
+		return nil
+	}
+
+	conn, digest, err := loadVaultFile(db.path, db.file.cipher)
+	if err != nil {
+		return err
+	}
+	if err := db.checkReloaded(conn); err != nil {
+		conn.Close()
+		return err
+	}
+
+	db.Conn.Close()
+	db.Conn = conn
+	db.file.digest = digest
+	db.cache.leaves = nil
+	return nil
+}
+
+// checkReloaded refuses a database loaded by reload that was upgraded by a
+// newer version or is older than the one in memory
+func (db *DB) checkReloaded(conn *sql.DB) error {
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	loaded := &DB{Conn: conn}
+	version, err := loaded.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version != current {
+		return fmt.Errorf("vault file was changed to schema version %d by another process", version)
+	}
+
+	revision, err := loaded.IntegrityRevision()
+	if err != nil {
+		return err
+	}
+	if revision < db.cache.revision {
+		return fmt.Errorf("vault file on disk is older than revision %d already loaded (possible rollback)", db.cache.revision)
+	}
+	return nil
+}
+
+// fileDigest returns the digest of an encrypted vault file
+func fileDigest(prefix, payload []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(prefix)
+	h.Write(payload)
+	return [sha256.Size]byte(h.Sum(nil))
+}
+
+// EncryptFile replaces a plain vault file with an encrypted one. The database
+// is moved into memory and written back encrypted with cipher on every change.
+func (db *DB) EncryptFile(cipher Cipher) error {
+	if db.IsEncrypted() {
+		return errors.New("vault file is already encrypted")
+	}
+
+	contents, err := db.dump()
+	if err != nil {
+		return err
+	}
+	defer clear(contents)
+
+	conn, err := openMemory(contents)
+	if err != nil {
+		return err
+	}
+
+	plain := db.Conn
+	db.Conn = conn
+	db.file = &vaultFile{cipher: cipher}
+	if err := db.persist(); err != nil {
+		conn.Close()
+		db.Conn = plain
+		db.file = nil
+		return err
+	}
+
+	return plain.Close()
+}
+
+// DecryptFile replaces an encrypted vault file with a plain SQLite file
+func (db *DB) DecryptFile() error {
+	if !db.IsEncrypted() || db.IsSealed() {
+		return errors.New("vault file is not encrypted")
+	}
+
+	// Write a plain copy next to the vault file and move it into place
+	tmp := db.path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if _, err := db.Conn.Exec("VACUUM INTO ?", tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, db.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	conn, err := sql.Open("sqlite", db.path)
+	if err != nil {
+		return err
+	}
+
+	db.Conn.Close()
+	db.Conn = conn
+	db.file = nil
+	return nil
+}
+
+// persist writes an encrypted vault file back to disk after a change: the
+// header followed by an encrypted, compressed SQL dump of the database. SQLite writes
+// plain vault files itself.
+//
+// The whole database, attachment chunks included, is held in memory and
+// dumped, encrypted and written on every write, so both the memory used and
+// the cost of a write grow with the size of the vault.
+func (db *DB) persist() error {
+	if db.file == nil || db.tx != nil {
+		return nil
+	}
+
+	header, err := db.vaultHeader()
+	if err != nil {
+		return err
+	}
+	prefix, err := encodeVaultHeader(header)
+	if err != nil {
+		return err
+	}
+
+	dump, err := db.dump()
+	if err != nil {
+		return err
+	}
+	defer clear(dump)
+
+	contents, err := compressDump(dump)
+	if err != nil {
+		return err
+	}
+	defer clear(contents)
+
+	// The header is authenticated along with the database
+	payload, err := db.file.cipher.Seal(contents, prefix)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(db.path, append(prefix, payload...)); err != nil {
+		return err
+	}
+	db.file.digest = fileDigest(prefix, payload)
+	return nil
+}
+
+// vaultHeader collects the header of an encrypted vault file from the database
+func (db *DB) vaultHeader() (*VaultHeader, error) {
+	header := &VaultHeader{
+		Version:  vaultFileVersion,
+		Metadata: make(map[string]string),
+		Keys:     make(map[string]string),
+	}
+
+	err := db.queryRow("SELECT salt FROM salts ORDER BY id DESC LIMIT 1").Scan(&header.Salt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	for _, key := range headerMetadataKeys {
+		value, found, err := db.GetMetadata(key)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			header.Metadata[key] = value
+		}
+	}
+
+	rows, err := db.query("SELECT slot, wrapped_key FROM keys")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var slot, wrappedKey string
+		if err := rows.Scan(&slot, &wrappedKey); err != nil {
+			return nil, err
+		}
+		header.Keys[slot] = wrappedKey
+	}
+
+	return header, rows.Err()
+}
+
+// encodeVaultHeader encodes the start of an encrypted vault file:
+// magic || header length || header JSON
+func encodeVaultHeader(header *VaultHeader) ([]byte, error) {
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, len(vaultFileMagic)+4, len(vaultFileMagic)+4+len(encoded))
+	copy(prefix, vaultFileMagic)
+	binary.BigEndian.PutUint32(prefix[len(vaultFileMagic):], uint32(len(encoded)))
+	return append(prefix, encoded...), nil
+}
+
+// isVaultFile reports whether path is an encrypted vault file. A missing file
+// is a new plain vault.
+func isVaultFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(vaultFileMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		// Too short for either format, leave it to SQLite
+		return false, nil
+	}
+	return string(magic) == vaultFileMagic, nil
+}
+
+// readVaultFile reads an encrypted vault file, returning the encoded prefix,
+// the decoded header and the encrypted database
+func readVaultFile(path string) ([]byte, *VaultHeader, []byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	start := len(vaultFileMagic) + 4
+	if len(data) < start || !bytes.HasPrefix(data, []byte(vaultFileMagic)) {
+		return nil, nil, nil, errors.New("invalid vault file")
+	}
+	length := binary.BigEndian.Uint32(data[len(vaultFileMagic):])
+	if uint64(len(data)-start) < uint64(length) {
+		return nil, nil, nil, errors.New("invalid vault file")
+	}
+	end := start + int(length)
+
+	var header VaultHeader
+	if err := json.Unmarshal(data[start:end], &header); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid vault file header: %w", err)
+	}
+	if header.Version < 1 || header.Version > vaultFileVersion {
+		return nil, nil, nil, fmt.Errorf("unsupported vault file version %d", header.Version)
+	}
+
+	return data[:end], &header, data[end:], nil
+}
+
+// writeFileAtomic replaces the file at path with data, so that a crash leaves
+// either the old or the new contents
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// openMemory opens an in-memory database and loads a dump returned by
+// DB.dump into it
+func openMemory(dump []byte) (*sql.DB, error) {
+	conn, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+
+	// Every connection to :memory: is a separate database, so keep just one
+	conn.SetMaxOpenConns(1)
+	conn.SetMaxIdleConns(1)
+
+	tx, err := conn.Begin()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := tx.Exec(string(dump)); err != nil {
+		tx.Rollback()
+		conn.Close()
+		return nil, fmt.Errorf("invalid vault file contents: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// compressDump compresses a dump returned by DB.dump. The dump is mostly
+// ciphertext, which does not repeat, so only Huffman coding is used; it
+// brings hex-encoded BLOBs back to about their size, and quickly. Secrets in
+// the dump are encrypted field by field, so its compressed size reveals
+// nothing about them.
+func compressDump(dump []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	w, err := flate.NewWriter(&compressed, flate.HuffmanOnly)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(dump); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// decompressDump reverses compressDump
+func decompressDump(compressed []byte) ([]byte, error) {
+	var dump bytes.Buffer
+	if _, err := dump.ReadFrom(flate.NewReader(bytes.NewReader(compressed))); err != nil {
+		clear(dump.Bytes())
+		return nil, fmt.Errorf("invalid vault file contents: %w", err)
+	}
+	return dump.Bytes(), nil
+}
+
+// dump returns the schema and rows of the database as SQL statements.
+// Values are written with quote(), so they load back exactly as stored.
+// Indexes and triggers follow the rows, so that loading the rows does not
+// fire the triggers tracking changes for the integrity root.
+func (db *DB) dump() ([]byte, error) {
+	rows, err := db.query(`
+    SELECT type, name, sql FROM sqlite_master
+    WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite_autoindex_%'
+    ORDER BY type = 'table' DESC, rowid`)
+	if err != nil {
+		return nil, err
+	}
+
+	var schema, rest bytes.Buffer
+	var tables []string
+	for rows.Next() {
+		var kind, name, statement string
+		if err := rows.Scan(&kind, &name, &statement); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		switch {
+		case kind != "table":
+			rest.WriteString(statement + ";\n")
+		case name == "sqlite_sequence":
+			// SQLite creates its own sqlite_sequence table with the first
+			// AUTOINCREMENT table
+			tables = append(tables, name)
+		default:
+			tables = append(tables, name)
+			schema.WriteString(statement + ";\n")
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	dump := schema.Bytes()
+	for _, table := range tables {
+		inserts, err := db.tableRows(table)
+		if err != nil {
+			clear(dump)
+			return nil, err
+		}
+		for _, insert := range inserts {
+			dump = append(append(dump, insert...), '\n')
+		}
+	}
+	return append(dump, rest.Bytes()...), nil
+}
+
+// tableRows returns an INSERT statement for every row of a table, in rowid
+// order
+func (db *DB) tableRows(table string) ([]string, error) {
+	var inserts []string
+	err := db.eachTableRow(table, func(_ int64, statement string) error {
+		inserts = append(inserts, statement)
+		return nil
+	})
+	return inserts, err
+}
+
+// eachTableRow calls fn with the rowid and an INSERT statement of every row of
+// a table, in rowid order, reading one row at a time
+func (db *DB) eachTableRow(table string, fn func(rowid int64, statement string) error) error {
+	query, err := db.rowStatementQuery(table)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.query(query + " ORDER BY rowid")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rowid int64
+		var statement string
+		if err := rows.Scan(&rowid, &statement); err != nil {
+			return err
+		}
+		if err := fn(rowid, statement); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// tableRow returns the INSERT statement of the row of a table with the given
+// rowid. found is false if there is no such row.
+func (db *DB) tableRow(table string, rowid int64) (statement string, found bool, err error) {
+	query, err := db.rowStatementQuery(table)
+	if err != nil {
+		return "", false, err
+	}
+
+	err = db.queryRow(query+" WHERE rowid = ?", rowid).Scan(&rowid, &statement)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return statement, true, nil
+}
+
+// rowStatementQuery returns a query selecting the rowid and an INSERT
+// statement of every row of a table
+func (db *DB) rowStatementQuery(table string) (string, error) {
+	columns, err := db.tableColumns(table)
+	if err != nil {
+		return "", err
+	}
+
+	values := make([]string, len(columns))
+	for i, column := range columns {
+		values[i] = "quote(" + quoteIdentifier(column) + ")"
+	}
+	return "SELECT rowid, 'INSERT INTO " + strings.ReplaceAll(quoteIdentifier(table), "'", "''") +
+		" VALUES(' || " + strings.Join(values, " || ',' || ") + " || ');' FROM " +
+		quoteIdentifier(table), nil
+}
+
+// tableColumns returns the column names of a table
+func (db *DB) tableColumns(table string) ([]string, error) {
+	rows, err := db.query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
+
+// quoteIdentifier quotes a table or column name for use in SQL
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,32 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package database
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockVaultFile takes an exclusive lock on the lock file next to an encrypted
+// vault file, waiting for other processes to release it. The vault file
+// itself is replaced on every write, so it cannot hold the lock.
+func (db *DB) lockVaultFile() (unlock func(), err error) {
+	f, err := os.OpenFile(db.path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = unix.Flock(int(f.Fd()), unix.LOCK_EX)
+		if err != unix.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Closing the file releases the lock
+	return func() { f.Close() }, nil
+}
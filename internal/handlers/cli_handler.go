@@ -1,109 +1,336 @@
 package handlers
 
 import (
-    "bufio"
+    "bytes"
+    "errors"
     "fmt"
     "os"
+    "path/filepath"
+    "password-manager/internal/crypto"
     "password-manager/internal/models"
     "password-manager/internal/services"
+    "slices"
     "strconv"
     "strings"
-    "syscall"
-
-    "golang.org/x/term"
+    "time"
 )
 
 type CLIHandler struct {
-    passwordService   *services.PasswordService
+    passwordService   *services.PasswordService // nil while the vault is locked
     generatorService  *services.GeneratorService
-    scanner          *bufio.Scanner
+    unlock           func(masterPassword []byte) (*services.PasswordService, error)
+    terminal         *terminal
+    idleTimeout      time.Duration // zero if the vault is not locked for inactivity
+    sessionLength    time.Duration // zero if sessions are not limited
+    sessionStart     time.Time
 }
 
-// NewCLIHandler creates a new CLI handler
-func NewCLIHandler(passwordService *services.PasswordService, generatorService *services.GeneratorService) *CLIHandler {
+// errSessionLocked is returned by the input functions when the session ends
+// while waiting for input. Actions return it as is, abandoning what they were
+// doing, and the menu locks the vault.
+var errSessionLocked = errors.New("session locked")
+
+// NewCLIHandler creates a new CLI handler for an unlocked vault. The handler
+// closes the password service when it locks the vault or exits, and calls
+// unlock to open the vault again with the master password.
+func NewCLIHandler(passwordService *services.PasswordService, generatorService *services.GeneratorService, unlock func(masterPassword []byte) (*services.PasswordService, error)) *CLIHandler {
     return &CLIHandler{
         passwordService:  passwordService,
         generatorService: generatorService,
-        scanner:         bufio.NewScanner(os.Stdin),
+        unlock:          unlock,
+        terminal:        newTerminal(),
     }
 }
 
-// Start starts the CLI interface
+// Start starts the CLI interface. The vault is locked after the idle timeout,
+// at the end of the session, or from the menu, and unlocked again with the
+// master password.
 func (h *CLIHandler) Start() {
+    defer h.close()
+
     fmt.Println("🔐 Password Manager")
     fmt.Println("==================")
 
-    for {
-        fmt.Println("\nSelect an option:")
-        fmt.Println("1. Add new password")
-        fmt.Println("2. Get password")
-        fmt.Println("3. List all passwords")
-        fmt.Println("4. Search passwords")
-        fmt.Println("5. Update password")
-        fmt.Println("6. Delete password")
-        fmt.Println("7. Generate password")
-        fmt.Println("8. Exit")
-        fmt.Print("\nEnter your choice (1-8): ")
-
-        choice := h.readInput()
-        fmt.Println()
+    h.startSession()
+    if h.passwordService.IsNewVault() {
+        h.run(func() (bool, error) {
+            return false, h.createRecoveryKey()
+        })
+    }
 
-        switch choice {
-        case "1":
-            h.addPassword()
-        case "2":
-            h.getPassword()
-        case "3":
-            h.listPasswords()
-        case "4":
-            h.searchPasswords()
-        case "5":
-            h.updatePassword()
-        case "6":
-            h.deletePassword()
-        case "7":
-            h.generatePassword()
-        case "8":
+    for {
+        if h.passwordService == nil && !h.unlockVault() {
             fmt.Println("Goodbye! 👋")
             return
-        default:
-            fmt.Println("❌ Invalid choice. Please try again.")
         }
+        if h.run(h.mainMenu) {
+            return
+        }
+    }
+}
+
+// mainMenu shows the main menu and runs the chosen action. It reports
+// whether to exit.
+func (h *CLIHandler) mainMenu() (bool, error) {
+    fmt.Println("\nSelect an option:")
+    fmt.Println("1. Add new password")
+    fmt.Println("2. Get password")
+    fmt.Println("3. List all passwords")
+    fmt.Println("4. Search passwords")
+    fmt.Println("5. Update password")
+    fmt.Println("6. Delete password")
+    fmt.Println("7. Generate password")
+    fmt.Println("8. Vault security")
+    fmt.Println("9. Password history")
+    fmt.Println("10. Trash")
+    fmt.Println("11. Folders and tags")
+    fmt.Println("12. Attachments")
+    fmt.Println("13. One-time passwords")
+    fmt.Println("14. Settings")
+    fmt.Println("15. Lock vault")
+    fmt.Println("16. Exit")
+    fmt.Print("\nEnter your choice (1-16): ")
+
+    choice, err := h.readInput()
+    if err != nil {
+        return false, err
+    }
+    fmt.Println()
+
+    switch choice {
+    case "1":
+        err = h.addPassword()
+    case "2":
+        err = h.getPassword()
+    case "3":
+        err = h.listPasswords()
+    case "4":
+        err = h.searchPasswords()
+    case "5":
+        err = h.updatePassword()
+    case "6":
+        err = h.deletePassword()
+    case "7":
+        err = h.generatePassword()
+    case "8":
+        err = h.vaultSecurity()
+    case "9":
+        err = h.passwordHistory()
+    case "10":
+        err = h.trash()
+    case "11":
+        err = h.foldersAndTags()
+    case "12":
+        err = h.attachments()
+    case "13":
+        err = h.oneTimePasswords()
+    case "14":
+        err = h.settings()
+    case "15":
+        h.lock("Vault locked")
+    case "16":
+        fmt.Println("Goodbye! 👋")
+        return true, nil
+    default:
+        fmt.Println("❌ Invalid choice. Please try again.")
+    }
+    return false, err
+}
+
+// run runs a menu action and reports whether to exit. If the session ends
+// while the action waits for input, the action is abandoned and the vault
+// locked.
+func (h *CLIHandler) run(action func() (bool, error)) bool {
+    exit, err := action()
+    if errors.Is(err, errSessionLocked) {
+        fmt.Println()
+        h.lock(h.lockReason())
+        return false
+    }
+    if err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    }
+    return exit
+}
+
+// startSession reads the session limits of the vault, purges expired entries
+// from the trash and starts the session clock
+func (h *CLIHandler) startSession() {
+    var err error
+    h.sessionStart = time.Now()
+    if h.idleTimeout, err = h.passwordService.IdleTimeout(); err != nil {
+        fmt.Printf("⚠️  %v\n", err)
+    }
+    if h.sessionLength, err = h.passwordService.SessionLength(); err != nil {
+        fmt.Printf("⚠️  %v\n", err)
+    }
+    if _, err = h.passwordService.PurgeTrash(); err != nil {
+        fmt.Printf("⚠️  Error purging the trash: %v\n", err)
+    }
+}
+
+// lock closes the vault, wiping its keys from memory
+func (h *CLIHandler) lock(reason string) {
+    h.terminal.flush()
+    if err := h.passwordService.Close(); err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    }
+    h.passwordService = nil
+    fmt.Printf("🔒 %s\n", reason)
+}
+
+// unlockVault asks for the master password until the vault unlocks. It
+// reports false if the password is left empty to exit.
+func (h *CLIHandler) unlockVault() bool {
+    for {
+        fmt.Print("\nEnter master password to unlock (leave empty to exit): ")
+        masterPassword, err := h.terminal.readSecret(time.Time{})
+        fmt.Println()
+        if err != nil {
+            fmt.Printf("❌ Error reading password: %v\n", err)
+            return false
+        }
+        if len(masterPassword) == 0 {
+            return false
+        }
+
+        passwordService, err := h.unlock(masterPassword)
+        crypto.Wipe(masterPassword)
+        if err != nil {
+            fmt.Printf("❌ Error: %v\n", err)
+            continue
+        }
+
+        h.passwordService = passwordService
+        h.startSession()
+        fmt.Println("🔓 Vault unlocked")
+        return true
+    }
+}
+
+// close closes the vault, if unlocked
+func (h *CLIHandler) close() {
+    if h.passwordService != nil {
+        h.passwordService.Close()
+        h.passwordService = nil
+    }
+}
+
+// deadline returns when the session locks unless input arrives, or the zero
+// time if it never does
+func (h *CLIHandler) deadline() time.Time {
+    var deadline time.Time
+    if h.idleTimeout > 0 {
+        deadline = time.Now().Add(h.idleTimeout)
+    }
+    if h.sessionLength > 0 {
+        end := h.sessionStart.Add(h.sessionLength)
+        if deadline.IsZero() || end.Before(deadline) {
+            deadline = end
+        }
+    }
+    return deadline
+}
+
+// lockReason explains why the session ended after a read passed its deadline
+func (h *CLIHandler) lockReason() string {
+    if h.sessionLength > 0 && !time.Now().Before(h.sessionStart.Add(h.sessionLength)) {
+        return fmt.Sprintf("Session ended after %s; vault locked", formatMinutes(h.sessionLength))
+    }
+    return fmt.Sprintf("Vault locked after %s without input", formatMinutes(h.idleTimeout))
+}
+
+// formatMinutes formats a session limit, or "off" for none
+func formatMinutes(limit time.Duration) string {
+    minutes := int(limit.Minutes())
+    switch minutes {
+    case 0:
+        return "off"
+    case 1:
+        return "1 minute"
     }
+    return fmt.Sprintf("%d minutes", minutes)
 }
 
-func (h *CLIHandler) addPassword() {
+func (h *CLIHandler) addPassword() error {
     fmt.Println("➕ Add New Password")
     fmt.Println("-------------------")
 
+    entryType, ok, err := h.readEntryType()
+    if err != nil || !ok {
+        return err
+    }
+    if entryType != models.EntryLogin {
+        return h.addEntry(entryType)
+    }
+
     fmt.Print("Service name: ")
-    service := h.readInput()
+    service, err := h.readInput()
+    if err != nil {
+        return err
+    }
 
     fmt.Print("Username: ")
-    username := h.readInput()
+    username, err := h.readInput()
+    if err != nil {
+        return err
+    }
 
     fmt.Print("Generate password? (y/n): ")
-    generateChoice := strings.ToLower(h.readInput())
+    generateChoice, err := h.readChoice()
+    if err != nil {
+        return err
+    }
 
-    var password string
+    var password []byte
     if generateChoice == "y" || generateChoice == "yes" {
         generated, err := h.generatePasswordHelper()
+        if errors.Is(err, errSessionLocked) {
+            return err
+        }
         if err != nil {
             fmt.Printf("❌ Error generating password: %v\n", err)
-            return
+            return nil
         }
         password = generated
         fmt.Printf("Generated password: %s\n", password)
-    } else {
-        fmt.Print("Password: ")
-        password = h.readPassword()
+    } else if password, err = h.readPassword("Password: "); err != nil {
+        return err
+    }
+    defer crypto.Wipe(password)
+
+    reuse, err := h.confirmReuse(password, service, username)
+    if err != nil {
+        return err
+    }
+    if !reuse {
+        fmt.Println("❌ Password not saved.")
+        return nil
     }
 
     fmt.Print("URL (optional): ")
-    url := h.readInput()
+    url, err := h.readInput()
+    if err != nil {
+        return err
+    }
 
     fmt.Print("Notes (optional): ")
-    notes := h.readInput()
+    notes, err := h.readInput()
+    if err != nil {
+        return err
+    }
+
+    var fields []models.CustomField
+    fmt.Print("Add custom fields? (y/n): ")
+    fieldsChoice, err := h.readChoice()
+    if err != nil {
+        return err
+    }
+    if fieldsChoice == "y" || fieldsChoice == "yes" {
+        if fields, err = h.readCustomFields(); err != nil {
+            return err
+        }
+    }
 
     req := &models.PasswordRequest{
         Service:  service,
@@ -111,248 +338,1894 @@ func (h *CLIHandler) addPassword() {
         Password: password,
         URL:      url,
         Notes:    notes,
+        Fields:   fields,
     }
+    defer req.Wipe()
 
     if err := h.passwordService.CreatePassword(req); err != nil {
         fmt.Printf("❌ Error: %v\n", err)
     } else {
         fmt.Println("✅ Password saved successfully!")
     }
+    return nil
 }
 
-func (h *CLIHandler) getPassword() {
+func (h *CLIHandler) getPassword() error {
     fmt.Println("🔍 Get Password")
     fmt.Println("---------------")
 
     fmt.Print("Service name: ")
-    service := h.readInput()
+    service, err := h.readInput()
+    if err != nil {
+        return err
+    }
 
     fmt.Print("Username: ")
-    username := h.readInput()
+    username, err := h.readInput()
+    if err != nil {
+        return err
+    }
 
     password, err := h.passwordService.GetPassword(service, username)
     if err != nil {
         fmt.Printf("❌ Error: %v\n", err)
-        return
+        return nil
     }
+    defer password.Wipe()
 
     fmt.Printf("\n📋 Password Details:\n")
-    fmt.Printf("Service: %s\n", password.Service)
-    fmt.Printf("Username: %s\n", password.Username)
-    fmt.Printf("Password: %s\n", password.Password)
+    if password.Type == models.EntryLogin {
+        fmt.Printf("Service: %s\n", password.Service)
+        fmt.Printf("Username: %s\n", password.Username)
+        fmt.Printf("Password: %s\n", password.Password)
+    } else {
+        fmt.Printf("Title: %s\n", password.Service)
+        fmt.Printf("Type: %s\n", password.Type)
+        h.printDetails(password)
+    }
     if password.URL != "" {
         fmt.Printf("URL: %s\n", password.URL)
     }
-    if password.Notes != "" {
+    if password.Notes != "" && password.Type != models.EntryNote {
         fmt.Printf("Notes: %s\n", password.Notes)
     }
+    if len(password.Fields) > 0 {
+        fmt.Println("Custom fields:")
+        for _, field := range password.Fields {
+            fmt.Printf("  %s (%s): %s\n", field.Name, field.Type, field.Value)
+        }
+    }
+    if password.Folder != "" {
+        fmt.Printf("Folder: %s\n", password.Folder)
+    }
+    if attachments, err := h.passwordService.ListAttachments(service, username); err == nil && len(attachments) > 0 {
+        fmt.Println("Attachments:")
+        for _, attachment := range attachments {
+            fmt.Printf("  📎 %s (%s)\n", attachment.Name, formatSize(attachment.Size))
+        }
+    }
+    if len(password.Tags) > 0 {
+        fmt.Printf("Tags: %s\n", strings.Join(password.Tags, ", "))
+    }
+    if otp, err := h.passwordService.GetOTP(service, username); err == nil {
+        fmt.Printf("One-time password: %s\n", formatOTP(otp))
+    }
     fmt.Printf("Created: %s\n", password.CreatedAt.Format("2006-01-02 15:04:05"))
     fmt.Printf("Updated: %s\n", password.UpdatedAt.Format("2006-01-02 15:04:05"))
+    return nil
 }
 
-func (h *CLIHandler) listPasswords() {
+func (h *CLIHandler) listPasswords() error {
     fmt.Println("📋 All Passwords")
     fmt.Println("----------------")
 
-    passwords, err := h.passwordService.ListPasswords()
+    filter, err := h.readFilter(false)
+    if err != nil {
+        return err
+    }
+    passwords, err := h.passwordService.ListPasswords(filter)
     if err != nil {
         fmt.Printf("❌ Error: %v\n", err)
-        return
+        return nil
     }
 
+    if len(passwords) == 0 && (filter.Folder != "" || filter.Tag != "") {
+        fmt.Println("No passwords found.")
+        return nil
+    }
     if len(passwords) == 0 {
         fmt.Println("No passwords stored.")
-        return
+        return nil
     }
 
     for _, password := range passwords {
-        fmt.Printf("🔐 %s (%s) - %s\n", password.Service, password.Username, password.Password)
+        h.printEntry(password)
     }
+    return nil
 }
 
-func (h *CLIHandler) searchPasswords() {
+func (h *CLIHandler) searchPasswords() error {
     fmt.Println("🔍 Search Passwords")
     fmt.Println("-------------------")
 
     fmt.Print("Search term: ")
-    searchTerm := h.readInput()
+    searchTerm, err := h.readInput()
+    if err != nil {
+        return err
+    }
 
-    passwords, err := h.passwordService.SearchPasswords(searchTerm)
+    filter, err := h.readFilter(true)
+    if err != nil {
+        return err
+    }
+    passwords, err := h.passwordService.SearchPasswords(searchTerm, filter)
     if err != nil {
         fmt.Printf("❌ Error: %v\n", err)
-        return
+        return nil
     }
 
     if len(passwords) == 0 {
         fmt.Println("No passwords found.")
-        return
+        return nil
     }
 
     fmt.Printf("\nFound %d password(s):\n", len(passwords))
     for _, password := range passwords {
-        fmt.Printf("🔐 %s (%s) - %s\n", password.Service, password.Username, password.Password)
+        h.printEntry(password)
     }
+    return nil
 }
 
-func (h *CLIHandler) updatePassword() {
-    fmt.Println("✏️ Update Password")
-    fmt.Println("------------------")
-
-    fmt.Print("Service name: ")
-    service := h.readInput()
+// readCustomFields asks for custom fields until an empty name is entered
+func (h *CLIHandler) readCustomFields() ([]models.CustomField, error) {
+    types := make([]string, len(models.FieldTypes))
+    for i, fieldType := range models.FieldTypes {
+        types[i] = string(fieldType)
+    }
 
-    fmt.Print("Username: ")
-    username := h.readInput()
+    var fields []models.CustomField
+    for {
+        fmt.Print("Field name (leave empty to finish): ")
+        name, err := h.readInput()
+        if err != nil {
+            models.WipeFields(fields)
+            return nil, err
+        }
+        if name == "" {
+            return fields, nil
+        }
 
-    fmt.Print("Generate new password? (y/n): ")
-    generateChoice := strings.ToLower(h.readInput())
+        fmt.Printf("Type (%s) [text]: ", strings.Join(types, ", "))
+        fieldType, err := h.readChoice()
+        if err != nil {
+            models.WipeFields(fields)
+            return nil, err
+        }
+        if fieldType == "" {
+            fieldType = string(models.FieldText)
+        }
 
-    var password string
-    if generateChoice == "y" || generateChoice == "yes" {
-        generated, err := h.generatePasswordHelper()
+        field := models.CustomField{Name: name, Type: models.FieldType(fieldType)}
+        if field.Concealed() {
+            field.Value, err = h.readPassword("Value: ")
+        } else {
+            fmt.Print("Value: ")
+            var value string
+            value, err = h.readInput()
+            field.Value = models.Secret(value)
+        }
         if err != nil {
-            fmt.Printf("❌ Error generating password: %v\n", err)
-            return
+            models.WipeFields(fields)
+            return nil, err
         }
-        password = generated
-        fmt.Printf("Generated password: %s\n", password)
-    } else {
-        fmt.Print("New password: ")
-        password = h.readPassword()
-    }
 
-    fmt.Print("URL (optional): ")
-    url := h.readInput()
+        if err := services.ValidateCustomField(field); err != nil {
+            field.Value.Wipe()
+            fmt.Printf("❌ Error: %v\n", err)
+            continue
+        }
+        fields = append(fields, field)
+    }
+}
 
-    fmt.Print("Notes (optional): ")
-    notes := h.readInput()
 
-    req := &models.PasswordRequest{
-        Service:  service,
-        Username: username,
-        Password: password,
-        URL:      url,
-        Notes:    notes,
+// editCustomFields asks whether to keep the custom fields of an entry or
+// enter new ones. It returns false if the entry cannot be read.
+func (h *CLIHandler) editCustomFields(service, username string) ([]models.CustomField, bool, error) {
+    current, err := h.passwordService.GetPassword(service, username)
+    if err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+        return nil, false, nil
     }
+    // The fields are returned as they are if kept, so only the rest is wiped
+    fields := current.Fields
+    current.Fields = nil
+    current.Wipe()
 
-    if err := h.passwordService.UpdatePassword(service, username, req); err != nil {
-        fmt.Printf("❌ Error: %v\n", err)
-    } else {
-        fmt.Println("✅ Password updated successfully!")
+    if len(fields) == 0 {
+        fmt.Print("Add custom fields? (y/n): ")
+        choice, err := h.readChoice()
+        if err != nil {
+            return nil, false, err
+        }
+        if choice == "y" || choice == "yes" {
+            fields, err := h.readCustomFields()
+            return fields, err == nil, err
+        }
+        return nil, true, nil
     }
-}
 
-func (h *CLIHandler) deletePassword() {
-    fmt.Println("🗑️ Delete Password")
-    fmt.Println("------------------")
+    fmt.Println("Current custom fields:")
+    for _, field := range fields {
+        fmt.Printf("  %s (%s)\n", field.Name, field.Type)
+    }
+    fmt.Print("Keep them? (y/n): ")
+    choice, err := h.readChoice()
+    if err == nil && (choice == "y" || choice == "yes") {
+        return fields, true, nil
+    }
+    models.WipeFields(fields)
+    if err != nil {
+        return nil, false, err
+    }
 
-    fmt.Print("Service name: ")
-    service := h.readInput()
+    fmt.Println("Enter the new custom fields:")
+    fields, err = h.readCustomFields()
+    return fields, err == nil, err
+}
 
-    fmt.Print("Username: ")
-    username := h.readInput()
 
-    fmt.Printf("Are you sure you want to delete the password for %s (%s)? (y/n): ", service, username)
-    confirm := strings.ToLower(h.readInput())
+// readEntryType asks for the type of a new entry. It returns false if the
+// type is unknown.
+func (h *CLIHandler) readEntryType() (models.EntryType, bool, error) {
+    types := make([]string, len(models.EntryTypes))
+    for i, entryType := range models.EntryTypes {
+        types[i] = string(entryType)
+    }
 
-    if confirm == "y" || confirm == "yes" {
-        if err := h.passwordService.DeletePassword(service, username); err != nil {
-            fmt.Printf("❌ Error: %v\n", err)
-        } else {
-            fmt.Println("✅ Password deleted successfully!")
-        }
-    } else {
-        fmt.Println("❌ Deletion cancelled.")
+    fmt.Printf("Entry type (%s) [login]: ", strings.Join(types, ", "))
+    choice, err := h.readChoice()
+    if err != nil {
+        return "", false, err
+    }
+    entryType := models.EntryType(choice)
+    if entryType == "" {
+        return models.EntryLogin, true, nil
     }
+    if !slices.Contains(models.EntryTypes, entryType) {
+        fmt.Printf("❌ Unknown entry type: %s\n", entryType)
+        return "", false, nil
+    }
+    return entryType, true, nil
 }
 
-func (h *CLIHandler) generatePassword() {
-    fmt.Println("🎲 Generate Password")
-    fmt.Println("--------------------")
 
-    options := h.getGeneratorOptions()
-    password, err := h.generatorService.GeneratePassword(options)
+// addEntry adds an entry other than a login. Such entries are found by their
+// title with an empty username.
+func (h *CLIHandler) addEntry(entryType models.EntryType) error {
+    fmt.Print("Title: ")
+    title, err := h.readInput()
     if err != nil {
-        fmt.Printf("❌ Error generating password: %v\n", err)
-        return
+        return err
     }
+    req := &models.PasswordRequest{Type: entryType, Service: title}
+    defer req.Wipe()
 
-    fmt.Printf("\n🔐 Generated Password: %s\n", password)
+    if ok, err := h.readDetails(req); err != nil || !ok {
+        return err
+    }
 
-    // Show password strength
-    strength := h.generatorService.ValidatePasswordStrength(password)
-    fmt.Println("\n📊 Password Strength:")
-    fmt.Printf("Has lowercase: %v\n", strength["has_lower"])
-    fmt.Printf("Has uppercase: %v\n", strength["has_upper"])
-    fmt.Printf("Has numbers: %v\n", strength["has_number"])
-    fmt.Printf("Has symbols: %v\n", strength["has_symbol"])
-    fmt.Printf("Minimum length (8+): %v\n", strength["min_length"])
-    fmt.Printf("Good length (12+): %v\n", strength["good_length"])
-}
+    fmt.Print("Add custom fields? (y/n): ")
+    fieldsChoice, err := h.readChoice()
+    if err != nil {
+        return err
+    }
+    if fieldsChoice == "y" || fieldsChoice == "yes" {
+        if req.Fields, err = h.readCustomFields(); err != nil {
+            return err
+        }
+    }
 
-func (h *CLIHandler) generatePasswordHelper() (string, error) {
-    options := h.getGeneratorOptions()
-    return h.generatorService.GeneratePassword(options)
+    if err := h.passwordService.CreatePassword(req); err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    } else {
+        fmt.Println("✅ Entry saved successfully! Find it by its title with an empty username.")
+    }
+    return nil
 }
 
-func (h *CLIHandler) getGeneratorOptions() *models.GeneratorOptions {
-    options := &models.GeneratorOptions{
-        Length:         12,
-        IncludeUpper:   true,
-        IncludeLower:   true,
-        IncludeNumbers: true,
-        IncludeSymbols: true,
-        ExcludeSimilar: false,
+// updateEntry asks for new details of an entry other than a login
+func (h *CLIHandler) updateEntry(current *models.Password) error {
+    fmt.Printf("Enter the new details of this %s:\n", current.Type)
+    req := &models.PasswordRequest{Type: current.Type}
+    defer req.Wipe()
+    if ok, err := h.readDetails(req); err != nil || !ok {
+        return err
     }
 
-    fmt.Print("Password length (default 12): ")
-    lengthStr := h.readInput()
-    if lengthStr != "" {
-        if length, err := strconv.Atoi(lengthStr); err == nil && length > 0 {
-            options.Length = length
+    fields, ok, err := h.editCustomFields(current.Service, current.Username)
+    if err != nil || !ok {
+        return err
+    }
+    req.Fields = fields
+
+    if err := h.passwordService.UpdatePassword(current.Service, current.Username, req); err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    } else {
+        fmt.Println("✅ Entry updated successfully!")
+    }
+    return nil
+}
+
+// readDetails asks for the details of an entry of the request type. It
+// returns false if they cannot be read.
+func (h *CLIHandler) readDetails(req *models.PasswordRequest) (bool, error) {
+    var err error
+    switch req.Type {
+    case models.EntryNote:
+        fmt.Println("Note (end with a line containing only \".\"):")
+        req.Notes, err = h.readLines()
+        return err == nil, err
+    case models.EntryCard:
+        card := &models.Card{}
+        req.Card = card
+        fmt.Print("Cardholder name: ")
+        if card.Holder, err = h.readInput(); err != nil {
+            return false, err
+        }
+        if card.Number, err = h.readPassword("Card number: "); err != nil {
+            return false, err
+        }
+        fmt.Print("Expiry (MM/YY): ")
+        if card.Expiry, err = h.readInput(); err != nil {
+            return false, err
+        }
+        if card.CVV, err = h.readPassword("CVV: "); err != nil {
+            return false, err
+        }
+    case models.EntryIdentity:
+        identity := &models.Identity{}
+        fmt.Print("Full name: ")
+        if identity.FullName, err = h.readInput(); err != nil {
+            return false, err
+        }
+        fmt.Print("Address: ")
+        if identity.Address, err = h.readInput(); err != nil {
+            return false, err
+        }
+        fmt.Print("Email: ")
+        if identity.Email, err = h.readInput(); err != nil {
+            return false, err
+        }
+        fmt.Print("Phone (optional): ")
+        if identity.Phone, err = h.readInput(); err != nil {
+            return false, err
+        }
+        req.Identity = identity
+    case models.EntrySSHKey:
+        fmt.Print("Private key file: ")
+        path, err := h.readInput()
+        if err != nil {
+            return false, err
+        }
+        privateKey, err := os.ReadFile(path)
+        if err != nil {
+            fmt.Printf("❌ Error reading private key: %v\n", err)
+            return false, nil
+        }
+        sshKey := &models.SSHKey{PrivateKey: privateKey}
+        req.SSHKey = sshKey
+        if sshKey.Passphrase, err = h.readPassword("Passphrase (leave empty if none): "); err != nil {
+            return false, err
+        }
+        fmt.Print("Public key (leave empty to derive it): ")
+        if sshKey.PublicKey, err = h.readInput(); err != nil {
+            return false, err
         }
     }
 
-    fmt.Print("Include uppercase letters? (Y/n): ")
-    if strings.ToLower(h.readInput()) == "n" {
-        options.IncludeUpper = false
+    fmt.Print("Notes (optional): ")
+    if req.Notes, err = h.readInput(); err != nil {
+        return false, err
     }
+    return true, nil
+}
 
-    fmt.Print("Include lowercase letters? (Y/n): ")
-    if strings.ToLower(h.readInput()) == "n" {
-        options.IncludeLower = false
+
+// printDetails prints the details of an entry other than a login
+func (h *CLIHandler) printDetails(password *models.Password) {
+    switch {
+    case password.Type == models.EntryNote:
+        fmt.Printf("Note:\n%s\n", password.Notes)
+    case password.Card != nil:
+        if password.Card.Holder != "" {
+            fmt.Printf("Cardholder: %s\n", password.Card.Holder)
+        }
+        fmt.Printf("Card number: %s\n", password.Card.Number)
+        fmt.Printf("Expiry: %s\n", password.Card.Expiry)
+        fmt.Printf("CVV: %s\n", password.Card.CVV)
+    case password.Identity != nil:
+        fmt.Printf("Full name: %s\n", password.Identity.FullName)
+        fmt.Printf("Address: %s\n", password.Identity.Address)
+        fmt.Printf("Email: %s\n", password.Identity.Email)
+        if password.Identity.Phone != "" {
+            fmt.Printf("Phone: %s\n", password.Identity.Phone)
+        }
+    case password.SSHKey != nil:
+        fmt.Printf("Public key: %s\n", password.SSHKey.PublicKey)
+        fmt.Printf("Private key:\n%s\n", bytes.TrimRight(password.SSHKey.PrivateKey, "\n"))
+        if len(password.SSHKey.Passphrase) > 0 {
+            fmt.Printf("Passphrase: %s\n", password.SSHKey.Passphrase)
+        }
     }
+}
 
-    fmt.Print("Include numbers? (Y/n): ")
-    if strings.ToLower(h.readInput()) == "n" {
-        options.IncludeNumbers = false
+// readFilter asks for the optional folder and tag to list, and whether to
+// include the trash
+func (h *CLIHandler) readFilter(askTrash bool) (models.PasswordFilter, error) {
+    var filter models.PasswordFilter
+    var err error
+
+    fmt.Print("Folder (optional): ")
+    if filter.Folder, err = h.readInput(); err != nil {
+        return filter, err
     }
 
-    fmt.Print("Include symbols? (Y/n): ")
-    if strings.ToLower(h.readInput()) == "n" {
-        options.IncludeSymbols = false
+    fmt.Print("Tag (optional): ")
+    if filter.Tag, err = h.readInput(); err != nil {
+        return filter, err
     }
 
-    fmt.Print("Exclude similar characters (0,O,l,1,I)? (y/N): ")
-    if strings.ToLower(h.readInput()) == "y" {
-        options.ExcludeSimilar = true
+    if askTrash {
+        fmt.Print("Include trash? (y/n): ")
+        includeChoice, err := h.readChoice()
+        if err != nil {
+            return filter, err
+        }
+        filter.IncludeTrashed = includeChoice == "y" || includeChoice == "yes"
     }
+    fmt.Println()
 
-    return options
+    return filter, nil
 }
 
-func (h *CLIHandler) readInput() string {
-    h.scanner.Scan()
-    return strings.TrimSpace(h.scanner.Text())
-}
+// printEntry prints one line of a list or search result
+func (h *CLIHandler) printEntry(password *models.Password) {
+    name := fmt.Sprintf("%s (%s)", password.Service, password.Username)
+    line := fmt.Sprintf("%s - %s", name, password.Password)
+    if password.Type != models.EntryLogin {
+        name = fmt.Sprintf("%s (%s)", password.Service, password.Type)
+        line = name
+        if password.Card != nil {
+            line += " - " + string(password.Card.Number)
+        }
+    }
+    if password.DeletedAt != nil {
+        line = name + " - in trash"
+    }
+    if password.Folder != "" {
+        line += fmt.Sprintf(" [%s]", password.Folder)
+    }
+    for _, tag := range password.Tags {
+        line += " #" + tag
+    }
 
-func (h *CLIHandler) readPassword() string {
-    fmt.Print("Password: ")
-    password, err := term.ReadPassword(int(syscall.Stdin))
+    if password.DeletedAt != nil {
+        fmt.Println("🗑️ " + line)
+    } else {
+        fmt.Println("🔐 " + line)
+    }
+}
+
+func (h *CLIHandler) updatePassword() error {
+    fmt.Println("✏️ Update Password")
+    fmt.Println("------------------")
+
+    fmt.Print("Service name: ")
+    service, err := h.readInput()
+    if err != nil {
+        return err
+    }
+
+    fmt.Print("Username: ")
+    username, err := h.readInput()
+    if err != nil {
+        return err
+    }
+
+    current, err := h.passwordService.GetPassword(service, username)
+    if err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+        return nil
+    }
+    current.Wipe()
+    if current.Type != models.EntryLogin {
+        return h.updateEntry(current)
+    }
+
+    fmt.Print("Generate new password? (y/n): ")
+    generateChoice, err := h.readChoice()
+    if err != nil {
+        return err
+    }
+
+    var password []byte
+    if generateChoice == "y" || generateChoice == "yes" {
+        generated, err := h.generatePasswordHelper()
+        if errors.Is(err, errSessionLocked) {
+            return err
+        }
+        if err != nil {
+            fmt.Printf("❌ Error generating password: %v\n", err)
+            return nil
+        }
+        password = generated
+        fmt.Printf("Generated password: %s\n", password)
+    } else if password, err = h.readPassword("New password: "); err != nil {
+        return err
+    }
+    defer crypto.Wipe(password)
+
+    reuse, err := h.confirmReuse(password, service, username)
+    if err != nil {
+        return err
+    }
+    if !reuse {
+        fmt.Println("❌ Update cancelled.")
+        return nil
+    }
+
+    fmt.Print("URL (optional): ")
+    url, err := h.readInput()
+    if err != nil {
+        return err
+    }
+
+    fmt.Print("Notes (optional): ")
+    notes, err := h.readInput()
+    if err != nil {
+        return err
+    }
+
+    fields, ok, err := h.editCustomFields(service, username)
+    if err != nil || !ok {
+        return err
+    }
+
+    req := &models.PasswordRequest{
+        Service:  service,
+        Username: username,
+        Password: password,
+        URL:      url,
+        Notes:    notes,
+        Fields:   fields,
+    }
+    defer req.Wipe()
+
+    if err := h.passwordService.UpdatePassword(service, username, req); err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    } else {
+        fmt.Println("✅ Password updated successfully!")
+    }
+    return nil
+}
+
+func (h *CLIHandler) deletePassword() error {
+    fmt.Println("🗑️ Delete Password")
+    fmt.Println("------------------")
+
+    fmt.Print("Service name: ")
+    service, err := h.readInput()
+    if err != nil {
+        return err
+    }
+
+    fmt.Print("Username: ")
+    username, err := h.readInput()
+    if err != nil {
+        return err
+    }
+
+    fmt.Printf("Are you sure you want to delete the password for %s (%s)? (y/n): ", service, username)
+    confirm, err := h.readChoice()
+    if err != nil {
+        return err
+    }
+
+    if confirm == "y" || confirm == "yes" {
+        if err := h.passwordService.DeletePassword(service, username); err != nil {
+            fmt.Printf("❌ Error: %v\n", err)
+        } else {
+            fmt.Println("✅ Password moved to the trash. It can be restored from the Trash menu.")
+        }
+    } else {
+        fmt.Println("❌ Deletion cancelled.")
+    }
+    return nil
+}
+
+func (h *CLIHandler) passwordHistory() error {
+    fmt.Println("🕘 Password History")
+    fmt.Println("-------------------")
+
+    fmt.Print("Service name: ")
+    service, err := h.readInput()
+    if err != nil {
+        return err
+    }
+
+    fmt.Print("Username: ")
+    username, err := h.readInput()
+    if err != nil {
+        return err
+    }
+
+    versions, err := h.passwordService.PasswordHistory(service, username)
+    if err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+        return nil
+    }
+    defer func() {
+        for _, version := range versions {
+            version.Wipe()
+        }
+    }()
+
+    if len(versions) == 0 {
+        fmt.Println("No earlier passwords stored.")
+        return nil
+    }
+
+    for i, version := range versions {
+        fmt.Printf("%d. %s - replaced %s\n", i+1, version.Password, version.ReplacedAt.Format("2006-01-02 15:04:05"))
+    }
+
+    fmt.Print("\nRestore a version? Enter its number (or press Enter to skip): ")
+    choice, err := h.readInput()
+    if err != nil {
+        return err
+    }
+    if choice == "" {
+        return nil
+    }
+    n, err := strconv.Atoi(choice)
+    if err != nil || n < 1 || n > len(versions) {
+        fmt.Println("❌ Invalid choice.")
+        return nil
+    }
+
+    if err := h.passwordService.RestorePasswordVersion(service, username, versions[n-1].ID); err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    } else {
+        fmt.Println("✅ Password restored successfully!")
+    }
+    return nil
+}
+
+func (h *CLIHandler) trash() error {
+    fmt.Println("🗑️ Trash")
+    fmt.Println("--------")
+
+    passwords, err := h.passwordService.ListTrash()
+    if err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+        return nil
+    }
+    if retention, err := h.passwordService.TrashRetention(); err == nil && retention > 0 {
+        fmt.Printf("Entries are purged %d days after deletion.\n", retention)
+    }
+
+    if len(passwords) == 0 {
+        fmt.Println("The trash is empty.")
+        return nil
+    }
+
+    for _, password := range passwords {
+        fmt.Printf("🗑️ %s (%s) - deleted %s\n", password.Service, password.Username, password.DeletedAt.Format("2006-01-02 15:04:05"))
+    }
+
+    fmt.Println("\n1. Restore password")
+    fmt.Println("2. Empty trash")
+    fmt.Println("3. Back")
+    fmt.Print("\nEnter your choice (1-3): ")
+
+    choice, err := h.readInput()
+    if err != nil {
+        return err
+    }
+    fmt.Println()
+
+    switch choice {
+    case "1":
+        return h.restorePassword()
+    case "2":
+        return h.emptyTrash()
+    case "3":
+        return nil
+    default:
+        fmt.Println("❌ Invalid choice.")
+    }
+    return nil
+}
+
+func (h *CLIHandler) restorePassword() error {
+    fmt.Print("Service name: ")
+    service, err := h.readInput()
+    if err != nil {
+        return err
+    }
+
+    fmt.Print("Username: ")
+    username, err := h.readInput()
+    if err != nil {
+        return err
+    }
+
+    if err := h.passwordService.RestorePassword(service, username); err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    } else {
+        fmt.Println("✅ Password restored successfully!")
+    }
+    return nil
+}
+
+func (h *CLIHandler) emptyTrash() error {
+    fmt.Print("Permanently delete every password in the trash? (y/n): ")
+    confirm, err := h.readChoice()
+    if err != nil {
+        return err
+    }
+    if confirm != "y" && confirm != "yes" {
+        fmt.Println("❌ Cancelled.")
+        return nil
+    }
+
+    deleted, err := h.passwordService.EmptyTrash()
+    if err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    } else {
+        fmt.Printf("✅ %d password(s) permanently deleted.\n", deleted)
+    }
+    return nil
+}
+
+func (h *CLIHandler) foldersAndTags() error {
+    fmt.Println("🗂️ Folders and Tags")
+    fmt.Println("------------------")
+
+    folders, err := h.passwordService.ListFolders()
+    if err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+        return nil
+    }
+    tags, err := h.passwordService.ListTags()
+    if err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+        return nil
+    }
+
+    if len(folders) == 0 {
+        fmt.Println("Folders: none")
+    } else {
+        fmt.Println("Folders:")
+        for _, folder := range folders {
+            fmt.Printf("  📁 %s\n", folder.Path)
+        }
+    }
+    if len(tags) == 0 {
+        fmt.Println("Tags: none")
+    } else {
+        names := make([]string, len(tags))
+        for i, tag := range tags {
+            names[i] = tag.Name
+        }
+        fmt.Printf("Tags: %s\n", strings.Join(names, ", "))
+    }
+
+    fmt.Println("\n1. Create folder")
+    fmt.Println("2. Rename folder")
+    fmt.Println("3. Delete folder")
+    fmt.Println("4. Move password to folder")
+    fmt.Println("5. Create tag")
+    fmt.Println("6. Rename tag")
+    fmt.Println("7. Delete tag")
+    fmt.Println("8. Tag password")
+    fmt.Println("9. Untag password")
+    fmt.Println("10. Back")
+    fmt.Print("\nEnter your choice (1-10): ")
+
+    choice, err := h.readInput()
+    if err != nil {
+        return err
+    }
+    fmt.Println()
+
+    var action func() error
+    switch choice {
+    case "1":
+        fmt.Print("Folder path (e.g. Work/Email): ")
+        path, err := h.readInput()
+        if err != nil {
+            return err
+        }
+        action = func() error { return h.passwordService.CreateFolder(path) }
+    case "2":
+        fmt.Print("Folder path: ")
+        path, err := h.readInput()
+        if err != nil {
+            return err
+        }
+        fmt.Print("New name: ")
+        name, err := h.readInput()
+        if err != nil {
+            return err
+        }
+        action = func() error { return h.passwordService.RenameFolder(path, name) }
+    case "3":
+        fmt.Print("Folder path: ")
+        path, err := h.readInput()
+        if err != nil {
+            return err
+        }
+        fmt.Println("Passwords in the folder will move to its parent folder.")
+        action = func() error { return h.passwordService.DeleteFolder(path) }
+    case "4":
+        service, username, err := h.readEntryName()
+        if err != nil {
+            return err
+        }
+        fmt.Print("Folder path (leave empty to remove from folders): ")
+        path, err := h.readInput()
+        if err != nil {
+            return err
+        }
+        action = func() error { return h.passwordService.MovePassword(service, username, path) }
+    case "5":
+        fmt.Print("Tag name: ")
+        name, err := h.readInput()
+        if err != nil {
+            return err
+        }
+        action = func() error { return h.passwordService.CreateTag(name) }
+    case "6":
+        fmt.Print("Tag name: ")
+        name, err := h.readInput()
+        if err != nil {
+            return err
+        }
+        fmt.Print("New name: ")
+        newName, err := h.readInput()
+        if err != nil {
+            return err
+        }
+        action = func() error { return h.passwordService.RenameTag(name, newName) }
+    case "7":
+        fmt.Print("Tag name: ")
+        name, err := h.readInput()
+        if err != nil {
+            return err
+        }
+        action = func() error { return h.passwordService.DeleteTag(name) }
+    case "8":
+        service, username, err := h.readEntryName()
+        if err != nil {
+            return err
+        }
+        fmt.Print("Tag name: ")
+        name, err := h.readInput()
+        if err != nil {
+            return err
+        }
+        action = func() error { return h.passwordService.TagPassword(service, username, name) }
+    case "9":
+        service, username, err := h.readEntryName()
+        if err != nil {
+            return err
+        }
+        fmt.Print("Tag name: ")
+        name, err := h.readInput()
+        if err != nil {
+            return err
+        }
+        action = func() error { return h.passwordService.UntagPassword(service, username, name) }
+    case "10":
+        return nil
+    default:
+        fmt.Println("❌ Invalid choice.")
+        return nil
+    }
+
+    if err := action(); err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    } else {
+        fmt.Println("✅ Done!")
+    }
+    return nil
+}
+
+func (h *CLIHandler) attachments() error {
+    fmt.Println("📎 Attachments")
+    fmt.Println("--------------")
+
+    fmt.Println("1. Attach file")
+    fmt.Println("2. List attachments")
+    fmt.Println("3. Extract attachment")
+    fmt.Println("4. Remove attachment")
+    fmt.Println("5. Back")
+    fmt.Print("\nEnter your choice (1-5): ")
+
+    choice, err := h.readInput()
+    if err != nil {
+        return err
+    }
+    fmt.Println()
+
+    switch choice {
+    case "1":
+        return h.attachFile()
+    case "2":
+        return h.listAttachments()
+    case "3":
+        return h.extractAttachment()
+    case "4":
+        return h.removeAttachment()
+    case "5":
+        return nil
+    default:
+        fmt.Println("❌ Invalid choice.")
+    }
+    return nil
+}
+
+func (h *CLIHandler) attachFile() error {
+    service, username, err := h.readEntryName()
+    if err != nil {
+        return err
+    }
+
+    if h.passwordService.AttachmentsInMemory() {
+        fmt.Println("⚠️ The whole vault file is encrypted: attachments are held in memory while the vault is unlocked and rewritten with every change.")
+    }
+
+    fmt.Print("File path: ")
+    path, err := h.readInput()
+    if err != nil {
+        return err
+    }
+
+    f, err := os.Open(path)
+    if err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+        return nil
+    }
+    defer f.Close()
+
+    attachment, err := h.passwordService.AddAttachment(service, username, filepath.Base(path), f)
+    if err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    } else {
+        fmt.Printf("✅ Attached %s (%s)\n", attachment.Name, formatSize(attachment.Size))
+    }
+    return nil
+}
+
+func (h *CLIHandler) listAttachments() error {
+    service, username, err := h.readEntryName()
+    if err != nil {
+        return err
+    }
+
+    attachments, err := h.passwordService.ListAttachments(service, username)
+    if err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+        return nil
+    }
+
+    if len(attachments) == 0 {
+        fmt.Println("No attachments.")
+        return nil
+    }
+    for _, attachment := range attachments {
+        fmt.Printf("📎 %s (%s) - added %s\n", attachment.Name, formatSize(attachment.Size), attachment.CreatedAt.Format("2006-01-02 15:04:05"))
+    }
+    return nil
+}
+
+func (h *CLIHandler) extractAttachment() error {
+    service, username, err := h.readEntryName()
+    if err != nil {
+        return err
+    }
+
+    fmt.Print("Attachment name: ")
+    name, err := h.readInput()
+    if err != nil {
+        return err
+    }
+
+    fmt.Print("Save to path: ")
+    path, err := h.readInput()
+    if err != nil {
+        return err
+    }
+
+    // Never overwrite an existing file, and keep the contents private
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+    if err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+        return nil
+    }
+
+    err = h.passwordService.ExtractAttachment(service, username, name, f)
+    if closeErr := f.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        os.Remove(path)
+        fmt.Printf("❌ Error: %v\n", err)
+        return nil
+    }
+    fmt.Printf("✅ Saved to %s\n", path)
+    return nil
+}
+
+func (h *CLIHandler) removeAttachment() error {
+    service, username, err := h.readEntryName()
+    if err != nil {
+        return err
+    }
+
+    fmt.Print("Attachment name: ")
+    name, err := h.readInput()
+    if err != nil {
+        return err
+    }
+
+    fmt.Printf("Permanently remove %s? (y/n): ", name)
+    confirm, err := h.readChoice()
+    if err != nil {
+        return err
+    }
+    if confirm != "y" && confirm != "yes" {
+        fmt.Println("❌ Cancelled.")
+        return nil
+    }
+
+    if err := h.passwordService.RemoveAttachment(service, username, name); err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    } else {
+        fmt.Println("✅ Attachment removed!")
+    }
+    return nil
+}
+
+func (h *CLIHandler) oneTimePasswords() error {
+    fmt.Println("🔢 One-time Passwords")
+    fmt.Println("---------------------")
+
+    fmt.Println("1. Show current code")
+    fmt.Println("2. Set secret")
+    fmt.Println("3. Remove secret")
+    fmt.Println("4. Back")
+    fmt.Print("\nEnter your choice (1-4): ")
+
+    choice, err := h.readInput()
+    if err != nil {
+        return err
+    }
+    fmt.Println()
+
+    switch choice {
+    case "1":
+        return h.showOTPCode()
+    case "2":
+        return h.setOTP()
+    case "3":
+        return h.removeOTP()
+    case "4":
+        return nil
+    default:
+        fmt.Println("❌ Invalid choice.")
+    }
+    return nil
+}
+
+func (h *CLIHandler) showOTPCode() error {
+    service, username, err := h.readEntryName()
+    if err != nil {
+        return err
+    }
+
+    code, err := h.passwordService.OTPCode(service, username)
+    if err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+        return nil
+    }
+
+    if code.Remaining > 0 {
+        fmt.Printf("🔢 %s (valid for %d more seconds)\n", code.Code, code.Remaining)
+    } else {
+        fmt.Printf("🔢 %s (counter %d)\n", code.Code, code.Counter)
+    }
+    return nil
+}
+
+func (h *CLIHandler) setOTP() error {
+    service, username, err := h.readEntryName()
+    if err != nil {
+        return err
+    }
+
+    value, err := h.readPassword("otpauth:// URI or base32 secret: ")
+    if err != nil {
+        return err
+    }
+    defer crypto.Wipe(value)
+
+    if err := h.passwordService.SetOTP(service, username, string(value)); err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    } else {
+        fmt.Println("✅ One-time password set!")
+    }
+    return nil
+}
+
+func (h *CLIHandler) removeOTP() error {
+    service, username, err := h.readEntryName()
+    if err != nil {
+        return err
+    }
+
+    fmt.Print("Remove the one-time password secret? It cannot be recovered. (y/n): ")
+    confirm, err := h.readChoice()
+    if err != nil {
+        return err
+    }
+    if confirm != "y" && confirm != "yes" {
+        fmt.Println("❌ Cancelled.")
+        return nil
+    }
+
+    if err := h.passwordService.RemoveOTP(service, username); err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    } else {
+        fmt.Println("✅ One-time password removed!")
+    }
+    return nil
+}
+
+// formatOTP describes one-time password settings for display
+func formatOTP(otp *models.OTP) string {
+    description := fmt.Sprintf("%s, %s, %d digits", strings.ToUpper(string(otp.Type)), otp.Algorithm, otp.Digits)
+    if otp.Type == models.OTPTOTP {
+        description += fmt.Sprintf(", every %ds", otp.Period)
+    }
+    if otp.Issuer != "" {
+        description += " from " + otp.Issuer
+    }
+    return description
+}
+
+// formatSize formats a size in bytes for display
+func formatSize(size int64) string {
+    switch {
+    case size >= 1<<20:
+        return fmt.Sprintf("%.1f MiB", float64(size)/(1<<20))
+    case size >= 1<<10:
+        return fmt.Sprintf("%.1f KiB", float64(size)/(1<<10))
+    default:
+        return fmt.Sprintf("%d bytes", size)
+    }
+}
+
+// readEntryName asks for the service and username of an entry
+func (h *CLIHandler) readEntryName() (string, string, error) {
+    fmt.Print("Service name: ")
+    service, err := h.readInput()
+    if err != nil {
+        return "", "", err
+    }
+
+    fmt.Print("Username: ")
+    username, err := h.readInput()
+    if err != nil {
+        return "", "", err
+    }
+
+    return service, username, nil
+}
+
+// confirmReuse warns if password is already used by another entry, now or
+// before, and asks whether to use it anyway
+func (h *CLIHandler) confirmReuse(password []byte, service, username string) (bool, error) {
+    reuses, err := h.passwordService.FindPasswordReuse(password)
+    if err != nil {
+        fmt.Printf("❌ Error checking for reuse: %v\n", err)
+        return false, nil
+    }
+
+    warned := false
+    for _, reuse := range reuses {
+        if reuse.Service == service && reuse.Username == username {
+            continue
+        }
+        if reuse.Current {
+            fmt.Printf("⚠️  This password is used by %s (%s)\n", reuse.Service, reuse.Username)
+        } else {
+            fmt.Printf("⚠️  This password was used before by %s (%s)\n", reuse.Service, reuse.Username)
+        }
+        warned = true
+    }
+    if !warned {
+        return true, nil
+    }
+
+    fmt.Print("Use it anyway? (y/n): ")
+    confirm, err := h.readChoice()
+    if err != nil {
+        return false, err
+    }
+    return confirm == "y" || confirm == "yes", nil
+}
+
+func (h *CLIHandler) settings() error {
+    fmt.Println("⚙️ Settings")
+    fmt.Println("-----------")
+
+    depth, err := h.passwordService.HistoryDepth()
+    if err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+        return nil
+    }
+    fmt.Printf("Password history depth: %d\n", depth)
+
+    retention, err := h.passwordService.TrashRetention()
+    if err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+        return nil
+    }
+    fmt.Printf("Trash retention: %d days\n", retention)
+
+    maxSize, err := h.passwordService.AttachmentMaxSize()
+    if err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+        return nil
+    }
+    fmt.Printf("Attachment size limit: %s\n", formatSize(maxSize))
+    fmt.Printf("Idle lock: %s\n", formatMinutes(h.idleTimeout))
+    fmt.Printf("Maximum session length: %s\n", formatMinutes(h.sessionLength))
+
+    fmt.Println("\n1. Change password history depth")
+    fmt.Println("2. Change trash retention")
+    fmt.Println("3. Change attachment size limit")
+    fmt.Println("4. Change idle lock")
+    fmt.Println("5. Change maximum session length")
+    fmt.Println("6. Back")
+    fmt.Print("\nEnter your choice (1-6): ")
+
+    choice, err := h.readInput()
+    if err != nil {
+        return err
+    }
+    fmt.Println()
+
+    switch choice {
+    case "1":
+        return h.setHistoryDepth()
+    case "2":
+        return h.setTrashRetention()
+    case "3":
+        return h.setAttachmentMaxSize()
+    case "4":
+        return h.setIdleTimeout()
+    case "5":
+        return h.setSessionLength()
+    case "6":
+        return nil
+    default:
+        fmt.Println("❌ Invalid choice.")
+    }
+    return nil
+}
+
+func (h *CLIHandler) setIdleTimeout() error {
+    fmt.Print("Minutes without input before the vault locks (0 turns the idle lock off): ")
+    input, err := h.readInput()
+    if err != nil {
+        return err
+    }
+    minutes, err := strconv.Atoi(input)
+    if err != nil {
+        fmt.Println("❌ Invalid number.")
+        return nil
+    }
+
+    timeout := time.Duration(minutes) * time.Minute
+    if err := h.passwordService.SetIdleTimeout(timeout); err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    } else {
+        h.idleTimeout = timeout
+        fmt.Println("✅ Idle lock updated!")
+    }
+    return nil
+}
+
+func (h *CLIHandler) setSessionLength() error {
+    fmt.Print("Minutes after unlocking before the vault locks (0 removes the limit): ")
+    input, err := h.readInput()
+    if err != nil {
+        return err
+    }
+    minutes, err := strconv.Atoi(input)
+    if err != nil {
+        fmt.Println("❌ Invalid number.")
+        return nil
+    }
+
+    length := time.Duration(minutes) * time.Minute
+    if err := h.passwordService.SetSessionLength(length); err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    } else {
+        h.sessionLength = length
+        fmt.Println("✅ Maximum session length updated!")
+    }
+    return nil
+}
+
+func (h *CLIHandler) setAttachmentMaxSize() error {
+    fmt.Print("Largest attachment size in MiB: ")
+    input, err := h.readInput()
+    if err != nil {
+        return err
+    }
+    mib, err := strconv.ParseInt(input, 10, 64)
+    if err != nil || mib <= 0 || mib > 1<<20 {
+        fmt.Println("❌ Invalid number.")
+        return nil
+    }
+
+    if err := h.passwordService.SetAttachmentMaxSize(mib << 20); err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    } else {
+        fmt.Println("✅ Attachment size limit updated!")
+    }
+    return nil
+}
+
+func (h *CLIHandler) setHistoryDepth() error {
+    fmt.Print("Earlier passwords to keep per entry (0 turns history off): ")
+    input, err := h.readInput()
+    if err != nil {
+        return err
+    }
+    depth, err := strconv.Atoi(input)
+    if err != nil {
+        fmt.Println("❌ Invalid number.")
+        return nil
+    }
+
+    if err := h.passwordService.SetHistoryDepth(depth); err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    } else {
+        fmt.Println("✅ History depth updated!")
+    }
+    return nil
+}
+
+func (h *CLIHandler) setTrashRetention() error {
+    fmt.Print("Days to keep deleted passwords (0 keeps them until the trash is emptied): ")
+    input, err := h.readInput()
+    if err != nil {
+        return err
+    }
+    days, err := strconv.Atoi(input)
+    if err != nil {
+        fmt.Println("❌ Invalid number.")
+        return nil
+    }
+
+    if err := h.passwordService.SetTrashRetention(days); err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    } else {
+        fmt.Println("✅ Trash retention updated!")
+    }
+    return nil
+}
+
+func (h *CLIHandler) vaultSecurity() error {
+    fmt.Println("🛡️ Vault Security")
+    fmt.Println("-----------------")
+
+    if h.passwordService.KeyFileRequired() {
+        fmt.Println("Unlock requires: master password + key file")
+    } else {
+        fmt.Println("Unlock requires: master password")
+    }
+    if hasRecoveryKey, err := h.passwordService.HasRecoveryKey(); err == nil {
+        fmt.Printf("Recovery key: %v\n", hasRecoveryKey)
+    }
+    if revision, err := h.passwordService.VaultRevision(); err == nil {
+        fmt.Printf("Vault revision: %d\n", revision)
+    }
+    fileEncrypted := h.passwordService.VaultFileEncrypted()
+    fmt.Printf("Whole-file encryption: %v\n", fileEncrypted)
+
+    fmt.Println("\n1. Change master password")
+    fmt.Println("2. Require key file")
+    fmt.Println("3. Remove key file requirement")
+    fmt.Println("4. Rotate recovery key")
+    fmt.Println("5. Revoke recovery key")
+    fmt.Println("6. Split recovery key into shares")
+    if fileEncrypted {
+        fmt.Println("7. Decrypt vault file")
+    } else {
+        fmt.Println("7. Encrypt vault file")
+    }
+    fmt.Println("8. Back")
+    fmt.Print("\nEnter your choice (1-8): ")
+
+    choice, err := h.readInput()
+    if err != nil {
+        return err
+    }
+    fmt.Println()
+
+    switch choice {
+    case "1":
+        return h.changeMasterPassword()
+    case "2":
+        return h.requireKeyFile()
+    case "3":
+        return h.removeKeyFile()
+    case "4":
+        return h.rotateRecoveryKey()
+    case "5":
+        return h.revokeRecoveryKey()
+    case "6":
+        return h.splitRecoveryKey()
+    case "7":
+        if fileEncrypted {
+            return h.decryptVaultFile()
+        } else {
+            return h.encryptVaultFile()
+        }
+    case "8":
+        return nil
+    default:
+        fmt.Println("❌ Invalid choice.")
+    }
+    return nil
+}
+
+func (h *CLIHandler) requireKeyFile() error {
+    fmt.Println("🔑 Require Key File")
+    fmt.Println("-------------------")
+
+    fmt.Print("Key file path: ")
+    path, err := h.readInput()
+    if err != nil {
+        return err
+    }
+    if path == "" {
+        fmt.Println("❌ Key file path is required.")
+        return nil
+    }
+
+    if _, err := os.Stat(path); os.IsNotExist(err) {
+        fmt.Print("Key file does not exist. Create a new random key file? (y/n): ")
+        create, err := h.readChoice()
+        if err != nil {
+            return err
+        }
+        if create != "y" && create != "yes" {
+            fmt.Println("❌ Cancelled.")
+            return nil
+        }
+        if err := crypto.CreateKeyFile(path); err != nil {
+            fmt.Printf("❌ Error creating key file: %v\n", err)
+            return nil
+        }
+        fmt.Printf("✅ Key file created at %s\n", path)
+    }
+
+    keyFile, err := crypto.ReadKeyFile(path)
+    if err != nil {
+        fmt.Printf("❌ Error reading key file: %v\n", err)
+        return nil
+    }
+
+    currentPassword, err := h.readPassword("Current master password: ")
+    if err != nil {
+        return err
+    }
+    defer crypto.Wipe(currentPassword)
+    if err := h.passwordService.RequireKeyFile(currentPassword, keyFile); err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+        return nil
+    }
+
+    fmt.Println("✅ The vault now requires this key file to unlock (use --keyfile).")
+    fmt.Println("⚠️ Keep a backup of the key file: without it the vault cannot be opened.")
+    return nil
+}
+
+func (h *CLIHandler) removeKeyFile() error {
+    fmt.Println("🔓 Remove Key File Requirement")
+    fmt.Println("------------------------------")
+
+    currentPassword, err := h.readPassword("Current master password: ")
+    if err != nil {
+        return err
+    }
+    defer crypto.Wipe(currentPassword)
+    if err := h.passwordService.RemoveKeyFile(currentPassword); err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    } else {
+        fmt.Println("✅ The vault no longer requires a key file.")
+    }
+    return nil
+}
+
+func (h *CLIHandler) encryptVaultFile() error {
+    fmt.Println("🔒 Encrypt Vault File")
+    fmt.Println("--------------------")
+    fmt.Println("The whole database will be encrypted, hiding its structure, entry count and timestamps.")
+    fmt.Println("It is then held in memory while unlocked, attachments included, and every change rewrites the whole file.")
+
+    currentPassword, err := h.readPassword("Current master password: ")
+    if err != nil {
+        return err
+    }
+    defer crypto.Wipe(currentPassword)
+    if err := h.passwordService.EncryptVaultFile(currentPassword); err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    } else {
+        fmt.Println("✅ Vault file encrypted.")
+    }
+    return nil
+}
+
+func (h *CLIHandler) decryptVaultFile() error {
+    fmt.Println("🔓 Decrypt Vault File")
+    fmt.Println("--------------------")
+    fmt.Println("The database will be stored as a plain SQLite file again. Entries stay encrypted.")
+
+    currentPassword, err := h.readPassword("Current master password: ")
+    if err != nil {
+        return err
+    }
+    defer crypto.Wipe(currentPassword)
+    if err := h.passwordService.DecryptVaultFile(currentPassword); err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    } else {
+        fmt.Println("✅ Vault file decrypted.")
+    }
+    return nil
+}
+
+func (h *CLIHandler) createRecoveryKey() error {
+    fmt.Println("\n🆕 New vault created. Generating your recovery key...")
+
+    recoveryKey, err := h.passwordService.CreateRecoveryKey()
+    if err != nil {
+        fmt.Printf("❌ Error creating recovery key: %v\n", err)
+        return nil
+    }
+
+    return h.showEmergencyKit(recoveryKey)
+}
+
+func (h *CLIHandler) rotateRecoveryKey() error {
+    fmt.Println("🔁 Rotate Recovery Key")
+    fmt.Println("----------------------")
+
+    currentPassword, err := h.readPassword("Current master password: ")
+    if err != nil {
+        return err
+    }
+    defer crypto.Wipe(currentPassword)
+    recoveryKey, err := h.passwordService.RotateRecoveryKey(currentPassword)
+    if err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+        return nil
+    }
+
+    fmt.Println("✅ New recovery key created. The previous recovery key no longer works.")
+    return h.showEmergencyKit(recoveryKey)
+}
+
+func (h *CLIHandler) revokeRecoveryKey() error {
+    fmt.Println("🚫 Revoke Recovery Key")
+    fmt.Println("----------------------")
+
+    fmt.Print("Without a recovery key a forgotten master password cannot be recovered. Continue? (y/n): ")
+    confirm, err := h.readChoice()
+    if err != nil {
+        return err
+    }
+    if confirm != "y" && confirm != "yes" {
+        fmt.Println("❌ Cancelled.")
+        return nil
+    }
+
+    currentPassword, err := h.readPassword("Current master password: ")
+    if err != nil {
+        return err
+    }
+    defer crypto.Wipe(currentPassword)
+    if err := h.passwordService.RevokeRecoveryKey(currentPassword); err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    } else {
+        fmt.Println("✅ Recovery key revoked.")
+    }
+    return nil
+}
+
+func (h *CLIHandler) splitRecoveryKey() error {
+    fmt.Println("🧩 Split Recovery Key")
+    fmt.Println("---------------------")
+    fmt.Println("A new recovery key is created and split into shares. The current recovery key stops working.")
+
+    fmt.Print("Number of shares: ")
+    input, err := h.readInput()
+    if err != nil {
+        return err
+    }
+    shares, err := strconv.Atoi(input)
+    if err != nil {
+        fmt.Println("❌ Invalid number of shares.")
+        return nil
+    }
+
+    fmt.Print("Shares required to recover: ")
+    if input, err = h.readInput(); err != nil {
+        return err
+    }
+    threshold, err := strconv.Atoi(input)
+    if err != nil {
+        fmt.Println("❌ Invalid number of shares.")
+        return nil
+    }
+
+    currentPassword, err := h.readPassword("Current master password: ")
+    if err != nil {
+        return err
+    }
+    defer crypto.Wipe(currentPassword)
+    formatted, err := h.passwordService.SplitRecoveryKey(currentPassword, shares, threshold)
+    if err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+        return nil
+    }
+
+    fmt.Printf("✅ Recovery key split into %d shares, any %d of which recover the vault.\n", shares, threshold)
+    fmt.Println("Hand each share to a different person.")
+    for i, share := range formatted {
+        fmt.Print("\nPress Enter to show the next share...")
+        if _, err := h.readInput(); err != nil {
+            return err
+        }
+        fmt.Println()
+        fmt.Println(h.passwordService.ShareKit(share, i+1, shares, threshold))
+    }
+    return nil
+}
+
+func (h *CLIHandler) showEmergencyKit(recoveryKey string) error {
+    kit := h.passwordService.EmergencyKit(recoveryKey)
+    fmt.Println()
+    fmt.Println(kit)
+
+    fmt.Print("Save the emergency kit to a file? Enter a path, or leave empty to skip: ")
+    path, err := h.readInput()
+    if err != nil {
+        return err
+    }
+    if path == "" {
+        return nil
+    }
+
+    file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+    if err != nil {
+        fmt.Printf("❌ Error saving emergency kit: %v\n", err)
+        return nil
+    }
+    defer file.Close()
+
+    if _, err := file.WriteString(kit); err != nil {
+        fmt.Printf("❌ Error saving emergency kit: %v\n", err)
+        return nil
+    }
+    fmt.Printf("✅ Emergency kit saved to %s. Print it and delete the file.\n", path)
+    return nil
+}
+
+func (h *CLIHandler) changeMasterPassword() error {
+    fmt.Println("🔑 Change Master Password")
+    fmt.Println("-------------------------")
+
+    currentPassword, err := h.readPassword("Current master password: ")
+    if err != nil {
+        return err
+    }
+    defer crypto.Wipe(currentPassword)
+    newPassword, err := h.readPassword("New master password: ")
+    if err != nil {
+        return err
+    }
+    defer crypto.Wipe(newPassword)
+    confirmPassword, err := h.readPassword("Confirm new master password: ")
+    if err != nil {
+        return err
+    }
+    defer crypto.Wipe(confirmPassword)
+
+    if !bytes.Equal(newPassword, confirmPassword) {
+        fmt.Println("❌ Passwords do not match.")
+        return nil
+    }
+
+    fmt.Println("Re-encrypting vault...")
+    if err := h.passwordService.ChangeMasterPassword(currentPassword, newPassword); err != nil {
+        fmt.Printf("❌ Error: %v\n", err)
+    } else {
+        fmt.Println("✅ Master password changed successfully!")
+    }
+    return nil
+}
+
+func (h *CLIHandler) generatePassword() error {
+    fmt.Println("🎲 Generate Password")
+    fmt.Println("--------------------")
+
+    options, err := h.getGeneratorOptions()
+    if err != nil {
+        return err
+    }
+    password, err := h.generatorService.GeneratePassword(options)
+    if err != nil {
+        fmt.Printf("❌ Error generating password: %v\n", err)
+        return nil
+    }
+
+    defer crypto.Wipe(password)
+
+    fmt.Printf("\n🔐 Generated Password: %s\n", password)
+
+    // Show password strength
+    strength := h.generatorService.ValidatePasswordStrength(password)
+    fmt.Println("\n📊 Password Strength:")
+    fmt.Printf("Has lowercase: %v\n", strength["has_lower"])
+    fmt.Printf("Has uppercase: %v\n", strength["has_upper"])
+    fmt.Printf("Has numbers: %v\n", strength["has_number"])
+    fmt.Printf("Has symbols: %v\n", strength["has_symbol"])
+    fmt.Printf("Minimum length (8+): %v\n", strength["min_length"])
+    fmt.Printf("Good length (12+): %v\n", strength["good_length"])
+    return nil
+}
+
+func (h *CLIHandler) generatePasswordHelper() ([]byte, error) {
+    options, err := h.getGeneratorOptions()
+    if err != nil {
+        return nil, err
+    }
+    return h.generatorService.GeneratePassword(options)
+}
+
+func (h *CLIHandler) getGeneratorOptions() (*models.GeneratorOptions, error) {
+    options := &models.GeneratorOptions{
+        Length:         12,
+        IncludeUpper:   true,
+        IncludeLower:   true,
+        IncludeNumbers: true,
+        IncludeSymbols: true,
+        ExcludeSimilar: false,
+    }
+
+    fmt.Print("Password length (default 12): ")
+    lengthStr, err := h.readInput()
+    if err != nil {
+        return nil, err
+    }
+    if lengthStr != "" {
+        if length, err := strconv.Atoi(lengthStr); err == nil && length > 0 {
+            options.Length = length
+        }
+    }
+
+    fmt.Print("Include uppercase letters? (Y/n): ")
+    choice, err := h.readChoice()
+    if err != nil {
+        return nil, err
+    }
+    if choice == "n" {
+        options.IncludeUpper = false
+    }
+
+    fmt.Print("Include lowercase letters? (Y/n): ")
+    if choice, err = h.readChoice(); err != nil {
+        return nil, err
+    }
+    if choice == "n" {
+        options.IncludeLower = false
+    }
+
+    fmt.Print("Include numbers? (Y/n): ")
+    if choice, err = h.readChoice(); err != nil {
+        return nil, err
+    }
+    if choice == "n" {
+        options.IncludeNumbers = false
+    }
+
+    fmt.Print("Include symbols? (Y/n): ")
+    if choice, err = h.readChoice(); err != nil {
+        return nil, err
+    }
+    if choice == "n" {
+        options.IncludeSymbols = false
+    }
+
+    fmt.Print("Exclude similar characters (0,O,l,1,I)? (y/N): ")
+    if choice, err = h.readChoice(); err != nil {
+        return nil, err
+    }
+    if choice == "y" {
+        options.ExcludeSimilar = true
+    }
+
+    return options, nil
+}
+
+// readInput reads a line of input. If the session ends first, it returns
+// errSessionLocked.
+func (h *CLIHandler) readInput() (string, error) {
+    line, err := h.terminal.readLine(h.deadline())
+    if err == errInputTimeout {
+        return "", errSessionLocked
+    }
+    return strings.TrimSpace(line), nil
+}
+
+// readChoice reads a line of input in lower case, as the answer to a yes or
+// no question
+func (h *CLIHandler) readChoice() (string, error) {
+    input, err := h.readInput()
+    return strings.ToLower(input), err
+}
+
+// readLines reads lines until one containing only "." and joins them
+func (h *CLIHandler) readLines() (string, error) {
+    var lines []string
+    for {
+        line, err := h.terminal.readLine(h.deadline())
+        if err == errInputTimeout {
+            return "", errSessionLocked
+        }
+        if err != nil {
+            break
+        }
+        line = strings.TrimRight(line, "\r")
+        if line == "." {
+            break
+        }
+        lines = append(lines, line)
+    }
+    return strings.Join(lines, "\n"), nil
+}
+
+// readPassword reads a password without echo. If the session ends first, it
+// returns errSessionLocked; other errors are reported and nothing is read.
+func (h *CLIHandler) readPassword(prompt string) ([]byte, error) {
+    fmt.Print(prompt)
+    password, err := h.terminal.readSecret(h.deadline())
     fmt.Println()
+    if err == errInputTimeout {
+        return nil, errSessionLocked
+    }
     if err != nil {
         fmt.Printf("❌ Error reading password: %v\n", err)
-        return ""
+        return nil, nil
     }
-    return string(password)
+    return password, nil
 }
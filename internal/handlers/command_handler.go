@@ -0,0 +1,741 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/term"
+
+	"password-manager/internal/crypto"
+	"password-manager/internal/models"
+	"password-manager/internal/services"
+)
+
+// Exit codes of the subcommands
+const (
+	ExitOK    = 0
+	ExitError = 1 // the command failed, e.g. the entry was not found
+	ExitUsage = 2 // the command line was invalid
+)
+
+// CommandHandler runs the non-interactive subcommands used from scripts.
+// Results are written to stdout, prompts and errors to stderr, and every
+// command ends with an exit code.
+type CommandHandler struct {
+	openVault        func() (*services.PasswordService, error)
+	passwordService  *services.PasswordService // set once the vault is opened
+	generatorService *services.GeneratorService
+	name             string
+	stdin            io.Reader
+	stdout           io.Writer
+	stderr           io.Writer
+}
+
+// command is one subcommand. Commands that open the vault do so only once
+// their arguments are known to be valid.
+type command struct {
+	usage   string
+	summary string
+	run     func(h *CommandHandler, fs *flag.FlagSet, args []string) error
+}
+
+// commands are the subcommands by name
+var commands = map[string]command{
+	"get": {
+		usage:   "get [--format FORMAT [--reveal]] <service> [username]",
+		summary: "print the password of a login or the body of a note, or the whole entry",
+		run:     (*CommandHandler).get,
+	},
+	"add": {
+		usage:   "add [--url URL] [--notes TEXT] [--generate [generator flags]] <service> <username>",
+		summary: "add a login, reading its password from the terminal or stdin",
+		run:     (*CommandHandler).add,
+	},
+	"update": {
+		usage:   "update [--url URL] [--notes TEXT] [--generate [generator flags]] <service> <username>",
+		summary: "replace the password of a login, keeping the old one in its history",
+		run:     (*CommandHandler).update,
+	},
+	"delete": {
+		usage:   "delete <service> [username]",
+		summary: "move an entry to the trash",
+		run:     (*CommandHandler).delete,
+	},
+	"list": {
+		usage:   "list [--format FORMAT] [--reveal] [--folder PATH] [--tag NAME] [--trash]",
+		summary: "list entries without their passwords",
+		run:     (*CommandHandler).list,
+	},
+	"search": {
+		usage:   "search [--format FORMAT] [--reveal] [--folder PATH] [--tag NAME] [--trash] <term>",
+		summary: "search entries by service, username or URL",
+		run:     (*CommandHandler).search,
+	},
+	"generate": {
+		usage:   "generate [--length N] [--no-upper] [--no-lower] [--no-numbers] [--no-symbols] [--exclude-similar]",
+		summary: "print a new random password without opening the vault",
+		run:     (*CommandHandler).generate,
+	},
+	"export": {
+		usage:   "export [--output PATH]",
+		summary: "write every entry outside the trash as JSON, with its secrets and attachments unencrypted",
+		run:     (*CommandHandler).exportEntries,
+	},
+	"import": {
+		usage:   "import <path|->",
+		summary: "add the entries of an export, or of stdin given -, to the vault",
+		run:     (*CommandHandler).importEntries,
+	},
+	"otp": {
+		usage:   "otp <service> [username]",
+		summary: "print the current one-time password of an entry",
+		run:     (*CommandHandler).otp,
+	},
+}
+
+func init() {
+	// help lists the commands, so it is added once they are defined
+	commands["help"] = command{
+		usage:   "help",
+		summary: "show this help",
+		run:     (*CommandHandler).help,
+	}
+}
+
+// usageError is an invalid command line, reported with exit code ExitUsage
+type usageError struct {
+	message string
+}
+
+func (e *usageError) Error() string {
+	return e.message
+}
+
+// NewCommandHandler creates a handler for the subcommands. openVault unlocks
+// the vault and is only called by commands that need it.
+func NewCommandHandler(openVault func() (*services.PasswordService, error), generatorService *services.GeneratorService) *CommandHandler {
+	return &CommandHandler{
+		openVault:        openVault,
+		generatorService: generatorService,
+		name:             filepath.Base(os.Args[0]),
+		stdin:            os.Stdin,
+		stdout:           os.Stdout,
+		stderr:           os.Stderr,
+	}
+}
+
+// Run runs a subcommand and returns its exit code
+func (h *CommandHandler) Run(name string, args []string) int {
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(h.stderr, "%s: unknown command %q\n\n", h.name, name)
+		h.printHelp(h.stderr)
+		return ExitUsage
+	}
+
+	// Parse errors are reported below rather than by the flag package
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Usage = func() {}
+	printUsage := func() {
+		fmt.Fprintf(h.stderr, "Usage: %s %s\n", h.name, cmd.usage)
+		fs.SetOutput(h.stderr)
+		fs.PrintDefaults()
+	}
+
+	err := cmd.run(h, fs, args)
+	var usage *usageError
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, flag.ErrHelp):
+		printUsage()
+		return ExitOK
+	case errors.As(err, &usage):
+		fmt.Fprintf(h.stderr, "%s %s: %v\n", h.name, name, err)
+		printUsage()
+		return ExitUsage
+	default:
+		fmt.Fprintf(h.stderr, "%s %s: %v\n", h.name, name, err)
+		return ExitError
+	}
+}
+
+func (h *CommandHandler) get(fs *flag.FlagSet, args []string) error {
+	output := addOutputFlags(fs, "")
+	service, username, err := parseEntryArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	format, err := output.format()
+	if err != nil {
+		return err
+	}
+	ps, err := h.vault()
+	if err != nil {
+		return err
+	}
+
+	password, err := ps.GetPassword(service, username)
+	if err != nil {
+		return err
+	}
+	defer password.Wipe()
+
+	if format != "" {
+		if !*output.reveal {
+			services.MaskSecrets(password)
+		}
+		record := newEntryRecord(password)
+		return writeOutput(h.stdout, format, record, entryColumns, [][][]byte{record.row()})
+	}
+
+	switch password.Type {
+	case models.EntryLogin:
+		return h.writeSecret(password.Password)
+	case models.EntryNote:
+		fmt.Fprintln(h.stdout, password.Notes)
+	default:
+		return fmt.Errorf("entry is a %s; use --format to print its details", password.Type)
+	}
+	return nil
+}
+
+func (h *CommandHandler) add(fs *flag.FlagSet, args []string) error {
+	return h.savePassword(fs, args, false)
+}
+
+func (h *CommandHandler) update(fs *flag.FlagSet, args []string) error {
+	return h.savePassword(fs, args, true)
+}
+
+// savePassword adds a login or replaces its password. URL and notes are kept
+// on update unless given.
+func (h *CommandHandler) savePassword(fs *flag.FlagSet, args []string, update bool) error {
+	url := fs.String("url", "", "URL of the service")
+	notes := fs.String("notes", "", "notes about the entry")
+	generate := fs.Bool("generate", false, "generate the password and print it")
+	options := addGeneratorFlags(fs)
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return &usageError{"expected a service and a username"}
+	}
+	service, username := positional[0], positional[1]
+	if *generate && options().Length <= 0 {
+		return &usageError{"--length must be positive"}
+	}
+	set := setFlags(fs)
+
+	ps, err := h.writableVault()
+	if err != nil {
+		return err
+	}
+
+	req := &models.PasswordRequest{Service: service, Username: username, URL: *url, Notes: *notes}
+	defer req.Wipe()
+	if update {
+		current, err := ps.GetPassword(service, username)
+		if err != nil {
+			return err
+		}
+		// The fields are kept, and wiped with the request
+		req.Fields = current.Fields
+		current.Fields = nil
+		current.Wipe()
+		if current.Type != models.EntryLogin {
+			return fmt.Errorf("entry is a %s; only logins can be updated from the command line", current.Type)
+		}
+		if !set["url"] {
+			req.URL = current.URL
+		}
+		if !set["notes"] {
+			req.Notes = current.Notes
+		}
+	}
+
+	if *generate {
+		req.Password, err = h.generatorService.GeneratePassword(options())
+	} else {
+		req.Password, err = h.readPassword("Password: ")
+	}
+	if err != nil {
+		return err
+	}
+	if len(req.Password) == 0 {
+		return errors.New("password cannot be empty")
+	}
+	h.warnReuse(ps, req.Password, service, username)
+
+	if update {
+		err = ps.UpdatePassword(service, username, req)
+	} else {
+		err = ps.CreatePassword(req)
+	}
+	if err != nil {
+		return err
+	}
+	if *generate {
+		return h.writeSecret(req.Password)
+	}
+	return nil
+}
+
+func (h *CommandHandler) delete(fs *flag.FlagSet, args []string) error {
+	service, username, err := parseEntryArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	ps, err := h.writableVault()
+	if err != nil {
+		return err
+	}
+	return ps.DeletePassword(service, username)
+}
+
+func (h *CommandHandler) list(fs *flag.FlagSet, args []string) error {
+	output, filter := addListFlags(fs)
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return &usageError{"list takes no arguments"}
+	}
+	format, err := output.format()
+	if err != nil {
+		return err
+	}
+	filter.Reveal = *output.reveal
+	ps, err := h.vault()
+	if err != nil {
+		return err
+	}
+
+	passwords, err := ps.ListPasswords(*filter)
+	if err != nil {
+		return err
+	}
+	defer wipeEntries(passwords)
+	return h.printEntries(passwords, format)
+}
+
+func (h *CommandHandler) search(fs *flag.FlagSet, args []string) error {
+	output, filter := addListFlags(fs)
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return &usageError{"expected one search term"}
+	}
+	format, err := output.format()
+	if err != nil {
+		return err
+	}
+	filter.Reveal = *output.reveal
+	ps, err := h.vault()
+	if err != nil {
+		return err
+	}
+
+	passwords, err := ps.SearchPasswords(positional[0], *filter)
+	if err != nil {
+		return err
+	}
+	defer wipeEntries(passwords)
+	return h.printEntries(passwords, format)
+}
+
+func (h *CommandHandler) generate(fs *flag.FlagSet, args []string) error {
+	options := addGeneratorFlags(fs)
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return &usageError{"generate takes no arguments"}
+	}
+	if options().Length <= 0 {
+		return &usageError{"--length must be positive"}
+	}
+
+	password, err := h.generatorService.GeneratePassword(options())
+	if err != nil {
+		return err
+	}
+	defer crypto.Wipe(password)
+
+	return h.writeSecret(password)
+}
+
+func (h *CommandHandler) otp(fs *flag.FlagSet, args []string) error {
+	service, username, err := parseEntryArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	ps, err := h.vault()
+	if err != nil {
+		return err
+	}
+
+	code, err := ps.OTPCode(service, username)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(h.stdout, code.Code)
+	return nil
+}
+
+func (h *CommandHandler) exportEntries(fs *flag.FlagSet, args []string) error {
+	output := fs.String("output", "", "write to a new file readable only by you instead of stdout")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return &usageError{"export takes no arguments"}
+	}
+	ps, err := h.vault()
+	if err != nil {
+		return err
+	}
+
+	entries, err := ps.Export()
+	if err != nil {
+		return err
+	}
+	defer wipeExported(entries)
+
+	document := &exportDocument{Version: exportVersion, Entries: make([]*entryRecord, len(entries))}
+	for i, entry := range entries {
+		document.Entries[i] = newExportRecord(entry)
+	}
+	defer document.wipeAttachments()
+
+	if *output == "" {
+		return writeOutput(h.stdout, formatJSON, document, nil, nil)
+	}
+	f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := writeOutput(f, formatJSON, document, nil, nil); err != nil {
+		f.Close()
+		os.Remove(*output)
+		return err
+	}
+	return f.Close()
+}
+
+func (h *CommandHandler) importEntries(fs *flag.FlagSet, args []string) error {
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return &usageError{"expected the path of an export, or - for stdin"}
+	}
+
+	var data []byte
+	if positional[0] == "-" {
+		data, err = io.ReadAll(h.stdin)
+	} else {
+		data, err = os.ReadFile(positional[0])
+	}
+	if err != nil {
+		return err
+	}
+	defer crypto.Wipe(data)
+
+	// Secrets are decoded straight from data, which is wiped with them. Every
+	// entry read is converted, even from an invalid export, so that it is wiped.
+	var document exportDocument
+	err = json.Unmarshal(data, &document)
+	defer document.wipeAttachments()
+	var entries []*services.ExportedEntry
+	defer func() { wipeExported(entries) }()
+	var invalid error
+	for _, record := range document.Entries {
+		if record == nil {
+			invalid = errors.New("null entry")
+			continue
+		}
+		entry, err := record.importedEntry()
+		entries = append(entries, entry)
+		if err != nil && invalid == nil {
+			invalid = fmt.Errorf("%s (%s): %w", record.Service, record.Username, err)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("invalid export: %w", err)
+	}
+	if document.Version != exportVersion {
+		return fmt.Errorf("unsupported export version %d", document.Version)
+	}
+	if invalid != nil {
+		return fmt.Errorf("invalid export: %w", invalid)
+	}
+
+	ps, err := h.writableVault()
+	if err != nil {
+		return err
+	}
+	return ps.Import(entries)
+}
+
+func (h *CommandHandler) help(fs *flag.FlagSet, args []string) error {
+	h.printHelp(h.stdout)
+	return nil
+}
+
+// printHelp writes the usage of the program and its commands to w
+func (h *CommandHandler) printHelp(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "Usage: %s [--keyfile PATH] [--password-fd N] [--force] [command]\n\n", h.name)
+	fmt.Fprintln(w, "Without a command, the interactive menu starts. Commands:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-10s %s\n", name, commands[name].summary)
+		fmt.Fprintf(w, "  %-10s usage: %s %s\n", "", h.name, commands[name].usage)
+	}
+	fmt.Fprintln(w, "\nThe master password is read from the file descriptor given with --password-fd,")
+	fmt.Fprintln(w, "the PM_MASTER_PASSWORD environment variable, or the terminal, in that order.")
+	fmt.Fprintln(w, "Prefer --password-fd: a password passed in the environment stays in memory")
+	fmt.Fprintln(w, "as the process started with it and cannot be wiped.")
+	fmt.Fprintf(w, "While an agent started with \"%s agent start\" is unlocked, it is not asked for.\n", h.name)
+	fmt.Fprintf(w, "Manage the agent with \"%s agent lock|status|stop\".\n", h.name)
+	fmt.Fprintln(w, "\nExit codes: 0 on success, 1 if the command failed, 2 for usage errors.")
+}
+
+// vault opens the vault on first use
+func (h *CommandHandler) vault() (*services.PasswordService, error) {
+	if h.passwordService == nil {
+		ps, err := h.openVault()
+		if err != nil {
+			return nil, err
+		}
+		h.passwordService = ps
+	}
+	return h.passwordService, nil
+}
+
+// writeSecret writes a secret on its own line of stdout. It is written
+// directly, as formatting it would leave a copy in fmt's buffers.
+func (h *CommandHandler) writeSecret(secret []byte) error {
+	if _, err := h.stdout.Write(secret); err != nil {
+		return err
+	}
+	_, err := io.WriteString(h.stdout, "\n")
+	return err
+}
+
+// writableVault opens the vault for a command that changes it. Expired
+// entries are purged from the trash first, as read commands leave the vault
+// untouched.
+func (h *CommandHandler) writableVault() (*services.PasswordService, error) {
+	ps, err := h.vault()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ps.PurgeTrash(); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// readPassword reads a password without echo from the terminal, or as the
+// first line of stdin when it is not a terminal
+func (h *CommandHandler) readPassword(prompt string) ([]byte, error) {
+	if f, ok := h.stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		fmt.Fprint(h.stderr, prompt)
+		password, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(h.stderr)
+		return password, err
+	}
+
+	line, err := bufio.NewReader(h.stdin).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	password := append([]byte(nil), trimNewline(line)...)
+	crypto.Wipe(line)
+	return password, nil
+}
+
+// warnReuse warns on stderr if password is used, or was used, by another entry
+func (h *CommandHandler) warnReuse(ps *services.PasswordService, password []byte, service, username string) {
+	reuses, err := ps.FindPasswordReuse(password)
+	if err != nil {
+		fmt.Fprintf(h.stderr, "%s: warning: could not check for reuse: %v\n", h.name, err)
+		return
+	}
+	for _, reuse := range reuses {
+		if reuse.Service == service && reuse.Username == username {
+			continue
+		}
+		fmt.Fprintf(h.stderr, "%s: warning: this password is also used by %s (%s)\n", h.name, reuse.Service, reuse.Username)
+	}
+}
+
+// printEntries prints entries in an output format
+func (h *CommandHandler) printEntries(passwords []*models.Password, format string) error {
+	records := make([]*entryRecord, len(passwords))
+	rows := make([][][]byte, len(passwords))
+	for i, password := range passwords {
+		records[i] = newEntryRecord(password)
+		rows[i] = records[i].row()
+	}
+	return writeOutput(h.stdout, format, records, entryColumns, rows)
+}
+
+// wipeEntries wipes the secrets of entries listed with --reveal once they
+// are written
+func wipeEntries(passwords []*models.Password) {
+	for _, password := range passwords {
+		password.Wipe()
+	}
+}
+
+// wipeExported wipes the secrets and attachments of exported entries once
+// they are written or imported
+func wipeExported(entries []*services.ExportedEntry) {
+	for _, entry := range entries {
+		entry.Wipe()
+	}
+}
+
+// outputFlags are the flags choosing the output of read commands
+type outputFlags struct {
+	chosen        *string
+	json          *bool
+	reveal        *bool
+	defaultFormat string
+}
+
+// addOutputFlags registers the output flags. defaultFormat is used unless
+// another format is chosen; it may be empty for commands with their own
+// default output.
+func addOutputFlags(fs *flag.FlagSet, defaultFormat string) *outputFlags {
+	return &outputFlags{
+		chosen:        fs.String("format", defaultFormat, "output format: "+strings.Join(outputFormats, ", ")),
+		json:          fs.Bool("json", false, "shorthand for --format json"),
+		reveal:        fs.Bool("reveal", false, "show passwords and other secrets instead of masking them"),
+		defaultFormat: defaultFormat,
+	}
+}
+
+// format returns the chosen output format
+func (f *outputFlags) format() (string, error) {
+	format := strings.ToLower(*f.chosen)
+	if *f.json {
+		if format != f.defaultFormat && format != formatJSON {
+			return "", &usageError{"--json conflicts with --format " + format}
+		}
+		format = formatJSON
+	}
+	if format == "" {
+		return "", nil
+	}
+	return format, validFormat(format)
+}
+
+// addGeneratorFlags registers the password generator flags and returns a
+// function reading the options from them once parsed
+func addGeneratorFlags(fs *flag.FlagSet) func() *models.GeneratorOptions {
+	length := fs.Int("length", 12, "password length")
+	noUpper := fs.Bool("no-upper", false, "leave out uppercase letters")
+	noLower := fs.Bool("no-lower", false, "leave out lowercase letters")
+	noNumbers := fs.Bool("no-numbers", false, "leave out numbers")
+	noSymbols := fs.Bool("no-symbols", false, "leave out symbols")
+	excludeSimilar := fs.Bool("exclude-similar", false, "leave out similar characters (0,O,l,1,I)")
+
+	return func() *models.GeneratorOptions {
+		return &models.GeneratorOptions{
+			Length:         *length,
+			IncludeUpper:   !*noUpper,
+			IncludeLower:   !*noLower,
+			IncludeNumbers: !*noNumbers,
+			IncludeSymbols: !*noSymbols,
+			ExcludeSimilar: *excludeSimilar,
+		}
+	}
+}
+
+// addListFlags registers the flags of list and search
+func addListFlags(fs *flag.FlagSet) (*outputFlags, *models.PasswordFilter) {
+	filter := &models.PasswordFilter{}
+	output := addOutputFlags(fs, formatTable)
+	fs.StringVar(&filter.Folder, "folder", "", "only entries in this folder or its subfolders")
+	fs.StringVar(&filter.Tag, "tag", "", "only entries with this tag")
+	fs.BoolVar(&filter.IncludeTrashed, "trash", false, "include entries in the trash")
+	return output, filter
+}
+
+// parseArgs parses flags appearing anywhere among the arguments, up to a
+// "--", and returns the other arguments
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, err
+			}
+			return nil, &usageError{err.Error()}
+		}
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// parseEntryArgs parses the arguments of a command taking a service and an
+// optional username, which entries other than logins do not have
+func parseEntryArgs(fs *flag.FlagSet, args []string) (string, string, error) {
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return "", "", err
+	}
+	switch len(positional) {
+	case 1:
+		return positional[0], "", nil
+	case 2:
+		return positional[0], positional[1], nil
+	default:
+		return "", "", &usageError{"expected a service and an optional username"}
+	}
+}
+
+// setFlags returns the names of the flags given on the command line
+func setFlags(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
+
+// trimNewline removes a trailing line ending
+func trimNewline(line []byte) []byte {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r"))
+}
@@ -0,0 +1,568 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"password-manager/internal/models"
+	"password-manager/internal/services"
+)
+
+// Output formats of the read commands
+const (
+	formatJSON  = "json"
+	formatYAML  = "yaml"
+	formatTable = "table"
+	formatTSV   = "tsv"
+)
+
+// outputFormats lists the output formats in the order they are documented
+var outputFormats = []string{formatJSON, formatYAML, formatTable, formatTSV}
+
+// entryRecord is the schema of entries printed with --format. It is part of
+// the command line interface: fields may be added, but never renamed or
+// removed. Secrets are masked unless --reveal is given, and shared with the
+// entry so that wiping the entry wipes them.
+type entryRecord struct {
+	ID        int                  `json:"id"`
+	Type      models.EntryType     `json:"type"`
+	Service   string               `json:"service"` // the title of entries other than logins
+	Username  string               `json:"username"`
+	Password  models.Secret        `json:"password"` // empty for entries other than logins
+	URL       string               `json:"url"`
+	Notes     string               `json:"notes"`
+	Folder    string               `json:"folder"`
+	Tags      []string             `json:"tags"`
+	Fields    []models.CustomField `json:"fields"`
+	Card      *models.Card         `json:"card"`
+	Identity  *models.Identity     `json:"identity"`
+	SSHKey    *models.SSHKey       `json:"ssh_key"`
+	CreatedAt time.Time            `json:"created_at"`
+	UpdatedAt time.Time            `json:"updated_at"`
+	DeletedAt *time.Time           `json:"deleted_at"` // set while the entry is in the trash
+
+	Attachments []*attachmentRecord `json:"attachments,omitempty"` // only in exports
+}
+
+// attachmentRecord is an attachment in an export. Its contents are base64
+// encoded, one string per chunk it is stored in, so that an import can check
+// them against the recorded chunk count and size.
+type attachmentRecord struct {
+	Name   string          `json:"name"`
+	Size   int64           `json:"size"`
+	Chunks int             `json:"chunks"`
+	Data   []models.Secret `json:"data"`
+}
+
+// newEntryRecord converts an entry to its output schema
+func newEntryRecord(password *models.Password) *entryRecord {
+	record := &entryRecord{
+		ID:        password.ID,
+		Type:      password.Type,
+		Service:   password.Service,
+		Username:  password.Username,
+		Password:  password.Password,
+		URL:       password.URL,
+		Notes:     password.Notes,
+		Folder:    password.Folder,
+		Tags:      password.Tags,
+		Fields:    password.Fields,
+		Card:      password.Card,
+		Identity:  password.Identity,
+		SSHKey:    password.SSHKey,
+		CreatedAt: password.CreatedAt,
+		UpdatedAt: password.UpdatedAt,
+		DeletedAt: password.DeletedAt,
+	}
+
+	// Lists are never null, so consumers need not check for it
+	if record.Tags == nil {
+		record.Tags = []string{}
+	}
+	if record.Fields == nil {
+		record.Fields = []models.CustomField{}
+	}
+	return record
+}
+
+// exportVersion is the version of the export schema, raised whenever a
+// change would keep older versions from importing an export
+const exportVersion = 1
+
+// exportDocument is the schema of exports: the entries in their output
+// schema with their attachments, and with every secret revealed. Imports
+// ignore the IDs, times and trash state of the entries, which are set anew.
+type exportDocument struct {
+	Version int            `json:"version"`
+	Entries []*entryRecord `json:"entries"`
+}
+
+// newExportRecord converts an exported entry to its export schema
+func newExportRecord(exported *services.ExportedEntry) *entryRecord {
+	record := newEntryRecord(exported.Entry)
+	for _, attachment := range exported.Attachments {
+		data := make([]models.Secret, len(attachment.Data))
+		for i, chunk := range attachment.Data {
+			data[i] = make(models.Secret, base64.StdEncoding.EncodedLen(len(chunk)))
+			base64.StdEncoding.Encode(data[i], chunk)
+		}
+		record.Attachments = append(record.Attachments, &attachmentRecord{
+			Name:   attachment.Name,
+			Size:   attachment.Size,
+			Chunks: attachment.Chunks,
+			Data:   data,
+		})
+	}
+	return record
+}
+
+// importedEntry converts an entry read from an export. Its secrets are
+// shared with the record, while the contents of its attachments are decoded
+// into new memory. The entry is returned on error too, so that it can be
+// wiped.
+func (r *entryRecord) importedEntry() (*services.ExportedEntry, error) {
+	exported := &services.ExportedEntry{Entry: &models.Password{
+		Type:     r.Type,
+		Service:  r.Service,
+		Username: r.Username,
+		Password: r.Password,
+		URL:      r.URL,
+		Notes:    r.Notes,
+		Folder:   r.Folder,
+		Tags:     r.Tags,
+		Fields:   r.Fields,
+		Card:     r.Card,
+		Identity: r.Identity,
+		SSHKey:   r.SSHKey,
+	}}
+
+	for _, record := range r.Attachments {
+		if record == nil {
+			return exported, errors.New("null attachment")
+		}
+		attachment := &services.ExportedAttachment{Name: record.Name, Size: record.Size, Chunks: record.Chunks}
+		exported.Attachments = append(exported.Attachments, attachment)
+
+		for _, encoded := range record.Data {
+			chunk := make(models.Secret, base64.StdEncoding.DecodedLen(len(encoded)))
+			n, err := base64.StdEncoding.Decode(chunk, encoded)
+			attachment.Data = append(attachment.Data, chunk[:n])
+			if err != nil {
+				chunk.Wipe()
+				return exported, fmt.Errorf("attachment %q: %w", record.Name, err)
+			}
+		}
+	}
+	return exported, nil
+}
+
+// wipeAttachments wipes the encoded contents of the attachments in an export
+func (d *exportDocument) wipeAttachments() {
+	for _, record := range d.Entries {
+		if record == nil {
+			continue
+		}
+		for _, attachment := range record.Attachments {
+			if attachment == nil {
+				continue
+			}
+			for _, encoded := range attachment.Data {
+				encoded.Wipe()
+			}
+		}
+	}
+}
+
+// entryColumns are the columns of entries in table and TSV output. Notes,
+// custom fields and type details are only part of JSON and YAML output.
+var entryColumns = []string{"id", "type", "service", "username", "password", "url", "folder", "tags", "updated_at", "deleted_at"}
+
+// row returns the values of the entry columns. The password is not copied.
+func (r *entryRecord) row() [][]byte {
+	deletedAt := ""
+	if r.DeletedAt != nil {
+		deletedAt = r.DeletedAt.Format(time.RFC3339)
+	}
+	return [][]byte{
+		[]byte(strconv.Itoa(r.ID)), []byte(r.Type), []byte(r.Service), []byte(r.Username), r.Password, []byte(r.URL),
+		[]byte(r.Folder), []byte(strings.Join(r.Tags, ",")), []byte(r.UpdatedAt.Format(time.RFC3339)), []byte(deletedAt),
+	}
+}
+
+// validFormat checks an output format given on the command line
+func validFormat(format string) error {
+	if !slices.Contains(outputFormats, format) {
+		return &usageError{fmt.Sprintf("unknown format %q; expected one of %s", format, strings.Join(outputFormats, ", "))}
+	}
+	return nil
+}
+
+// writeOutput writes value as JSON or YAML, or the given rows as a table or
+// TSV. The output is built in memory that is wiped once written, without
+// encoding/json or text/tabwriter, whose buffers would keep copies of the
+// secrets in it.
+func writeOutput(w io.Writer, format string, value any, columns []string, rows [][][]byte) error {
+	var out outputBuffer
+	defer out.wipe()
+
+	switch format {
+	case formatJSON, formatYAML:
+		node, err := newOutputNode(reflect.ValueOf(value))
+		if err != nil {
+			return err
+		}
+		if format == formatJSON {
+			writeJSONNode(&out, node, 0)
+			out.WriteString("\n")
+		} else {
+			writeYAMLNode(&out, node, 0)
+		}
+	case formatTable:
+		writeTable(&out, columns, rows)
+	case formatTSV:
+		writeTSV(&out, columns, rows)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+
+	_, err := w.Write(out.buf)
+	return err
+}
+
+// outputBuffer collects output that may hold secrets. Memory it outgrows is
+// wiped as it grows, and the rest by wipe.
+type outputBuffer struct {
+	buf []byte
+}
+
+// grow makes room for n more bytes
+func (b *outputBuffer) grow(n int) {
+	if cap(b.buf)-len(b.buf) >= n {
+		return
+	}
+	grown := make([]byte, len(b.buf), 2*cap(b.buf)+n)
+	copy(grown, b.buf)
+	clear(b.buf[:cap(b.buf)])
+	b.buf = grown
+}
+
+// Write appends p to the buffer
+func (b *outputBuffer) Write(p []byte) {
+	b.grow(len(p))
+	b.buf = append(b.buf, p...)
+}
+
+// WriteString appends s to the buffer
+func (b *outputBuffer) WriteString(s string) {
+	b.grow(len(s))
+	b.buf = append(b.buf, s...)
+}
+
+// writeQuoted appends s as a JSON string. JSON string escapes are valid in
+// YAML double-quoted strings.
+func (b *outputBuffer) writeQuoted(s models.Secret) {
+	b.grow(6*len(s) + 2) // every byte may become a \u00XX escape
+	b.buf = s.AppendJSON(b.buf)
+}
+
+// wipe overwrites the buffer with zeros
+func (b *outputBuffer) wipe() {
+	clear(b.buf[:cap(b.buf)])
+	b.buf = nil
+}
+
+// outputField is one key and value of an object, kept in order
+type outputField struct {
+	key   string
+	value any
+}
+
+// newOutputNode converts a value to the tree written as JSON or YAML, with
+// the names, order and omissions of its JSON tags. Objects are
+// []outputField and arrays []any; secrets stay models.Secret so that they
+// are never copied to a string.
+func newOutputNode(v reflect.Value) (any, error) {
+	switch value := v.Interface().(type) {
+	case models.Secret:
+		return value, nil
+	case time.Time:
+		return value.Format(time.RFC3339Nano), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return newOutputNode(v.Elem())
+	case reflect.Struct:
+		fields := []outputField{}
+		for i := range v.NumField() {
+			field := v.Type().Field(i)
+			name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			if options == "omitempty" && emptyOutputValue(v.Field(i)) {
+				continue
+			}
+			value, err := newOutputNode(v.Field(i))
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, outputField{key: name, value: value})
+		}
+		return fields, nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil, nil
+		}
+		items := make([]any, v.Len())
+		for i := range items {
+			item, err := newOutputNode(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return json.Number(strconv.FormatInt(v.Int(), 10)), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return json.Number(strconv.FormatUint(v.Uint(), 10)), nil
+	}
+	return nil, fmt.Errorf("cannot write a %s", v.Type())
+}
+
+// emptyOutputValue reports whether a field tagged omitempty is left out, as
+// encoding/json decides it
+func emptyOutputValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	}
+	return false
+}
+
+// writeJSONNode writes a node as indented JSON, laid out as
+// json.Encoder.SetIndent("", "  ") lays it out
+func writeJSONNode(out *outputBuffer, node any, indent int) {
+	pad := strings.Repeat("  ", indent)
+
+	switch node := node.(type) {
+	case []outputField:
+		if len(node) == 0 {
+			out.WriteString("{}")
+			return
+		}
+		out.WriteString("{")
+		for i, field := range node {
+			if i > 0 {
+				out.WriteString(",")
+			}
+			out.WriteString("\n" + pad + "  ")
+			out.writeQuoted(models.Secret(field.key))
+			out.WriteString(": ")
+			writeJSONNode(out, field.value, indent+1)
+		}
+		out.WriteString("\n" + pad + "}")
+	case []any:
+		if len(node) == 0 {
+			out.WriteString("[]")
+			return
+		}
+		out.WriteString("[")
+		for i, item := range node {
+			if i > 0 {
+				out.WriteString(",")
+			}
+			out.WriteString("\n" + pad + "  ")
+			writeJSONNode(out, item, indent+1)
+		}
+		out.WriteString("\n" + pad + "]")
+	default:
+		writeScalar(out, node)
+	}
+}
+
+// plainYAMLKey matches the mapping keys written without quotes
+var plainYAMLKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// writeYAMLNode writes a node as YAML at an indentation level. Strings are
+// always quoted so that no value changes type when read back.
+func writeYAMLNode(out *outputBuffer, node any, indent int) {
+	pad := strings.Repeat("  ", indent)
+
+	switch node := node.(type) {
+	case []outputField:
+		if len(node) == 0 {
+			out.WriteString(pad + "{}\n")
+		}
+		for _, field := range node {
+			out.WriteString(pad)
+			if plainYAMLKey.MatchString(field.key) {
+				out.WriteString(field.key)
+			} else {
+				out.writeQuoted(models.Secret(field.key))
+			}
+			if isYAMLScalar(field.value) {
+				out.WriteString(": ")
+				writeScalar(out, field.value)
+				out.WriteString("\n")
+				continue
+			}
+			out.WriteString(":\n")
+			writeYAMLNode(out, field.value, indent+1)
+		}
+	case []any:
+		if len(node) == 0 {
+			out.WriteString(pad + "[]\n")
+		}
+		for _, item := range node {
+			out.WriteString(pad + "- ")
+			if isYAMLScalar(item) {
+				writeScalar(out, item)
+				out.WriteString("\n")
+				continue
+			}
+			// Nested collections start on the line of their dash
+			var nested outputBuffer
+			writeYAMLNode(&nested, item, indent+1)
+			out.Write(nested.buf[len(pad)+2:])
+			nested.wipe()
+		}
+	default:
+		out.WriteString(pad)
+		writeScalar(out, node)
+		out.WriteString("\n")
+	}
+}
+
+// isYAMLScalar reports whether a node is written on the line of its key,
+// which includes empty collections
+func isYAMLScalar(node any) bool {
+	switch node := node.(type) {
+	case []outputField:
+		return len(node) == 0
+	case []any:
+		return len(node) == 0
+	}
+	return true
+}
+
+// writeScalar writes a scalar node or an empty collection, the same way in
+// JSON and YAML
+func writeScalar(out *outputBuffer, node any) {
+	switch node := node.(type) {
+	case nil:
+		out.WriteString("null")
+	case bool:
+		out.WriteString(strconv.FormatBool(node))
+	case json.Number:
+		out.WriteString(node.String())
+	case string:
+		out.writeQuoted(models.Secret(node))
+	case models.Secret:
+		out.writeQuoted(node)
+	case []outputField:
+		out.WriteString("{}")
+	case []any:
+		out.WriteString("[]")
+	}
+}
+
+// writeTable writes rows as columns aligned with spaces, laid out as
+// text/tabwriter lays them out with a padding of 2. Runs of whitespace in a
+// cell are collapsed to one space so that every row stays on one line.
+func writeTable(out *outputBuffer, columns []string, rows [][][]byte) {
+	header := make([][]byte, len(columns))
+	for i, column := range columns {
+		header[i] = []byte(strings.ToUpper(column))
+	}
+	lines := append([][][]byte{header}, rows...)
+
+	widths := make([]int, len(columns))
+	for _, line := range lines {
+		for i, cell := range line {
+			widths[i] = max(widths[i], tableCellWidth(cell))
+		}
+	}
+
+	for _, line := range lines {
+		for i, cell := range line {
+			for j, word := range bytes.Fields(cell) {
+				if j > 0 {
+					out.WriteString(" ")
+				}
+				out.Write(word)
+			}
+			if i < len(line)-1 {
+				out.WriteString(strings.Repeat(" ", widths[i]-tableCellWidth(cell)+2))
+			}
+		}
+		out.WriteString("\n")
+	}
+}
+
+// tableCellWidth returns the width of a cell once its whitespace is collapsed
+func tableCellWidth(cell []byte) int {
+	words := bytes.Fields(cell)
+	width := max(len(words)-1, 0)
+	for _, word := range words {
+		width += utf8.RuneCount(word)
+	}
+	return width
+}
+
+// writeTSV writes rows as tab-separated values, escaping the characters that
+// would break a row
+func writeTSV(out *outputBuffer, columns []string, rows [][][]byte) {
+	out.WriteString(strings.Join(columns, "\t") + "\n")
+	for _, row := range rows {
+		for i, cell := range row {
+			if i > 0 {
+				out.WriteString("\t")
+			}
+			for len(cell) > 0 {
+				special := bytes.IndexAny(cell, "\\\t\n\r")
+				if special < 0 {
+					out.Write(cell)
+					break
+				}
+				out.Write(cell[:special])
+				out.WriteString(tsvEscapes[cell[special]])
+				cell = cell[special+1:]
+			}
+		}
+		out.WriteString("\n")
+	}
+}
+
+// tsvEscapes are the escapes of the characters that would break a TSV row
+var tsvEscapes = map[byte]string{'\\': `\\`, '\t': `\t`, '\n': `\n`, '\r': `\r`}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"password-manager/internal/crypto"
+)
+
+// errInputTimeout is returned when no input arrives before the deadline
+var errInputTimeout = errors.New("timed out waiting for input")
+
+// terminal reads the input of the interactive menu. Where stdin can be
+// polled, reads take a deadline, so that the menu can lock the vault while it
+// waits; elsewhere they block as before.
+type terminal struct {
+	input  deadlineReader
+	fd     int // descriptor of stdin, for terminal settings
+	reader *bufio.Reader
+	timed  bool // reads honor deadlines
+}
+
+// deadlineReader is stdin as read by the terminal
+type deadlineReader interface {
+	io.Reader
+	SetReadDeadline(deadline time.Time) error
+}
+
+// readLine reads a line without its line ending. A zero deadline waits
+// forever.
+func (t *terminal) readLine(deadline time.Time) (string, error) {
+	line, err := t.readBytes(deadline)
+	return string(line), err
+}
+
+// readBytes reads a line without its line ending as bytes, which unlike a
+// string can be wiped. A partial line left at the deadline is dropped.
+func (t *terminal) readBytes(deadline time.Time) ([]byte, error) {
+	if t.timed {
+		if err := t.input.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	line, err := t.reader.ReadBytes('\n')
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		crypto.Wipe(line)
+		return nil, errInputTimeout
+	}
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		crypto.Wipe(line)
+		return nil, err
+	}
+
+	trimmed := append([]byte(nil), trimNewline(line)...)
+	crypto.Wipe(line)
+	return trimmed, nil
+}
@@ -0,0 +1,19 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package handlers
+
+import "golang.org/x/sys/unix"
+
+// Requests reading and writing the terminal settings
+const (
+	ioctlGetTermios = unix.TIOCGETA
+	ioctlSetTermios = unix.TIOCSETA
+)
+
+// flushRead selects the input queue for TIOCFLUSH
+const flushRead = 0x1
+
+// flushInput discards input typed but not read yet
+func flushInput(fd int) error {
+	return unix.IoctlSetPointerInt(fd, unix.TIOCFLUSH, flushRead)
+}
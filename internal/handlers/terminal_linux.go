@@ -0,0 +1,14 @@
+package handlers
+
+import "golang.org/x/sys/unix"
+
+// Requests reading and writing the terminal settings
+const (
+	ioctlGetTermios = unix.TCGETS
+	ioctlSetTermios = unix.TCSETS
+)
+
+// flushInput discards input typed but not read yet
+func flushInput(fd int) error {
+	return unix.IoctlSetInt(fd, unix.TCFLSH, unix.TCIFLUSH)
+}
@@ -0,0 +1,30 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package handlers
+
+import (
+	"bufio"
+	"os"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// newTerminal reads stdin without deadlines, as it cannot be polled here
+func newTerminal() *terminal {
+	return &terminal{
+		input:  os.Stdin,
+		fd:     int(os.Stdin.Fd()),
+		reader: bufio.NewReader(os.Stdin),
+	}
+}
+
+// readSecret reads a line with echo turned off, ignoring the deadline
+func (t *terminal) readSecret(deadline time.Time) ([]byte, error) {
+	return term.ReadPassword(t.fd)
+}
+
+// flush discards input read ahead but not used yet
+func (t *terminal) flush() {
+	t.reader.Reset(t.input)
+}
@@ -0,0 +1,112 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package handlers
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// newTerminal reads stdin once poll reports input, which is what lets reads
+// take a deadline. Stdin stays in blocking mode, as expected by the shell and
+// the other programs sharing it, whichever way the menu exits.
+func newTerminal() *terminal {
+	input := &polledInput{fd: unix.Stdin}
+	return &terminal{
+		input:  input,
+		fd:     unix.Stdin,
+		reader: bufio.NewReader(input),
+		timed:  true,
+	}
+}
+
+// polledInput reads a blocking file descriptor, waiting with poll first so
+// that no read outlasts the deadline
+type polledInput struct {
+	fd       int
+	deadline time.Time // zero to wait forever
+}
+
+// SetReadDeadline makes reads fail with os.ErrDeadlineExceeded once deadline
+// passes without input
+func (p *polledInput) SetReadDeadline(deadline time.Time) error {
+	p.deadline = deadline
+	return nil
+}
+
+func (p *polledInput) Read(b []byte) (int, error) {
+	if err := p.wait(); err != nil {
+		return 0, err
+	}
+	for {
+		n, err := unix.Read(p.fd, b)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 && len(b) > 0 {
+			return 0, io.EOF
+		}
+		return n, nil
+	}
+}
+
+// wait waits until the descriptor has input, or at its end, or the deadline
+// passes. Poll always reports regular files as readable.
+func (p *polledInput) wait() error {
+	fds := []unix.PollFd{{Fd: int32(p.fd), Events: unix.POLLIN}}
+	for {
+		timeout := -1
+		if !p.deadline.IsZero() {
+			// Round up, so that the deadline has passed when poll gives up
+			remaining := time.Until(p.deadline)
+			timeout = int(min(max(remaining+time.Millisecond-1, 0)/time.Millisecond, math.MaxInt32))
+		}
+
+		n, err := unix.Poll(fds, timeout)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return os.ErrDeadlineExceeded
+		}
+		return nil
+	}
+}
+
+// readSecret reads a line with echo turned off. Line editing keeps working,
+// as the terminal stays in canonical mode.
+func (t *terminal) readSecret(deadline time.Time) ([]byte, error) {
+	termios, err := unix.IoctlGetTermios(t.fd, ioctlGetTermios)
+	if err != nil {
+		return nil, err
+	}
+	saved := *termios
+
+	termios.Lflag &^= unix.ECHO
+	termios.Lflag |= unix.ICANON | unix.ISIG
+	termios.Iflag |= unix.ICRNL
+	if err := unix.IoctlSetTermios(t.fd, ioctlSetTermios, termios); err != nil {
+		return nil, err
+	}
+	defer unix.IoctlSetTermios(t.fd, ioctlSetTermios, &saved)
+
+	return t.readBytes(deadline)
+}
+
+// flush discards input typed but not read yet, so that nothing typed before
+// the vault locked ends up in the master password
+func (t *terminal) flush() {
+	t.reader.Reset(t.input)
+	flushInput(t.fd)
+}
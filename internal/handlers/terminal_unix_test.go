@@ -0,0 +1,89 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package handlers
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"password-manager/internal/crypto"
+	"password-manager/internal/database"
+	"password-manager/internal/models"
+	"password-manager/internal/services"
+)
+
+// newPipeTerminal returns a terminal reading the read end of a pipe, as the
+// menu reads stdin, and the write end to type into
+func newPipeTerminal(t *testing.T) (*terminal, *os.File) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+
+	input := &polledInput{fd: int(r.Fd())}
+	return &terminal{input: input, fd: int(r.Fd()), reader: bufio.NewReader(input), timed: true}, w
+}
+
+func TestPolledInputDeadline(t *testing.T) {
+	term, w := newPipeTerminal(t)
+
+	start := time.Now()
+	if _, err := term.readLine(start.Add(50 * time.Millisecond)); err != errInputTimeout {
+		t.Fatalf("read without input: got error %v, want %v", err, errInputTimeout)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("read gave up after %v, want the 50ms deadline", elapsed)
+	}
+
+	// Input that arrives before the deadline is read
+	if _, err := w.WriteString("3\n"); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := term.readLine(time.Now().Add(5 * time.Second)); err != nil || line != "3" {
+		t.Errorf("read with input = %q, %v; want 3", line, err)
+	}
+}
+
+func TestIdleTimeoutLocksVault(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	db, err := database.NewDB(filepath.Join(dir, "vault.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor, err := crypto.NewEncryptor([]byte("correct horse battery"), nil, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err := services.NewPasswordService(db, encryptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	term, _ := newPipeTerminal(t)
+	h := &CLIHandler{passwordService: ps, terminal: term, idleTimeout: 50 * time.Millisecond, sessionStart: time.Now()}
+
+	if _, err := h.readInput(); err != errSessionLocked {
+		t.Fatalf("readInput without input: got error %v, want %v", err, errSessionLocked)
+	}
+
+	// The menu abandons its wait and locks the vault instead of exiting
+	if exit := h.run(h.mainMenu); exit {
+		t.Error("menu exited when the session locked")
+	}
+	if h.passwordService != nil {
+		t.Error("vault still open after the idle timeout")
+	}
+	if _, err := ps.ListPasswords(models.PasswordFilter{}); err == nil {
+		t.Error("closed vault can still be read")
+	}
+}
@@ -2,25 +2,236 @@ package models
 
 import "time"
 
-// Password represents a password entry in the database
+// Password represents a password entry in the database. Entries other than
+// logins keep their title in Service and have no username or password.
 type Password struct {
     ID          int       `json:"id"`
-    Service     string    `json:"service"`
-    Username    string    `json:"username"`
-    Password    string    `json:"password"` // Encrypted
-    URL         string    `json:"url,omitempty"`
-    Notes       string    `json:"notes,omitempty"`
+    Type        EntryType `json:"type"`     // Encrypted
+    Service     string    `json:"service"`  // Encrypted
+    Username    string    `json:"username"` // Encrypted
+    Password    []byte    `json:"password"` // Encrypted; plaintext after decryption
+    URL         string    `json:"url,omitempty"`   // Encrypted
+    Notes       string    `json:"notes,omitempty"` // Encrypted
+    Fields      []CustomField `json:"fields,omitempty"`
+    SealedFields string   `json:"-"`        // Encrypted custom fields as stored
+    Card        *Card     `json:"card,omitempty"`
+    Identity    *Identity `json:"identity,omitempty"`
+    SSHKey      *SSHKey   `json:"ssh_key,omitempty"`
+    SealedDetails string  `json:"-"`        // Encrypted card, identity or SSH key as stored
+    LookupHash  string    `json:"-"`        // Blind index of service and username
+    FolderID    int       `json:"-"`        // 0 if the entry is not in a folder
+    Folder      string    `json:"folder,omitempty"` // Folder path, set when listed
+    Tags        []string  `json:"tags,omitempty"`   // Tag names, set when listed
     CreatedAt   time.Time `json:"created_at"`
     UpdatedAt   time.Time `json:"updated_at"`
+    DeletedAt   *time.Time `json:"deleted_at,omitempty"` // Set while the entry is in the trash
+}
+
+// Wipe overwrites the password, custom field values and secret details with
+// zeros once they are no longer needed
+func (p *Password) Wipe() {
+    clear(p.Password)
+    WipeFields(p.Fields)
+    p.Card.Wipe()
+    p.SSHKey.Wipe()
+}
+
+// EntryType is the kind of record an entry holds
+type EntryType string
+
+// Entry types
+const (
+    EntryLogin    EntryType = "login"
+    EntryNote     EntryType = "note"     // title and body, kept in Notes
+    EntryCard     EntryType = "card"
+    EntryIdentity EntryType = "identity"
+    EntrySSHKey   EntryType = "ssh_key"
+)
+
+// EntryTypes lists the entry types in display order
+var EntryTypes = []EntryType{EntryLogin, EntryNote, EntryCard, EntryIdentity, EntrySSHKey}
+
+// Card holds the details of a payment card entry
+type Card struct {
+    Holder string `json:"holder,omitempty"`
+    Number Secret `json:"number"`
+    Expiry string `json:"expiry"` // MM/YY
+    CVV    Secret `json:"cvv"`
+}
+
+// Wipe overwrites the card number and CVV with zeros
+func (c *Card) Wipe() {
+    if c != nil {
+        c.Number.Wipe()
+        c.CVV.Wipe()
+    }
+}
+
+// Identity holds the details of an identity entry
+type Identity struct {
+    FullName string `json:"full_name"`
+    Address  string `json:"address"`
+    Email    string `json:"email"`
+    Phone    string `json:"phone,omitempty"`
+}
+
+// SSHKey holds the details of an SSH key entry
+type SSHKey struct {
+    PrivateKey Secret `json:"private_key"` // PEM or OpenSSH format
+    PublicKey  string `json:"public_key"`  // authorized_keys format
+    Passphrase Secret `json:"passphrase,omitempty"`
+}
+
+// Wipe overwrites the private key and passphrase with zeros
+func (k *SSHKey) Wipe() {
+    if k != nil {
+        k.PrivateKey.Wipe()
+        k.Passphrase.Wipe()
+    }
+}
+
+// OTPType is the kind of one-time password an entry generates
+type OTPType string
+
+// One-time password types
+const (
+    OTPTOTP OTPType = "totp" // time-based, RFC 6238
+    OTPHOTP OTPType = "hotp" // counter-based, RFC 4226
+)
+
+// OTP holds the one-time password settings of an entry, as found in an
+// otpauth:// URI
+type OTP struct {
+    Type      OTPType `json:"type"`
+    Secret    string  `json:"secret"` // base32
+    Issuer    string  `json:"issuer,omitempty"`
+    Account   string  `json:"account,omitempty"`
+    Algorithm string  `json:"algorithm"` // SHA1, SHA256 or SHA512
+    Digits    int     `json:"digits"`
+    Period    int     `json:"period,omitempty"`  // seconds, TOTP only
+    Counter   uint64  `json:"counter,omitempty"` // next counter, HOTP only
+}
+
+// OTPCode is a generated one-time password
+type OTPCode struct {
+    Code      string `json:"code"`
+    Remaining int    `json:"remaining,omitempty"` // seconds a TOTP code stays valid
+    Counter   uint64 `json:"counter,omitempty"`   // counter a HOTP code was generated from
+}
+
+// FieldType is the kind of value held by a custom field
+type FieldType string
+
+// Custom field types
+const (
+    FieldText      FieldType = "text"
+    FieldConcealed FieldType = "concealed" // masked like the password
+    FieldURL       FieldType = "url"
+    FieldEmail     FieldType = "email"
+    FieldDate      FieldType = "date" // YYYY-MM-DD
+    FieldOTP       FieldType = "otp"  // one-time password secret
+)
+
+// FieldTypes lists the custom field types in display order
+var FieldTypes = []FieldType{FieldText, FieldConcealed, FieldURL, FieldEmail, FieldDate, FieldOTP}
+
+// CustomField is a named extra value of an entry, such as a security
+// question or an account number
+type CustomField struct {
+    Name  string    `json:"name"`
+    Type  FieldType `json:"type"`
+    Value Secret    `json:"value"` // a secret if concealed, wiped like one either way
+}
+
+// Concealed reports whether the field value is a secret masked in listings
+func (f CustomField) Concealed() bool {
+    return f.Type == FieldConcealed || f.Type == FieldOTP
+}
+
+// WipeFields overwrites the values of custom fields with zeros
+func WipeFields(fields []CustomField) {
+    for _, field := range fields {
+        field.Value.Wipe()
+    }
+}
+
+// PasswordFilter selects the entries returned by list and search
+type PasswordFilter struct {
+    Folder         string // folder path; entries in its subfolders match too
+    Tag            string
+    IncludeTrashed bool
+    Reveal         bool // decrypt passwords and other secrets instead of masking them
+}
+
+// Folder is a folder of entries. Folders nest; the path joins the names of a
+// folder and its parents with "/".
+type Folder struct {
+    ID        int       `json:"id"`
+    ParentID  int       `json:"parent_id,omitempty"` // 0 for top-level folders
+    Name      string    `json:"name"`                // Encrypted
+    Path      string    `json:"path"`                // Set when listed
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// Tag is a label that can be attached to any number of entries
+type Tag struct {
+    ID        int       `json:"id"`
+    Name      string    `json:"name"` // Encrypted
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// Attachment is a file stored encrypted with an entry, in chunks
+type Attachment struct {
+    ID         int       `json:"id"`
+    PasswordID int       `json:"password_id"`
+    Name       string    `json:"name"`
+    Size       int64     `json:"size"`
+    Chunks     int       `json:"-"`
+    Metadata   string    `json:"-"` // Encrypted name, size and chunk count as stored
+    CreatedAt  time.Time `json:"created_at"`
+}
+
+// PasswordVersion is an earlier password of an entry kept in its history
+type PasswordVersion struct {
+    ID         int       `json:"id"`
+    PasswordID int       `json:"password_id"`
+    Password   []byte    `json:"password"` // Encrypted; plaintext after decryption
+    ReplacedAt time.Time `json:"replaced_at"`
+}
+
+// Wipe overwrites the password with zeros once it is no longer needed
+func (v *PasswordVersion) Wipe() {
+    clear(v.Password)
+}
+
+// PasswordReuse is an entry that uses, or used, a given password
+type PasswordReuse struct {
+    Service  string `json:"service"`
+    Username string `json:"username"`
+    Current  bool   `json:"current"` // false if only found in the history
 }
 
 // PasswordRequest represents a request to create/update a password
 type PasswordRequest struct {
+    Type     EntryType `json:"type,omitempty"` // login if empty
     Service  string `json:"service"`
     Username string `json:"username"`
-    Password string `json:"password"`
+    Password []byte `json:"password"`
     URL      string `json:"url,omitempty"`
     Notes    string `json:"notes,omitempty"`
+    Fields   []CustomField `json:"fields,omitempty"`
+    Card     *Card     `json:"card,omitempty"`
+    Identity *Identity `json:"identity,omitempty"`
+    SSHKey   *SSHKey   `json:"ssh_key,omitempty"`
+}
+
+// Wipe overwrites the password, custom field values and secret details with
+// zeros once they are no longer needed
+func (r *PasswordRequest) Wipe() {
+    clear(r.Password)
+    WipeFields(r.Fields)
+    r.Card.Wipe()
+    r.SSHKey.Wipe()
 }
 
 // GeneratorOptions represents password generation options
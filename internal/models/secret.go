@@ -0,0 +1,157 @@
+package models
+
+import (
+	"errors"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Secret is a secret value, such as a card number or a concealed custom
+// field, kept in a byte slice so that it can be wiped. In JSON it is a string,
+// written and read without passing through a Go string.
+type Secret []byte
+
+// Wipe overwrites the secret with zeros once it is no longer needed
+func (s Secret) Wipe() {
+	clear(s)
+}
+
+// MarshalJSON encodes the secret as a JSON string
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return s.AppendJSON(make([]byte, 0, len(s)+2)), nil
+}
+
+// UnmarshalJSON decodes a JSON string into a new secret. The decoded value is
+// never longer than the quoted one, so it is written without reallocating.
+func (s *Secret) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*s = nil
+		return nil
+	}
+	if len(data) < 2 || data[0] != '"' || data[len(data)-1] != '"' {
+		return errors.New("secret must be a JSON string")
+	}
+	data = data[1 : len(data)-1]
+
+	value := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		if data[i] != '\\' {
+			value = append(value, data[i])
+			continue
+		}
+		if i++; i == len(data) {
+			clear(value)
+			return errors.New("invalid escape in JSON string")
+		}
+
+		switch data[i] {
+		case '"', '\\', '/':
+			value = append(value, data[i])
+		case 'b':
+			value = append(value, '\b')
+		case 'f':
+			value = append(value, '\f')
+		case 'n':
+			value = append(value, '\n')
+		case 'r':
+			value = append(value, '\r')
+		case 't':
+			value = append(value, '\t')
+		case 'u':
+			r, ok := hexRune(data[i+1:])
+			if !ok {
+				clear(value)
+				return errors.New("invalid escape in JSON string")
+			}
+			i += 4
+			if utf16.IsSurrogate(r) {
+				// Only the first half of a pair, followed by the second
+				// as another escape, makes a valid rune
+				high := r
+				r = unicode.ReplacementChar
+				if rest := data[i+1:]; len(rest) >= 6 && rest[0] == '\\' && rest[1] == 'u' {
+					if low, ok := hexRune(rest[2:]); ok {
+						if decoded := utf16.DecodeRune(high, low); decoded != unicode.ReplacementChar {
+							r = decoded
+							i += 6
+						}
+					}
+				}
+			}
+			value = utf8.AppendRune(value, r)
+		default:
+			clear(value)
+			return errors.New("invalid escape in JSON string")
+		}
+	}
+	*s = value
+	return nil
+}
+
+// AppendJSON appends the secret to buf as a JSON string, escaped exactly as
+// encoding/json escapes strings, and returns the extended buffer
+func (s Secret) AppendJSON(buf []byte) []byte {
+	const hex = "0123456789abcdef"
+
+	buf = append(buf, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				buf = append(buf, '\\', c)
+			case c == '\b':
+				buf = append(buf, '\\', 'b')
+			case c == '\f':
+				buf = append(buf, '\\', 'f')
+			case c == '\n':
+				buf = append(buf, '\\', 'n')
+			case c == '\r':
+				buf = append(buf, '\\', 'r')
+			case c == '\t':
+				buf = append(buf, '\\', 't')
+			case c < 0x20 || c == '<' || c == '>' || c == '&':
+				buf = append(buf, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xF])
+			default:
+				buf = append(buf, c)
+			}
+			i++
+			continue
+		}
+
+		r, size := utf8.DecodeRune(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			buf = utf8.AppendRune(buf, utf8.RuneError)
+		case r == '\u2028' || r == '\u2029':
+			buf = append(buf, '\\', 'u', '2', '0', '2', hex[r&0xF])
+		default:
+			buf = append(buf, s[i:i+size]...)
+		}
+		i += size
+	}
+	return append(buf, '"')
+}
+
+// hexRune decodes the four hexadecimal digits at the start of data
+func hexRune(data []byte) (rune, bool) {
+	if len(data) < 4 {
+		return 0, false
+	}
+	var r rune
+	for _, c := range data[:4] {
+		switch {
+		case '0' <= c && c <= '9':
+			c -= '0'
+		case 'a' <= c && c <= 'f':
+			c -= 'a' - 10
+		case 'A' <= c && c <= 'F':
+			c -= 'A' - 10
+		default:
+			return 0, false
+		}
+		r = r<<4 | rune(c)
+	}
+	return r, true
+}
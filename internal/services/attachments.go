@@ -0,0 +1,298 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"password-manager/internal/crypto"
+	"password-manager/internal/database"
+	"password-manager/internal/models"
+)
+
+// attachmentChunkSize is the size of the chunks attachments are encrypted in
+const attachmentChunkSize = 64 * 1024
+
+// attachmentMaxSizeKey is the vault metadata key holding the attachment size
+// limit in bytes
+const attachmentMaxSizeKey = "attachment_max_size"
+
+// defaultAttachmentMaxSize is the attachment size limit unless configured
+const defaultAttachmentMaxSize = 10 << 20
+
+// attachmentMetadataPart names the encrypted metadata in its associated data
+const attachmentMetadataPart = "metadata"
+
+// ErrAttachmentDamaged is returned when the chunks of an attachment do not
+// add up to what its metadata records
+var ErrAttachmentDamaged = errors.New("attachment is incomplete or damaged")
+
+// attachmentMetadata is the encrypted part of an attachment row
+type attachmentMetadata struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Chunks int    `json:"chunks"`
+}
+
+// AttachmentMaxSize returns the largest attachment size allowed, in bytes
+func (ps *PasswordService) AttachmentMaxSize() (int64, error) {
+	value, found, err := ps.db.GetMetadata(attachmentMaxSizeKey)
+	if err != nil || !found {
+		return defaultAttachmentMaxSize, err
+	}
+
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid attachment size limit in vault: %q", value)
+	}
+	return size, nil
+}
+
+// SetAttachmentMaxSize sets the largest attachment size allowed, in bytes.
+// Existing attachments are kept.
+func (ps *PasswordService) SetAttachmentMaxSize(size int64) error {
+	if size <= 0 {
+		return errors.New("attachment size limit must be positive")
+	}
+	return ps.db.SetMetadata(attachmentMaxSizeKey, strconv.FormatInt(size, 10))
+}
+
+// AddAttachment stores the contents of r as an attachment of an entry. The
+// file is read and encrypted one chunk at a time. If the whole vault file is
+// encrypted, the chunks still end up in the in-memory database and are
+// rewritten with every change; see AttachmentsInMemory.
+func (ps *PasswordService) AddAttachment(service, username, name string, r io.Reader) (*models.Attachment, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.New("attachment name cannot be empty")
+	}
+
+	maxSize, err := ps.AttachmentMaxSize()
+	if err != nil {
+		return nil, err
+	}
+
+	var attachment *models.Attachment
+	chunk := make([]byte, attachmentChunkSize)
+	defer crypto.Wipe(chunk)
+
+	err = ps.transaction(func(tx *PasswordService) error {
+		existing, err := tx.findEntry(service, username)
+		if err != nil {
+			return err
+		}
+		attachments, err := tx.openAttachments(existing.ID)
+		if err != nil {
+			return err
+		}
+		if findAttachment(attachments, name) != nil {
+			return errors.New("entry already has an attachment with that name")
+		}
+
+		// Chunks are bound to the attachment ID, so they are written once the row exists
+		attachment = &models.Attachment{PasswordID: existing.ID, Name: name}
+		if err := tx.db.CreateAttachment(attachment); err != nil {
+			return err
+		}
+
+		for {
+			n, err := io.ReadFull(r, chunk)
+			if n > 0 {
+				if attachment.Size+int64(n) > maxSize {
+					return fmt.Errorf("attachment is larger than the limit of %d bytes", maxSize)
+				}
+				if err := tx.addChunk(attachment, chunk[:n]); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.sealAttachment(tx.db, attachment)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// AttachmentsInMemory reports whether attachments are held in memory while
+// the vault is unlocked, which is the case when the whole vault file is
+// encrypted
+func (ps *PasswordService) AttachmentsInMemory() bool {
+	return ps.encryptor.VaultFileEncrypted()
+}
+
+// ListAttachments lists the attachments of an entry
+func (ps *PasswordService) ListAttachments(service, username string) ([]*models.Attachment, error) {
+	existing, err := ps.findEntry(service, username)
+	if err != nil {
+		return nil, err
+	}
+	return ps.openAttachments(existing.ID)
+}
+
+// ExtractAttachment writes the decrypted contents of an attachment to w, one
+// chunk at a time. Chunks are authenticated before they are written, but a
+// damaged attachment is only reported once the chunks written so far have
+// been passed on, so callers should discard w on error.
+func (ps *PasswordService) ExtractAttachment(service, username, name string, w io.Writer) error {
+	existing, err := ps.findEntry(service, username)
+	if err != nil {
+		return err
+	}
+	attachments, err := ps.openAttachments(existing.ID)
+	if err != nil {
+		return err
+	}
+	attachment := findAttachment(attachments, name)
+	if attachment == nil {
+		return errors.New("attachment not found")
+	}
+
+	return ps.eachChunk(attachment, func(chunk []byte) error {
+		_, err := w.Write(chunk)
+		return err
+	})
+}
+
+// RemoveAttachment deletes an attachment of an entry
+func (ps *PasswordService) RemoveAttachment(service, username, name string) error {
+	return ps.transaction(func(tx *PasswordService) error {
+		existing, err := tx.findEntry(service, username)
+		if err != nil {
+			return err
+		}
+		attachments, err := tx.openAttachments(existing.ID)
+		if err != nil {
+			return err
+		}
+		attachment := findAttachment(attachments, name)
+		if attachment == nil {
+			return errors.New("attachment not found")
+		}
+
+		return tx.db.DeleteAttachment(attachment.ID)
+	})
+}
+
+// addChunk encrypts the next chunk of an attachment, bound to its position,
+// and stores it
+func (ps *PasswordService) addChunk(attachment *models.Attachment, chunk []byte) error {
+	aad := ps.encryptor.AttachmentAAD(attachment.ID, attachment.PasswordID, chunkPart(attachment.Chunks))
+	data, err := ps.encryptor.EncryptBytesWithAAD(chunk, aad)
+	if err != nil {
+		return err
+	}
+	if err := ps.db.AddAttachmentChunk(attachment.ID, attachment.Chunks, data); err != nil {
+		return err
+	}
+
+	attachment.Chunks++
+	attachment.Size += int64(len(chunk))
+	return nil
+}
+
+// eachChunk calls fn with every decrypted chunk of an attachment in order.
+// The chunk is wiped once fn returns. Missing chunks are reported once the
+// last one has been passed to fn.
+func (ps *PasswordService) eachChunk(attachment *models.Attachment, fn func(chunk []byte) error) error {
+	var chunks int
+	var size int64
+	err := ps.db.EachAttachmentChunk(attachment.ID, func(position int, data []byte) error {
+		if position != chunks {
+			return ErrAttachmentDamaged
+		}
+
+		aad := ps.encryptor.AttachmentAAD(attachment.ID, attachment.PasswordID, chunkPart(position))
+		chunk, err := ps.encryptor.DecryptBytesWithAAD(data, aad)
+		if err != nil {
+			return err
+		}
+		defer crypto.Wipe(chunk)
+
+		chunks++
+		size += int64(len(chunk))
+		return fn(chunk)
+	})
+	if err != nil {
+		return err
+	}
+
+	if chunks != attachment.Chunks || size != attachment.Size {
+		return ErrAttachmentDamaged
+	}
+	return nil
+}
+
+// sealAttachment encrypts and stores the name, size and chunk count of an
+// attachment
+func (ps *PasswordService) sealAttachment(db *database.DB, attachment *models.Attachment) error {
+	encoded, err := json.Marshal(attachmentMetadata{
+		Name:   attachment.Name,
+		Size:   attachment.Size,
+		Chunks: attachment.Chunks,
+	})
+	if err != nil {
+		return err
+	}
+
+	aad := ps.encryptor.AttachmentAAD(attachment.ID, attachment.PasswordID, attachmentMetadataPart)
+	metadata, err := ps.encryptor.EncryptWithAAD(encoded, aad)
+	if err != nil {
+		return err
+	}
+	attachment.Metadata = metadata
+	return db.SetAttachmentMetadata(attachment.ID, metadata)
+}
+
+// openAttachments lists the attachments of an entry with their metadata
+// decrypted
+func (ps *PasswordService) openAttachments(passwordID int) ([]*models.Attachment, error) {
+	attachments, err := ps.db.ListAttachments(passwordID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, attachment := range attachments {
+		aad := ps.encryptor.AttachmentAAD(attachment.ID, attachment.PasswordID, attachmentMetadataPart)
+		encoded, err := ps.encryptor.DecryptWithAAD(attachment.Metadata, aad)
+		if err != nil {
+			return nil, err
+		}
+
+		var metadata attachmentMetadata
+		if err := json.Unmarshal(encoded, &metadata); err != nil {
+			return nil, fmt.Errorf("invalid attachment metadata: %w", err)
+		}
+		attachment.Name = metadata.Name
+		attachment.Size = metadata.Size
+		attachment.Chunks = metadata.Chunks
+	}
+
+	return attachments, nil
+}
+
+// findAttachment returns the attachment with the given name, or nil
+func findAttachment(attachments []*models.Attachment, name string) *models.Attachment {
+	name = strings.TrimSpace(name)
+	for _, attachment := range attachments {
+		if attachment.Name == name {
+			return attachment
+		}
+	}
+	return nil
+}
+
+// chunkPart names a chunk of an attachment in its associated data
+func chunkPart(position int) string {
+	return "chunk " + strconv.Itoa(position)
+}
@@ -0,0 +1,282 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"password-manager/internal/crypto"
+	"password-manager/internal/models"
+)
+
+// Field names binding the entry type and details to their entry
+const (
+	entryTypeField = "entry_type"
+	detailsField   = "details"
+)
+
+// entryDetails is the encrypted part of an entry specific to its type
+type entryDetails struct {
+	Card     *models.Card     `json:"card,omitempty"`
+	Identity *models.Identity `json:"identity,omitempty"`
+	SSHKey   *models.SSHKey   `json:"ssh_key,omitempty"`
+}
+
+// validateEntry checks a request against the schema of an entry type,
+// normalizing values such as card numbers in place
+func validateEntry(entryType models.EntryType, req *models.PasswordRequest) error {
+	if !slices.Contains(models.EntryTypes, entryType) {
+		return fmt.Errorf("unknown entry type %q", entryType)
+	}
+	if entryType == models.EntryLogin {
+		if req.Service == "" || req.Username == "" || len(req.Password) == 0 {
+			return errors.New("service, username, and password are required")
+		}
+		return validateCustomFields(req.Fields)
+	}
+
+	if req.Service == "" {
+		return errors.New("title is required")
+	}
+	if len(req.Password) > 0 {
+		return errors.New("only logins have a password")
+	}
+
+	var err error
+	switch entryType {
+	case models.EntryNote:
+		if strings.TrimSpace(req.Notes) == "" {
+			err = errors.New("note body is required")
+		}
+	case models.EntryCard:
+		err = validateCard(req.Card)
+	case models.EntryIdentity:
+		err = validateIdentity(req.Identity)
+	case models.EntrySSHKey:
+		err = validateSSHKey(req.SSHKey)
+	}
+	if err != nil {
+		return err
+	}
+	return validateCustomFields(req.Fields)
+}
+
+// validateCard checks a card, normalizing its number and expiry
+func validateCard(card *models.Card) error {
+	if card == nil {
+		return errors.New("card details are required")
+	}
+
+	// Drop spaces and dashes in place, so the number is not copied
+	number := card.Number[:0]
+	for _, c := range card.Number {
+		if c != ' ' && c != '-' {
+			number = append(number, c)
+		}
+	}
+	clear(card.Number[len(number):])
+	card.Number = number
+	if len(number) < 12 || len(number) > 19 || !isDigits(number) || !luhnValid(number) {
+		return errors.New("invalid card number")
+	}
+
+	month, year, found := strings.Cut(card.Expiry, "/")
+	m, err := strconv.Atoi(month)
+	if !found || err != nil || m < 1 || m > 12 || !isDigits([]byte(year)) || (len(year) != 2 && len(year) != 4) {
+		return errors.New("expiry must be written as MM/YY")
+	}
+	card.Expiry = fmt.Sprintf("%02d/%s", m, year[len(year)-2:])
+
+	if (len(card.CVV) != 3 && len(card.CVV) != 4) || !isDigits(card.CVV) {
+		return errors.New("CVV must be 3 or 4 digits")
+	}
+	return nil
+}
+
+// luhnValid reports whether a string of digits passes the Luhn checksum
+func luhnValid(number []byte) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		digit := int(number[i] - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// isDigits reports whether s is a non-empty string of ASCII digits
+func isDigits(s []byte) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// validateIdentity checks an identity
+func validateIdentity(identity *models.Identity) error {
+	if identity == nil {
+		return errors.New("identity details are required")
+	}
+	if strings.TrimSpace(identity.FullName) == "" || strings.TrimSpace(identity.Address) == "" {
+		return errors.New("full name and address are required")
+	}
+	if _, err := mail.ParseAddress(identity.Email); err != nil {
+		return errors.New("invalid email address")
+	}
+	return nil
+}
+
+// validateSSHKey checks that the private key parses, with its passphrase if
+// it is encrypted, and that the public key belongs to it. A missing public
+// key is derived from the private key.
+func validateSSHKey(key *models.SSHKey) error {
+	if key == nil || len(bytes.TrimSpace(key.PrivateKey)) == 0 {
+		return errors.New("private key is required")
+	}
+
+	var signer ssh.Signer
+	var err error
+	if len(key.Passphrase) > 0 {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key.PrivateKey, key.Passphrase)
+	} else {
+		signer, err = ssh.ParsePrivateKey(key.PrivateKey)
+	}
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return errors.New("private key is encrypted; its passphrase is required")
+	}
+	if err != nil {
+		return fmt.Errorf("invalid private key: %w", err)
+	}
+
+	if strings.TrimSpace(key.PublicKey) == "" {
+		key.PublicKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+		return nil
+	}
+
+	public, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.PublicKey))
+	if err != nil {
+		return fmt.Errorf("invalid public key: %w", err)
+	}
+	if !bytes.Equal(public.Marshal(), signer.PublicKey().Marshal()) {
+		return errors.New("public key does not match the private key")
+	}
+	return nil
+}
+
+// setDetails copies the details of the entry type from a request
+func setDetails(entry *models.Password, req *models.PasswordRequest) {
+	entry.Card, entry.Identity, entry.SSHKey = nil, nil, nil
+	switch entry.Type {
+	case models.EntryCard:
+		entry.Card = req.Card
+	case models.EntryIdentity:
+		entry.Identity = req.Identity
+	case models.EntrySSHKey:
+		entry.SSHKey = req.SSHKey
+	}
+}
+
+// sealDetails encrypts the type and type-specific details of an entry
+func (ps *PasswordService) sealDetails(entry *models.Password) error {
+	if entry.Type == "" {
+		entry.Type = models.EntryLogin
+	}
+
+	entryType, err := ps.encryptor.EncryptWithAAD([]byte(entry.Type), ps.encryptor.FieldAAD(entry.ID, entryTypeField))
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(entryDetails{Card: entry.Card, Identity: entry.Identity, SSHKey: entry.SSHKey})
+	if err != nil {
+		return err
+	}
+	defer crypto.Wipe(encoded)
+
+	details, err := ps.encryptor.EncryptWithAAD(encoded, ps.encryptor.FieldAAD(entry.ID, detailsField))
+	if err != nil {
+		return err
+	}
+
+	entry.Type = models.EntryType(entryType)
+	entry.SealedDetails = details
+	return nil
+}
+
+// openDetails decrypts the type and type-specific details of an entry.
+// Secrets such as card numbers and private keys are masked unless
+// withSecrets is set.
+func (ps *PasswordService) openDetails(entry *models.Password, withSecrets bool) error {
+	entry.Card, entry.Identity, entry.SSHKey = nil, nil, nil
+	if entry.Type == "" {
+		// Entries written before entry types existed are logins
+		entry.Type = models.EntryLogin
+		return nil
+	}
+
+	entryType, err := ps.encryptor.DecryptWithAAD(string(entry.Type), ps.encryptor.FieldAAD(entry.ID, entryTypeField))
+	if err != nil {
+		return err
+	}
+	entry.Type = models.EntryType(entryType)
+
+	encoded, err := ps.encryptor.DecryptWithAAD(entry.SealedDetails, ps.encryptor.FieldAAD(entry.ID, detailsField))
+	if err != nil {
+		return err
+	}
+	defer crypto.Wipe(encoded)
+
+	var details entryDetails
+	if err := json.Unmarshal(encoded, &details); err != nil {
+		return fmt.Errorf("invalid entry details: %w", err)
+	}
+	entry.Card, entry.Identity, entry.SSHKey = details.Card, details.Identity, details.SSHKey
+
+	if !withSecrets {
+		maskDetails(entry)
+	}
+	return nil
+}
+
+// maskDetails wipes the secrets among the details of an entry and replaces
+// them with placeholders
+func maskDetails(entry *models.Password) {
+	if entry.Card != nil {
+		last := entry.Card.Number
+		if len(last) > 4 {
+			last = last[len(last)-4:]
+		}
+		masked := append(models.Secret("•••• "), last...)
+		entry.Card.Wipe()
+		entry.Card.Number = masked
+		entry.Card.CVV = models.Secret(maskedPassword)
+	}
+	if entry.SSHKey != nil {
+		hasPassphrase := len(entry.SSHKey.Passphrase) > 0
+		entry.SSHKey.Wipe()
+		entry.SSHKey.PrivateKey = models.Secret(maskedPassword)
+		if hasPassphrase {
+			entry.SSHKey.Passphrase = models.Secret(maskedPassword)
+		}
+	}
+}
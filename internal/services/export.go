@@ -0,0 +1,229 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"password-manager/internal/models"
+)
+
+// ExportedEntry is a decrypted entry with the contents of its attachments, as
+// written to an export and read back from one
+type ExportedEntry struct {
+	Entry       *models.Password // with its folder and tags
+	Attachments []*ExportedAttachment
+}
+
+// ExportedAttachment is an attachment with its decrypted contents, in the
+// chunks it is stored in
+type ExportedAttachment struct {
+	Name   string
+	Size   int64
+	Chunks int // the number of chunks, checked against Data on import
+	Data   []models.Secret
+}
+
+// Wipe overwrites the secrets of the entry and the contents of its
+// attachments with zeros
+func (e *ExportedEntry) Wipe() {
+	e.Entry.Wipe()
+	for _, attachment := range e.Attachments {
+		for _, chunk := range attachment.Data {
+			chunk.Wipe()
+		}
+	}
+}
+
+// Export decrypts every entry outside the trash with its secrets, custom
+// fields and attachments. The whole vault is held in memory, so call Wipe on
+// every entry once it has been written.
+func (ps *PasswordService) Export() ([]*ExportedEntry, error) {
+	passwords, err := ps.ListPasswords(models.PasswordFilter{Reveal: true})
+	if err != nil {
+		return nil, err
+	}
+
+	exported := make([]*ExportedEntry, 0, len(passwords))
+	wipe := func() {
+		for _, entry := range exported {
+			entry.Wipe()
+		}
+	}
+	for _, password := range passwords {
+		entry := &ExportedEntry{Entry: password}
+		exported = append(exported, entry)
+
+		attachments, err := ps.openAttachments(password.ID)
+		if err != nil {
+			wipe()
+			return nil, err
+		}
+		for _, attachment := range attachments {
+			contents := &ExportedAttachment{Name: attachment.Name, Size: attachment.Size, Chunks: attachment.Chunks}
+			entry.Attachments = append(entry.Attachments, contents)
+
+			err := ps.eachChunk(attachment, func(chunk []byte) error {
+				contents.Data = append(contents.Data, append(models.Secret(nil), chunk...))
+				return nil
+			})
+			if err != nil {
+				wipe()
+				return nil, fmt.Errorf("%s (%s): attachment %q: %w", password.Service, password.Username, attachment.Name, err)
+			}
+		}
+	}
+	return exported, nil
+}
+
+// Import adds the entries of an export to the vault with new IDs, sealing
+// every value, custom field and attachment chunk for its new row. Missing
+// folders and tags are created. Nothing is imported if any entry already
+// exists or is invalid.
+func (ps *PasswordService) Import(entries []*ExportedEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	maxSize, err := ps.AttachmentMaxSize()
+	if err != nil {
+		return err
+	}
+
+	requests := make([]*models.PasswordRequest, len(entries))
+	for i, exported := range entries {
+		entry := exported.Entry
+		req := &models.PasswordRequest{
+			Type:     entry.Type,
+			Service:  entry.Service,
+			Username: entry.Username,
+			Password: entry.Password,
+			URL:      entry.URL,
+			Notes:    entry.Notes,
+			Fields:   entry.Fields,
+			Card:     entry.Card,
+			Identity: entry.Identity,
+			SSHKey:   entry.SSHKey,
+		}
+		if req.Type == "" {
+			req.Type = models.EntryLogin
+		}
+		if err := validateEntry(req.Type, req); err != nil {
+			return fmt.Errorf("%s (%s): %w", entry.Service, entry.Username, err)
+		}
+		if entry.Folder != "" {
+			if _, err := splitFolderPath(entry.Folder); err != nil {
+				return fmt.Errorf("%s (%s): folder: %w", entry.Service, entry.Username, err)
+			}
+		}
+		for _, tag := range entry.Tags {
+			if err := validateLabelName(tag, false); err != nil {
+				return fmt.Errorf("%s (%s): tag: %w", entry.Service, entry.Username, err)
+			}
+		}
+		for _, attachment := range exported.Attachments {
+			if err := checkExportedAttachment(attachment, maxSize); err != nil {
+				return fmt.Errorf("%s (%s): attachment %q: %w", entry.Service, entry.Username, attachment.Name, err)
+			}
+		}
+		requests[i] = req
+	}
+
+	return ps.transaction(func(tx *PasswordService) error {
+		l, err := tx.loadLabels()
+		if err != nil {
+			return err
+		}
+
+		for i, exported := range entries {
+			if err := tx.importEntry(l, requests[i], exported); err != nil {
+				return fmt.Errorf("%s (%s): %w", exported.Entry.Service, exported.Entry.Username, err)
+			}
+		}
+		return nil
+	})
+}
+
+// importEntry stores one validated entry of an export with its folder, tags
+// and attachments
+func (ps *PasswordService) importEntry(l *labels, req *models.PasswordRequest, exported *ExportedEntry) error {
+	entry, err := ps.createEntry(req.Type, req)
+	if err != nil {
+		return err
+	}
+
+	if exported.Entry.Folder != "" {
+		names, _ := splitFolderPath(exported.Entry.Folder)
+		folder, err := ps.createFolders(l, names)
+		if err != nil {
+			return err
+		}
+		if err := ps.db.SetPasswordFolder(entry.ID, folder.ID); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range exported.Entry.Tags {
+		tag := l.tag(name)
+		if tag == nil {
+			if tag, err = ps.createTag(ps.db, name); err != nil {
+				return err
+			}
+			l.tags = append(l.tags, tag)
+		}
+		if err := ps.db.AddPasswordTag(entry.ID, tag.ID); err != nil {
+			return err
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, contents := range exported.Attachments {
+		name := strings.TrimSpace(contents.Name)
+		if names[name] {
+			return fmt.Errorf("duplicate attachment %q", name)
+		}
+		names[name] = true
+
+		// Chunks are bound to the new attachment ID, so they are written once the row exists
+		attachment := &models.Attachment{PasswordID: entry.ID, Name: name}
+		if err := ps.db.CreateAttachment(attachment); err != nil {
+			return err
+		}
+		for _, chunk := range contents.Data {
+			if err := ps.addChunk(attachment, chunk); err != nil {
+				return err
+			}
+		}
+		if err := ps.sealAttachment(ps.db, attachment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkExportedAttachment checks that the chunks of an exported attachment
+// add up to the chunk count and size recorded with them, and that each fits
+// in a stored chunk
+func checkExportedAttachment(attachment *ExportedAttachment, maxSize int64) error {
+	if strings.TrimSpace(attachment.Name) == "" {
+		return errors.New("attachment name cannot be empty")
+	}
+	if len(attachment.Data) != attachment.Chunks {
+		return fmt.Errorf("%w: %d chunks, expected %d", ErrAttachmentDamaged, len(attachment.Data), attachment.Chunks)
+	}
+
+	var size int64
+	for _, chunk := range attachment.Data {
+		if len(chunk) == 0 || len(chunk) > attachmentChunkSize {
+			return fmt.Errorf("%w: chunk of %d bytes", ErrAttachmentDamaged, len(chunk))
+		}
+		size += int64(len(chunk))
+	}
+	if size != attachment.Size {
+		return fmt.Errorf("%w: %d bytes, expected %d", ErrAttachmentDamaged, size, attachment.Size)
+	}
+	if size > maxSize {
+		return fmt.Errorf("attachment is larger than the limit of %d bytes", maxSize)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"password-manager/internal/crypto"
+	"password-manager/internal/models"
+)
+
+func TestExportImport(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	source := openTestVault(t, filepath.Join(dir, "source.db"))
+
+	requests := []*models.PasswordRequest{
+		{Service: "example", Username: "alice", Password: []byte("secret"), URL: "https://example.com", Notes: "notes",
+			Fields: []models.CustomField{
+				{Name: "PIN", Type: models.FieldConcealed, Value: models.Secret("1234")},
+				{Name: "Account", Type: models.FieldText, Value: models.Secret("42")},
+			}},
+		{Type: models.EntryCard, Service: "Visa", Card: &models.Card{Number: models.Secret("4111111111111111"), Expiry: "12/30", CVV: models.Secret("123")}},
+		{Service: "trashed", Username: "bob", Password: []byte("gone")},
+	}
+	for _, req := range requests {
+		if err := source.CreatePassword(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := source.CreateFolder("Work/Mail"); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.MovePassword("example", "alice", "Work/Mail"); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.TagPassword("example", "alice", "important"); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.DeletePassword("trashed", "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	exported, err := source.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, entry := range exported {
+			entry.Wipe()
+		}
+	}()
+	if len(exported) != 2 {
+		t.Fatalf("exported %d entries, want the 2 outside the trash", len(exported))
+	}
+	var exportedID int
+	for _, entry := range exported {
+		if entry.Entry.Service == "example" {
+			exportedID = entry.Entry.ID
+		}
+	}
+
+	target := openTestVault(t, filepath.Join(dir, "target.db"))
+	// Taking up the first ID gives the imported entries other IDs than before
+	if err := target.CreatePassword(&models.PasswordRequest{Service: "existing", Username: "carol", Password: []byte("mine")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Import(exported); err != nil {
+		t.Fatal(err)
+	}
+
+	imported, err := target.GetPassword("example", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer imported.Wipe()
+	if string(imported.Password) != "secret" || imported.URL != "https://example.com" || imported.Notes != "notes" ||
+		imported.Folder != "Work/Mail" || len(imported.Tags) != 1 || imported.Tags[0] != "important" {
+		t.Errorf("imported entry: %+v", imported)
+	}
+	if len(imported.Fields) != 2 || imported.Fields[0].Name != "PIN" || string(imported.Fields[0].Value) != "1234" ||
+		imported.Fields[1].Name != "Account" || string(imported.Fields[1].Value) != "42" {
+		t.Errorf("imported fields: %+v", imported.Fields)
+	}
+
+	// The fields are sealed for the new row, not copied from the old one
+	stored, err := target.lookupEntry("example", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ID == exportedID {
+		t.Fatalf("imported entry kept its ID %d", stored.ID)
+	}
+	fields, err := target.encryptor.DecryptWithAAD(stored.SealedFields, target.encryptor.FieldAAD(stored.ID, customFieldsField))
+	if err != nil {
+		t.Errorf("fields not sealed for the imported entry: %v", err)
+	}
+	crypto.Wipe(fields)
+	if _, err := target.encryptor.DecryptWithAAD(stored.SealedFields, target.encryptor.FieldAAD(exportedID, customFieldsField)); !errors.Is(err, crypto.ErrTampered) {
+		t.Errorf("fields open for the exported entry ID: %v", err)
+	}
+
+	card, err := target.GetPassword("Visa", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer card.Wipe()
+	if card.Card == nil || !bytes.Equal(card.Card.Number, []byte("4111111111111111")) || !bytes.Equal(card.Card.CVV, []byte("123")) {
+		t.Errorf("imported card: %+v", card.Card)
+	}
+	if _, err := target.GetPassword("trashed", "bob"); err != ErrNotFound {
+		t.Errorf("entry in the trash was exported: %v", err)
+	}
+
+	// Importing again would duplicate the entries, so nothing is imported
+	revision, err := target.VaultRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Import(exported); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("second import: got error %v, want already exists", err)
+	}
+	if after, err := target.VaultRevision(); err != nil || after != revision {
+		t.Errorf("vault revision %d after a failed import, want %d (%v)", after, revision, err)
+	}
+}
+
+func TestExportImportAttachments(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	source := openTestVault(t, filepath.Join(dir, "source.db"))
+
+	if err := source.CreatePassword(&models.PasswordRequest{Service: "example", Username: "alice", Password: []byte("secret")}); err != nil {
+		t.Fatal(err)
+	}
+	contents := make([]byte, 2*attachmentChunkSize+100)
+	for i := range contents {
+		contents[i] = byte(i * 7)
+	}
+	if _, err := source.AddAttachment("example", "alice", "codes.bin", bytes.NewReader(contents)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.AddAttachment("example", "alice", "empty.txt", strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+
+	exported, err := source.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, entry := range exported {
+			entry.Wipe()
+		}
+	}()
+	attachments := exported[0].Attachments
+	if len(attachments) != 2 || attachments[0].Chunks != 3 || len(attachments[0].Data) != 3 || attachments[1].Chunks != 0 {
+		t.Fatalf("exported attachments: %+v", attachments)
+	}
+
+	// A chunk count or size that does not match the chunks imports nothing
+	target := openTestVault(t, filepath.Join(dir, "target.db"))
+	damage := []func(a *ExportedAttachment){
+		func(a *ExportedAttachment) { a.Chunks++ },
+		func(a *ExportedAttachment) { a.Size-- },
+		func(a *ExportedAttachment) { a.Data = a.Data[:len(a.Data)-1] },
+	}
+	for _, damage := range damage {
+		damaged := *attachments[0]
+		damage(&damaged)
+		entry := &ExportedEntry{Entry: exported[0].Entry, Attachments: []*ExportedAttachment{&damaged}}
+		if err := target.Import([]*ExportedEntry{entry}); !errors.Is(err, ErrAttachmentDamaged) {
+			t.Errorf("damaged attachment %+v: got error %v, want %v", damaged, err, ErrAttachmentDamaged)
+		}
+	}
+	if _, err := target.GetPassword("example", "alice"); err != ErrNotFound {
+		t.Fatalf("entry with a damaged attachment was imported: %v", err)
+	}
+
+	if err := target.Import(exported); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := target.ListAttachments("example", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 2 || imported[0].Name != "codes.bin" || imported[0].Chunks != 3 || imported[1].Name != "empty.txt" {
+		t.Fatalf("imported attachments: %+v", imported)
+	}
+
+	// The chunks are encrypted anew for the key and IDs of the target vault
+	var extracted bytes.Buffer
+	if err := target.ExtractAttachment("example", "alice", "codes.bin", &extracted); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(extracted.Bytes(), contents) {
+		t.Error("imported attachment differs from the exported one")
+	}
+}
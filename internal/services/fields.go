@@ -0,0 +1,124 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"password-manager/internal/crypto"
+	"password-manager/internal/models"
+)
+
+// customFieldsField binds the encrypted custom fields to their entry
+const customFieldsField = "custom_fields"
+
+// dateFieldLayout is the format of date custom fields
+const dateFieldLayout = "2006-01-02"
+
+// ValidateCustomField checks the name, type and value of a custom field
+func ValidateCustomField(field models.CustomField) error {
+	if strings.TrimSpace(field.Name) == "" {
+		return errors.New("field name cannot be empty")
+	}
+	if !slices.Contains(models.FieldTypes, field.Type) {
+		return fmt.Errorf("unknown field type %q", field.Type)
+	}
+
+	switch field.Type {
+	case models.FieldURL:
+		u, err := url.Parse(string(field.Value))
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("field %q: invalid URL", field.Name)
+		}
+	case models.FieldEmail:
+		if _, err := mail.ParseAddress(string(field.Value)); err != nil {
+			return fmt.Errorf("field %q: invalid email address", field.Name)
+		}
+	case models.FieldDate:
+		if _, err := time.Parse(dateFieldLayout, string(field.Value)); err != nil {
+			return fmt.Errorf("field %q: dates must be written as YYYY-MM-DD", field.Name)
+		}
+	case models.FieldOTP:
+		if _, err := ParseOTP(string(field.Value)); err != nil {
+			return fmt.Errorf("field %q: expected a base32 secret or an otpauth:// URI", field.Name)
+		}
+	}
+	return nil
+}
+
+// validateCustomFields checks every custom field of an entry. Field names
+// must be unique, ignoring case.
+func validateCustomFields(fields []models.CustomField) error {
+	seen := make(map[string]bool)
+	for _, field := range fields {
+		if err := ValidateCustomField(field); err != nil {
+			return err
+		}
+
+		name := strings.ToLower(field.Name)
+		if seen[name] {
+			return fmt.Errorf("duplicate field name %q", field.Name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// sealFields encrypts the custom fields of an entry into SealedFields
+func (ps *PasswordService) sealFields(entry *models.Password) error {
+	fields := entry.Fields
+	if fields == nil {
+		fields = []models.CustomField{}
+	}
+
+	// The fields are encrypted as one list, hiding their number and names
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	defer crypto.Wipe(encoded)
+
+	sealed, err := ps.encryptor.EncryptWithAAD(encoded, ps.encryptor.FieldAAD(entry.ID, customFieldsField))
+	if err != nil {
+		return err
+	}
+	entry.SealedFields = sealed
+	return nil
+}
+
+// openFields decrypts the custom fields of an entry. Concealed values are
+// masked unless withConcealed is set.
+func (ps *PasswordService) openFields(entry *models.Password, withConcealed bool) error {
+	entry.Fields = nil
+	if entry.SealedFields == "" {
+		// Entries written before custom fields existed
+		return nil
+	}
+
+	encoded, err := ps.encryptor.DecryptWithAAD(entry.SealedFields, ps.encryptor.FieldAAD(entry.ID, customFieldsField))
+	if err != nil {
+		return err
+	}
+	defer crypto.Wipe(encoded)
+
+	var fields []models.CustomField
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return fmt.Errorf("invalid custom fields: %w", err)
+	}
+
+	for i := range fields {
+		if fields[i].Concealed() && !withConcealed {
+			fields[i].Value.Wipe()
+			fields[i].Value = models.Secret(maskedPassword)
+		}
+	}
+	if len(fields) > 0 {
+		entry.Fields = fields
+	}
+	return nil
+}
@@ -0,0 +1,434 @@
+package services
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+
+	"password-manager/internal/database"
+	"password-manager/internal/models"
+)
+
+// Label kinds bound into the associated data of folder and tag names
+const (
+	folderLabel = "folder"
+	tagLabel    = "tag"
+)
+
+// folderSeparator joins the names of nested folders into a path
+const folderSeparator = "/"
+
+// labels are the decrypted folders and tags of the vault
+type labels struct {
+	folders []*models.Folder
+	tags    []*models.Tag
+}
+
+// ListFolders lists all folders, sorted by path
+func (ps *PasswordService) ListFolders() ([]*models.Folder, error) {
+	l, err := ps.loadLabels()
+	if err != nil {
+		return nil, err
+	}
+	return l.folders, nil
+}
+
+// CreateFolder creates a folder from a path such as "Work/Email", creating
+// any missing parent folders too
+func (ps *PasswordService) CreateFolder(path string) error {
+	names, err := splitFolderPath(path)
+	if err != nil {
+		return err
+	}
+
+	return ps.transaction(func(tx *PasswordService) error {
+		l, err := tx.loadLabels()
+		if err != nil {
+			return err
+		}
+		if l.folder(path) != nil {
+			return errors.New("folder already exists")
+		}
+
+		_, err = tx.createFolders(l, names)
+		return err
+	})
+}
+
+// createFolders creates the folders of a path that do not exist yet, adding
+// them to l, and returns the last one
+func (ps *PasswordService) createFolders(l *labels, names []string) (*models.Folder, error) {
+	var folder *models.Folder
+	for i, name := range names {
+		path := strings.Join(names[:i+1], folderSeparator)
+		if existing := l.folder(path); existing != nil {
+			folder = existing
+			continue
+		}
+
+		parentID := 0
+		if folder != nil {
+			parentID = folder.ID
+		}
+
+		// The name is bound to the folder ID, so it is written once the row exists
+		folder = &models.Folder{ParentID: parentID}
+		if err := ps.db.CreateFolder(folder); err != nil {
+			return nil, err
+		}
+		if err := ps.sealLabel(ps.db, folderLabel, folder.ID, name); err != nil {
+			return nil, err
+		}
+		folder.Name, folder.Path = name, path
+		l.folders = append(l.folders, folder)
+	}
+	return folder, nil
+}
+
+// RenameFolder gives the folder at path a new name, keeping its place in the
+// hierarchy
+func (ps *PasswordService) RenameFolder(path, name string) error {
+	if err := validateLabelName(name, true); err != nil {
+		return err
+	}
+
+	return ps.transaction(func(tx *PasswordService) error {
+		l, err := tx.loadLabels()
+		if err != nil {
+			return err
+		}
+		folder := l.folder(path)
+		if folder == nil {
+			return errors.New("folder not found")
+		}
+		for _, sibling := range l.folders {
+			if sibling.ParentID == folder.ParentID && sibling.Name == name && sibling.ID != folder.ID {
+				return errors.New("a folder with that name already exists here")
+			}
+		}
+
+		return tx.sealLabel(tx.db, folderLabel, folder.ID, name)
+	})
+}
+
+// DeleteFolder deletes the folder at path. Its entries move to the parent
+// folder; folders with subfolders cannot be deleted.
+func (ps *PasswordService) DeleteFolder(path string) error {
+	return ps.transaction(func(tx *PasswordService) error {
+		l, err := tx.loadLabels()
+		if err != nil {
+			return err
+		}
+		folder := l.folder(path)
+		if folder == nil {
+			return errors.New("folder not found")
+		}
+		for _, child := range l.folders {
+			if child.ParentID == folder.ID {
+				return errors.New("folder has subfolders; delete them first")
+			}
+		}
+
+		return tx.db.DeleteFolder(folder.ID, folder.ParentID)
+	})
+}
+
+// MovePassword moves an entry to the folder at path, or out of any folder if
+// path is empty. The entry keeps its ID, so its history moves with it.
+func (ps *PasswordService) MovePassword(service, username, path string) error {
+	return ps.transaction(func(tx *PasswordService) error {
+		existing, err := tx.findEntry(service, username)
+		if err != nil {
+			return err
+		}
+
+		folderID := 0
+		if path != "" {
+			l, err := tx.loadLabels()
+			if err != nil {
+				return err
+			}
+			folder := l.folder(path)
+			if folder == nil {
+				return errors.New("folder not found")
+			}
+			folderID = folder.ID
+		}
+
+		return tx.db.SetPasswordFolder(existing.ID, folderID)
+	})
+}
+
+// ListTags lists all tags, sorted by name
+func (ps *PasswordService) ListTags() ([]*models.Tag, error) {
+	l, err := ps.loadLabels()
+	if err != nil {
+		return nil, err
+	}
+	return l.tags, nil
+}
+
+// CreateTag creates a tag
+func (ps *PasswordService) CreateTag(name string) error {
+	if err := validateLabelName(name, false); err != nil {
+		return err
+	}
+
+	return ps.transaction(func(tx *PasswordService) error {
+		l, err := tx.loadLabels()
+		if err != nil {
+			return err
+		}
+		if l.tag(name) != nil {
+			return errors.New("tag already exists")
+		}
+
+		_, err = tx.createTag(tx.db, name)
+		return err
+	})
+}
+
+// RenameTag gives a tag a new name
+func (ps *PasswordService) RenameTag(name, newName string) error {
+	if err := validateLabelName(newName, false); err != nil {
+		return err
+	}
+
+	return ps.transaction(func(tx *PasswordService) error {
+		l, err := tx.loadLabels()
+		if err != nil {
+			return err
+		}
+		tag := l.tag(name)
+		if tag == nil {
+			return errors.New("tag not found")
+		}
+		if other := l.tag(newName); other != nil && other.ID != tag.ID {
+			return errors.New("tag already exists")
+		}
+
+		return tx.sealLabel(tx.db, tagLabel, tag.ID, newName)
+	})
+}
+
+// DeleteTag deletes a tag and removes it from every entry
+func (ps *PasswordService) DeleteTag(name string) error {
+	return ps.transaction(func(tx *PasswordService) error {
+		l, err := tx.loadLabels()
+		if err != nil {
+			return err
+		}
+		tag := l.tag(name)
+		if tag == nil {
+			return errors.New("tag not found")
+		}
+
+		return tx.db.DeleteTag(tag.ID)
+	})
+}
+
+// TagPassword attaches a tag to an entry, creating the tag if needed
+func (ps *PasswordService) TagPassword(service, username, name string) error {
+	return ps.transaction(func(tx *PasswordService) error {
+		existing, err := tx.findEntry(service, username)
+		if err != nil {
+			return err
+		}
+
+		l, err := tx.loadLabels()
+		if err != nil {
+			return err
+		}
+
+		tag := l.tag(name)
+		if tag == nil {
+			if err := validateLabelName(name, false); err != nil {
+				return err
+			}
+			if tag, err = tx.createTag(tx.db, name); err != nil {
+				return err
+			}
+		}
+		return tx.db.AddPasswordTag(existing.ID, tag.ID)
+	})
+}
+
+// UntagPassword detaches a tag from an entry
+func (ps *PasswordService) UntagPassword(service, username, name string) error {
+	return ps.transaction(func(tx *PasswordService) error {
+		existing, err := tx.findEntry(service, username)
+		if err != nil {
+			return err
+		}
+
+		l, err := tx.loadLabels()
+		if err != nil {
+			return err
+		}
+		tag := l.tag(name)
+		if tag == nil {
+			return errors.New("tag not found")
+		}
+
+		return tx.db.RemovePasswordTag(existing.ID, tag.ID)
+	})
+}
+
+// createTag stores a new tag with an encrypted name
+func (ps *PasswordService) createTag(db *database.DB, name string) (*models.Tag, error) {
+	tag := &models.Tag{}
+	err := db.Transaction(func(tx *database.DB) error {
+		// The name is bound to the tag ID, so it is written once the row exists
+		if err := tx.CreateTag(tag); err != nil {
+			return err
+		}
+		return ps.sealLabel(tx, tagLabel, tag.ID, name)
+	})
+	tag.Name = name
+	return tag, err
+}
+
+// sealLabel encrypts and stores the name of a folder or tag
+func (ps *PasswordService) sealLabel(db *database.DB, kind string, id int, name string) error {
+	ciphertext, err := ps.encryptor.EncryptWithAAD([]byte(name), ps.encryptor.LabelAAD(kind, id))
+	if err != nil {
+		return err
+	}
+
+	if kind == folderLabel {
+		return db.RenameFolder(id, ciphertext)
+	}
+	return db.RenameTag(id, ciphertext)
+}
+
+// openLabel decrypts the name of a folder or tag
+func (ps *PasswordService) openLabel(kind string, id int, ciphertext string) (string, error) {
+	name, err := ps.encryptor.DecryptWithAAD(ciphertext, ps.encryptor.LabelAAD(kind, id))
+	if err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
+
+// loadLabels decrypts all folders and tags and sets the folder paths
+func (ps *PasswordService) loadLabels() (*labels, error) {
+	folders, err := ps.db.ListFolders()
+	if err != nil {
+		return nil, err
+	}
+	tags, err := ps.db.ListTags()
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[int]*models.Folder)
+	for _, folder := range folders {
+		if folder.Name, err = ps.openLabel(folderLabel, folder.ID, folder.Name); err != nil {
+			return nil, err
+		}
+		byID[folder.ID] = folder
+	}
+	for _, folder := range folders {
+		folder.Path = folderPath(folder, byID)
+	}
+	for _, tag := range tags {
+		if tag.Name, err = ps.openLabel(tagLabel, tag.ID, tag.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(folders, func(i, j int) bool { return folders[i].Path < folders[j].Path })
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return &labels{folders: folders, tags: tags}, nil
+}
+
+// labelEntry sets the folder path and tag names of an entry
+func (l *labels) labelEntry(entry *models.Password, entryTags map[int][]int) {
+	entry.Folder = ""
+	for _, folder := range l.folders {
+		if folder.ID == entry.FolderID {
+			entry.Folder = folder.Path
+		}
+	}
+
+	entry.Tags = nil
+	for _, tag := range l.tags {
+		if slices.Contains(entryTags[entry.ID], tag.ID) {
+			entry.Tags = append(entry.Tags, tag.Name)
+		}
+	}
+}
+
+// folder returns the folder at path, or nil
+func (l *labels) folder(path string) *models.Folder {
+	names, err := splitFolderPath(path)
+	if err != nil {
+		return nil
+	}
+	path = strings.Join(names, folderSeparator)
+
+	for _, folder := range l.folders {
+		if folder.Path == path {
+			return folder
+		}
+	}
+	return nil
+}
+
+// tag returns the tag with the given name, or nil
+func (l *labels) tag(name string) *models.Tag {
+	name = strings.TrimSpace(name)
+	for _, tag := range l.tags {
+		if tag.Name == name {
+			return tag
+		}
+	}
+	return nil
+}
+
+// inFolder reports whether an entry is in the folder at path or one of its
+// subfolders
+func inFolder(entry *models.Password, path string) bool {
+	return entry.Folder == path || strings.HasPrefix(entry.Folder, path+folderSeparator)
+}
+
+// folderPath joins the names of a folder and its parents
+func folderPath(folder *models.Folder, byID map[int]*models.Folder) string {
+	names := []string{folder.Name}
+	for parent := byID[folder.ParentID]; parent != nil && len(names) <= len(byID); parent = byID[parent.ParentID] {
+		names = append([]string{parent.Name}, names...)
+	}
+	return strings.Join(names, folderSeparator)
+}
+
+// splitFolderPath splits a folder path into its folder names
+func splitFolderPath(path string) ([]string, error) {
+	path = strings.Trim(strings.TrimSpace(path), folderSeparator)
+	if path == "" {
+		return nil, errors.New("folder path cannot be empty")
+	}
+
+	names := strings.Split(path, folderSeparator)
+	for i, name := range names {
+		names[i] = strings.TrimSpace(name)
+		if err := validateLabelName(names[i], true); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// validateLabelName checks the name of a folder or tag
+func validateLabelName(name string, folder bool) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("name cannot be empty")
+	}
+	if name != strings.TrimSpace(name) {
+		return errors.New("name cannot start or end with spaces")
+	}
+	if folder && strings.Contains(name, folderSeparator) {
+		return errors.New("folder names cannot contain " + folderSeparator)
+	}
+	return nil
+}
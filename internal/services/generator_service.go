@@ -5,6 +5,7 @@ import (
     "math/big"
     "password-manager/internal/models"
     "strings"
+    "unicode/utf8"
 )
 
 type GeneratorService struct{}
@@ -15,7 +16,7 @@ func NewGeneratorService() *GeneratorService {
 }
 
 // GeneratePassword generates a password based on the given options
-func (gs *GeneratorService) GeneratePassword(options *models.GeneratorOptions) (string, error) {
+func (gs *GeneratorService) GeneratePassword(options *models.GeneratorOptions) ([]byte, error) {
     if options.Length <= 0 {
         options.Length = 12 // Default length
     }
@@ -34,12 +35,12 @@ func (gs *GeneratorService) GeneratePassword(options *models.GeneratorOptions) (
     for i := range password {
         randomIndex, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
         if err != nil {
-            return "", err
+            return nil, err
         }
         password[i] = charset[randomIndex.Int64()]
     }
 
-    return string(password), nil
+    return password, nil
 }
 
 // buildCharset builds the character set based on options
@@ -82,7 +83,7 @@ func (gs *GeneratorService) buildCharset(options *models.GeneratorOptions) strin
 }
 
 // ValidatePasswordStrength validates password strength
-func (gs *GeneratorService) ValidatePasswordStrength(password string) map[string]bool {
+func (gs *GeneratorService) ValidatePasswordStrength(password []byte) map[string]bool {
     strength := map[string]bool{
         "has_lower":   false,
         "has_upper":   false,
@@ -92,7 +93,10 @@ func (gs *GeneratorService) ValidatePasswordStrength(password string) map[string
         "good_length": len(password) >= 12,
     }
 
-    for _, char := range password {
+    for i := 0; i < len(password); {
+        char, size := utf8.DecodeRune(password[i:])
+        i += size
+
         switch {
         case char >= 'a' && char <= 'z':
             strength["has_lower"] = true
@@ -0,0 +1,228 @@
+package services
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"password-manager/internal/crypto"
+	"password-manager/internal/database"
+	"password-manager/internal/models"
+)
+
+// historyDepthKey is the vault metadata key holding the password history depth
+const historyDepthKey = "history_depth"
+
+// defaultHistoryDepth is the number of earlier passwords kept per entry
+const defaultHistoryDepth = 10
+
+// maxHistoryDepth bounds the configurable history depth
+const maxHistoryDepth = 100
+
+// historyField binds passwords in the history to their entry, apart from the
+// current password
+const historyField = "password_history"
+
+// HistoryDepth returns how many earlier passwords are kept per entry
+func (ps *PasswordService) HistoryDepth() (int, error) {
+	value, found, err := ps.db.GetMetadata(historyDepthKey)
+	if err != nil || !found {
+		return defaultHistoryDepth, err
+	}
+
+	depth, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid history depth in vault: %q", value)
+	}
+	return depth, nil
+}
+
+// SetHistoryDepth sets how many earlier passwords are kept per entry, pruning
+// older ones. A depth of 0 turns the history off.
+func (ps *PasswordService) SetHistoryDepth(depth int) error {
+	if depth < 0 || depth > maxHistoryDepth {
+		return fmt.Errorf("history depth must be between 0 and %d", maxHistoryDepth)
+	}
+
+	return ps.db.Transaction(func(tx *database.DB) error {
+		if err := tx.SetMetadata(historyDepthKey, strconv.Itoa(depth)); err != nil {
+			return err
+		}
+		return tx.PrunePasswordHistory(depth)
+	})
+}
+
+// PasswordHistory returns the earlier passwords of an entry, newest first,
+// decrypted. Call Wipe on each version once it has been used.
+func (ps *PasswordService) PasswordHistory(service, username string) ([]*models.PasswordVersion, error) {
+	existing, err := ps.findEntry(service, username)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := ps.db.ListPasswordVersions(existing.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, version := range versions {
+		if err := ps.openVersion(version); err != nil {
+			return nil, err
+		}
+	}
+
+	return versions, nil
+}
+
+// RestorePasswordVersion makes an earlier password of an entry current again.
+// The password it replaces moves to the history.
+func (ps *PasswordService) RestorePasswordVersion(service, username string, versionID int) error {
+	return ps.transaction(func(tx *PasswordService) error {
+		existing, err := tx.findEntry(service, username)
+		if err != nil {
+			return err
+		}
+
+		versions, err := tx.db.ListPasswordVersions(existing.ID)
+		if err != nil {
+			return err
+		}
+		var version *models.PasswordVersion
+		for _, v := range versions {
+			if v.ID == versionID {
+				version = v
+			}
+		}
+		if version == nil {
+			return errors.New("password version not found")
+		}
+
+		previous := string(existing.Password)
+		// Open concealed custom fields too, as the entry is written back whole
+		if err := tx.openEntry(existing, true); err != nil {
+			return err
+		}
+		defer existing.Wipe()
+		crypto.Wipe(existing.Password)
+		if err := tx.openVersion(version); err != nil {
+			return err
+		}
+		defer version.Wipe()
+
+		replaced, err := tx.historyVersion(existing, previous, version.Password)
+		if err != nil {
+			return err
+		}
+
+		existing.Password = version.Password
+		if err := tx.sealEntry(existing); err != nil {
+			return err
+		}
+
+		if err := tx.db.DeletePasswordVersion(version.ID); err != nil {
+			return err
+		}
+		if err := tx.addHistory(tx.db, existing.ID, replaced); err != nil {
+			return err
+		}
+		return tx.db.UpdatePassword(existing.ID, existing)
+	})
+}
+
+// FindPasswordReuse returns the entries whose current or earlier passwords
+// match password
+func (ps *PasswordService) FindPasswordReuse(password []byte) ([]models.PasswordReuse, error) {
+	entries, err := ps.db.ListPasswords()
+	if err != nil {
+		return nil, err
+	}
+
+	var reuses []models.PasswordReuse
+	for _, entry := range entries {
+		if err := ps.openEntry(entry, true); err != nil {
+			return nil, err
+		}
+		current := subtle.ConstantTimeCompare(entry.Password, password) == 1
+		entry.Wipe()
+		if current {
+			reuses = append(reuses, models.PasswordReuse{Service: entry.Service, Username: entry.Username, Current: true})
+			continue
+		}
+
+		versions, err := ps.db.ListPasswordVersions(entry.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, version := range versions {
+			if err := ps.openVersion(version); err != nil {
+				return nil, err
+			}
+			used := subtle.ConstantTimeCompare(version.Password, password) == 1
+			version.Wipe()
+			if used {
+				reuses = append(reuses, models.PasswordReuse{Service: entry.Service, Username: entry.Username})
+				break
+			}
+		}
+	}
+
+	sort.Slice(reuses, func(i, j int) bool {
+		if reuses[i].Service != reuses[j].Service {
+			return reuses[i].Service < reuses[j].Service
+		}
+		return reuses[i].Username < reuses[j].Username
+	})
+	return reuses, nil
+}
+
+// historyVersion re-encrypts the current password of an opened entry, given
+// as its stored ciphertext, for the history. It returns "" if the history is
+// off or the password is not changing.
+func (ps *PasswordService) historyVersion(entry *models.Password, ciphertext string, newPassword []byte) (string, error) {
+	depth, err := ps.HistoryDepth()
+	if err != nil || depth == 0 {
+		return "", err
+	}
+
+	aad := ps.encryptor.EntryAAD(entry.ID, entry.Service, entry.Username)
+	previous, err := ps.encryptor.DecryptWithAAD(ciphertext, aad)
+	if err != nil {
+		return "", err
+	}
+	defer crypto.Wipe(previous)
+
+	if subtle.ConstantTimeCompare(previous, newPassword) == 1 {
+		return "", nil
+	}
+	return ps.encryptor.EncryptWithAAD(previous, ps.encryptor.FieldAAD(entry.ID, historyField))
+}
+
+// addHistory stores a version returned by historyVersion and prunes the
+// history to its depth
+func (ps *PasswordService) addHistory(tx *database.DB, passwordID int, version string) error {
+	if version == "" {
+		return nil
+	}
+
+	depth, err := ps.HistoryDepth()
+	if err != nil {
+		return err
+	}
+	if err := tx.AddPasswordVersion(passwordID, version); err != nil {
+		return err
+	}
+	return tx.PrunePasswordHistory(depth)
+}
+
+// openVersion decrypts a password from the history in place
+func (ps *PasswordService) openVersion(version *models.PasswordVersion) error {
+	aad := ps.encryptor.FieldAAD(version.PasswordID, historyField)
+	password, err := ps.encryptor.DecryptWithAAD(string(version.Password), aad)
+	if err != nil {
+		return err
+	}
+	version.Password = password
+	return nil
+}
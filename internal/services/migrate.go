@@ -0,0 +1,89 @@
+package services
+
+import (
+	"fmt"
+	"strconv"
+
+	"password-manager/internal/crypto"
+	"password-manager/internal/database"
+	"password-manager/internal/models"
+)
+
+// entryFormatKey is the vault metadata key recording the entry format
+const entryFormatKey = "entry_format"
+
+// Entry formats, in the order they were introduced
+const (
+	entryFormatLegacy    = iota // password encrypted without associated data
+	entryFormatBound            // password bound to its entry with associated data
+	entryFormatEncrypted        // all fields encrypted, looked up by blind index
+)
+
+// currentEntryFormat is the format written by this version
+const currentEntryFormat = entryFormatEncrypted
+
+// upgradeEntries migrates stored entries to the current entry format
+func (ps *PasswordService) upgradeEntries() error {
+	value, found, err := ps.db.GetMetadata(entryFormatKey)
+	if err != nil {
+		return err
+	}
+
+	format := entryFormatLegacy
+	if found {
+		if format, err = strconv.Atoi(value); err != nil {
+			return fmt.Errorf("invalid entry format in vault: %q", value)
+		}
+	}
+	if format > currentEntryFormat {
+		return fmt.Errorf("vault entries use a newer format (%d)", format)
+	}
+	if format == currentEntryFormat {
+		return nil
+	}
+
+	return ps.db.Transaction(func(tx *database.DB) error {
+		if format < entryFormatBound {
+			err := tx.ReencryptPasswords(func(entry *models.Password) (string, error) {
+				plaintext, err := ps.encryptor.Decrypt(string(entry.Password))
+				if err != nil {
+					return "", err
+				}
+				defer crypto.Wipe(plaintext)
+
+				aad := ps.encryptor.EntryAAD(entry.ID, entry.Service, entry.Username)
+				return ps.encryptor.EncryptWithAAD(plaintext, aad)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if format < entryFormatEncrypted {
+			passwords, err := tx.ListPasswords()
+			if err != nil {
+				return err
+			}
+
+			for _, password := range passwords {
+				aad := ps.encryptor.EntryAAD(password.ID, password.Service, password.Username)
+				plaintext, err := ps.encryptor.DecryptWithAAD(string(password.Password), aad)
+				if err != nil {
+					return err
+				}
+
+				password.Password = plaintext
+				err = ps.sealEntry(password)
+				crypto.Wipe(plaintext)
+				if err != nil {
+					return err
+				}
+				if err := tx.UpdatePassword(password.ID, password); err != nil {
+					return err
+				}
+			}
+		}
+
+		return tx.SetMetadata(entryFormatKey, strconv.Itoa(currentEntryFormat))
+	})
+}
@@ -0,0 +1,266 @@
+package services
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"password-manager/internal/crypto"
+	"password-manager/internal/models"
+)
+
+// otpField binds the encrypted one-time password settings to their entry
+const otpField = "otp"
+
+// Defaults for the parameters an otpauth:// URI may leave out
+const (
+	defaultOTPAlgorithm = crypto.OTPSHA1
+	defaultOTPDigits    = 6
+	defaultOTPPeriod    = 30
+)
+
+// ErrNoOTP is returned when an entry has no one-time password
+var ErrNoOTP = errors.New("entry has no one-time password")
+
+// otpAlgorithms lists the supported one-time password hash algorithms
+var otpAlgorithms = []string{crypto.OTPSHA1, crypto.OTPSHA256, crypto.OTPSHA512}
+
+// ParseOTP reads one-time password settings from an otpauth:// URI, or from a
+// bare base32 secret for a TOTP with the usual defaults
+func ParseOTP(value string) (*models.OTP, error) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(strings.ToLower(value), "otpauth://") {
+		otp := &models.OTP{
+			Type:      models.OTPTOTP,
+			Secret:    normalizeOTPSecret(value),
+			Algorithm: defaultOTPAlgorithm,
+			Digits:    defaultOTPDigits,
+			Period:    defaultOTPPeriod,
+		}
+		return otp, validateOTP(otp)
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid otpauth URI: %w", err)
+	}
+	query := u.Query()
+
+	otp := &models.OTP{
+		Type:      models.OTPType(strings.ToLower(u.Host)),
+		Secret:    normalizeOTPSecret(query.Get("secret")),
+		Issuer:    query.Get("issuer"),
+		Algorithm: defaultOTPAlgorithm,
+		Digits:    defaultOTPDigits,
+	}
+
+	// The label is "issuer:account" or just "account"
+	label := strings.TrimPrefix(u.Path, "/")
+	if issuer, account, found := strings.Cut(label, ":"); found {
+		otp.Account = strings.TrimSpace(account)
+		if otp.Issuer == "" {
+			otp.Issuer = strings.TrimSpace(issuer)
+		}
+	} else {
+		otp.Account = strings.TrimSpace(label)
+	}
+
+	if algorithm := query.Get("algorithm"); algorithm != "" {
+		otp.Algorithm = strings.ToUpper(algorithm)
+	}
+	if digits := query.Get("digits"); digits != "" {
+		if otp.Digits, err = strconv.Atoi(digits); err != nil {
+			return nil, fmt.Errorf("invalid otpauth digits %q", digits)
+		}
+	}
+
+	switch otp.Type {
+	case models.OTPTOTP:
+		otp.Period = defaultOTPPeriod
+		if period := query.Get("period"); period != "" {
+			if otp.Period, err = strconv.Atoi(period); err != nil {
+				return nil, fmt.Errorf("invalid otpauth period %q", period)
+			}
+		}
+	case models.OTPHOTP:
+		counter := query.Get("counter")
+		if counter == "" {
+			return nil, errors.New("otpauth URI for HOTP needs a counter")
+		}
+		if otp.Counter, err = strconv.ParseUint(counter, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid otpauth counter %q", counter)
+		}
+	}
+
+	return otp, validateOTP(otp)
+}
+
+// SetOTP sets the one-time password of an entry from an otpauth:// URI or a
+// base32 secret, replacing any earlier one
+func (ps *PasswordService) SetOTP(service, username, value string) error {
+	return ps.transaction(func(tx *PasswordService) error {
+		existing, err := tx.findEntry(service, username)
+		if err != nil {
+			return err
+		}
+		otp, err := ParseOTP(value)
+		if err != nil {
+			return err
+		}
+
+		// The counter is stored apart from the encrypted settings
+		counter := otp.Counter
+		otp.Counter = 0
+		encoded, err := json.Marshal(otp)
+		if err != nil {
+			return err
+		}
+		defer crypto.Wipe(encoded)
+
+		sealed, err := tx.encryptor.EncryptWithAAD(encoded, tx.encryptor.FieldAAD(existing.ID, otpField))
+		if err != nil {
+			return err
+		}
+		return tx.db.SetOTP(existing.ID, sealed, counter)
+	})
+}
+
+// GetOTP returns the one-time password settings of an entry, including its
+// secret
+func (ps *PasswordService) GetOTP(service, username string) (*models.OTP, error) {
+	existing, err := ps.findEntry(service, username)
+	if err != nil {
+		return nil, err
+	}
+	return ps.openOTP(existing.ID)
+}
+
+// OTPCode generates the current one-time password of an entry. For a HOTP the
+// counter is advanced, so every call returns a new code.
+func (ps *PasswordService) OTPCode(service, username string) (*models.OTPCode, error) {
+	existing, err := ps.findEntry(service, username)
+	if err != nil {
+		return nil, err
+	}
+	otp, err := ps.openOTP(existing.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := decodeOTPSecret(otp.Secret)
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.Wipe(secret)
+
+	if otp.Type == models.OTPHOTP {
+		counter, err := ps.db.NextHOTPCounter(existing.ID)
+		if err != nil {
+			return nil, err
+		}
+		code, err := crypto.HOTP(secret, counter, otp.Digits, otp.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+		return &models.OTPCode{Code: code, Counter: counter}, nil
+	}
+
+	code, remaining, err := crypto.TOTP(secret, ps.clock(), otp.Period, otp.Digits, otp.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &models.OTPCode{Code: code, Remaining: remaining}, nil
+}
+
+// RemoveOTP removes the one-time password of an entry
+func (ps *PasswordService) RemoveOTP(service, username string) error {
+	return ps.transaction(func(tx *PasswordService) error {
+		existing, err := tx.findEntry(service, username)
+		if err != nil {
+			return err
+		}
+		_, _, found, err := tx.db.GetOTP(existing.ID)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return ErrNoOTP
+		}
+		return tx.db.DeleteOTP(existing.ID)
+	})
+}
+
+// SetClock replaces the clock TOTP codes are generated from, so codes can be
+// checked against known times
+func (ps *PasswordService) SetClock(clock func() time.Time) {
+	ps.clock = clock
+}
+
+// openOTP decrypts the one-time password settings of an entry
+func (ps *PasswordService) openOTP(passwordID int) (*models.OTP, error) {
+	sealed, counter, found, err := ps.db.GetOTP(passwordID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrNoOTP
+	}
+
+	encoded, err := ps.encryptor.DecryptWithAAD(sealed, ps.encryptor.FieldAAD(passwordID, otpField))
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.Wipe(encoded)
+
+	var otp models.OTP
+	if err := json.Unmarshal(encoded, &otp); err != nil {
+		return nil, fmt.Errorf("invalid one-time password settings: %w", err)
+	}
+	otp.Counter = counter
+	return &otp, nil
+}
+
+// validateOTP checks one-time password settings
+func validateOTP(otp *models.OTP) error {
+	if otp.Type != models.OTPTOTP && otp.Type != models.OTPHOTP {
+		return fmt.Errorf("unknown one-time password type %q", otp.Type)
+	}
+	secret, err := decodeOTPSecret(otp.Secret)
+	if err != nil {
+		return err
+	}
+	crypto.Wipe(secret)
+
+	if !slices.Contains(otpAlgorithms, otp.Algorithm) {
+		return fmt.Errorf("unsupported OTP algorithm %q", otp.Algorithm)
+	}
+	if otp.Digits < crypto.MinOTPDigits || otp.Digits > crypto.MaxOTPDigits {
+		return fmt.Errorf("OTP digits must be between %d and %d", crypto.MinOTPDigits, crypto.MaxOTPDigits)
+	}
+	if otp.Type == models.OTPTOTP && otp.Period <= 0 {
+		return errors.New("OTP period must be positive")
+	}
+	return nil
+}
+
+// normalizeOTPSecret upper-cases a base32 secret and removes the spaces and
+// padding it is often written with
+func normalizeOTPSecret(secret string) string {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	return strings.TrimRight(secret, "=")
+}
+
+// decodeOTPSecret decodes a normalized base32 secret
+func decodeOTPSecret(secret string) ([]byte, error) {
+	decoded, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil || len(decoded) == 0 {
+		return nil, errors.New("OTP secret must be base32")
+	}
+	return decoded, nil
+}
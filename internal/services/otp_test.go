@@ -0,0 +1,228 @@
+package services
+
+import (
+	"encoding/base32"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"password-manager/internal/crypto"
+	"password-manager/internal/database"
+	"password-manager/internal/models"
+)
+
+// Unpadded base32 secrets of the RFC 4226 and RFC 6238 test vectors
+var (
+	sha1Secret   = otpSecret("12345678901234567890")
+	sha256Secret = otpSecret("12345678901234567890123456789012")
+	sha512Secret = otpSecret("1234567890123456789012345678901234567890123456789012345678901234")
+)
+
+func otpSecret(secret string) string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte(secret))
+}
+
+// openTestVault opens the vault at path with a fixed master password,
+// recording revisions in a temporary config directory
+func openTestVault(t *testing.T, path string) *PasswordService {
+	t.Helper()
+	db, err := database.NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor, err := crypto.NewEncryptor([]byte("correct horse battery"), nil, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err := NewPasswordService(db, encryptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ps.Close() })
+	return ps
+}
+
+// newOTPVault creates a vault with one entry whose one-time password is set
+// from value
+func newOTPVault(t *testing.T, value string) (*PasswordService, string) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	path := filepath.Join(dir, "vault.db")
+
+	ps := openTestVault(t, path)
+	err := ps.CreatePassword(&models.PasswordRequest{Service: "example", Username: "alice", Password: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.SetOTP("example", "alice", value); err != nil {
+		t.Fatal(err)
+	}
+	return ps, path
+}
+
+func TestParseOTP(t *testing.T) {
+	tests := []struct {
+		value string
+		want  models.OTP
+	}{
+		{
+			"gezd gnbv gy3t qojq gezd gnbv gy3t qojq",
+			models.OTP{Type: models.OTPTOTP, Secret: sha1Secret, Algorithm: "SHA1", Digits: 6, Period: 30},
+		},
+		{
+			"otpauth://totp/Example:alice@example.com?secret=" + sha1Secret + "&issuer=Example",
+			models.OTP{Type: models.OTPTOTP, Secret: sha1Secret, Issuer: "Example", Account: "alice@example.com",
+				Algorithm: "SHA1", Digits: 6, Period: 30},
+		},
+		{
+			"otpauth://totp/Other:alice?secret=" + sha256Secret + "====&issuer=Example&algorithm=sha256&digits=8&period=60",
+			models.OTP{Type: models.OTPTOTP, Secret: sha256Secret, Issuer: "Example", Account: "alice",
+				Algorithm: "SHA256", Digits: 8, Period: 60},
+		},
+		{
+			"OTPAUTH://HOTP/alice?secret=" + sha1Secret + "&counter=42",
+			models.OTP{Type: models.OTPHOTP, Secret: sha1Secret, Account: "alice", Algorithm: "SHA1", Digits: 6, Counter: 42},
+		},
+	}
+	for _, tt := range tests {
+		got, err := ParseOTP(tt.value)
+		if err != nil {
+			t.Errorf("ParseOTP(%q): %v", tt.value, err)
+			continue
+		}
+		if *got != tt.want {
+			t.Errorf("ParseOTP(%q) = %+v, want %+v", tt.value, *got, tt.want)
+		}
+	}
+}
+
+func TestParseOTPInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"not base32!",
+		"otpauth://totp/alice",
+		"otpauth://totp/alice?secret=",
+		"otpauth://totp/alice?secret=1234",
+		"otpauth://totp/alice?secret=" + sha1Secret + "&digits=5",
+		"otpauth://totp/alice?secret=" + sha1Secret + "&digits=9",
+		"otpauth://totp/alice?secret=" + sha1Secret + "&digits=six",
+		"otpauth://totp/alice?secret=" + sha1Secret + "&period=0",
+		"otpauth://totp/alice?secret=" + sha1Secret + "&period=-30",
+		"otpauth://totp/alice?secret=" + sha1Secret + "&period=soon",
+		"otpauth://totp/alice?secret=" + sha1Secret + "&algorithm=MD5",
+		"otpauth://hotp/alice?secret=" + sha1Secret,
+		"otpauth://hotp/alice?secret=" + sha1Secret + "&counter=-1",
+		"otpauth://motp/alice?secret=" + sha1Secret,
+		"otpauth://totp/%zz?secret=" + sha1Secret,
+	}
+	for _, value := range tests {
+		if otp, err := ParseOTP(value); err == nil {
+			t.Errorf("ParseOTP(%q) = %+v, want an error", value, *otp)
+		}
+	}
+}
+
+func TestOTPCodeTOTP(t *testing.T) {
+	// RFC 6238 appendix B, through an entry of a vault
+	secrets := map[string]string{"SHA1": sha1Secret, "SHA256": sha256Secret, "SHA512": sha512Secret}
+	vectors := []struct {
+		unix  int64
+		codes map[string]string
+	}{
+		{59, map[string]string{"SHA1": "94287082", "SHA256": "46119246", "SHA512": "90693936"}},
+		{1111111109, map[string]string{"SHA1": "07081804", "SHA256": "68084774", "SHA512": "25091201"}},
+		{1111111111, map[string]string{"SHA1": "14050471", "SHA256": "67062674", "SHA512": "99943326"}},
+		{1234567890, map[string]string{"SHA1": "89005924", "SHA256": "91819424", "SHA512": "93441116"}},
+		{2000000000, map[string]string{"SHA1": "69279037", "SHA256": "90698825", "SHA512": "38618901"}},
+		{20000000000, map[string]string{"SHA1": "65353130", "SHA256": "77737706", "SHA512": "47863826"}},
+	}
+
+	for _, algorithm := range []string{"SHA1", "SHA256", "SHA512"} {
+		uri := fmt.Sprintf("otpauth://totp/alice?secret=%s&algorithm=%s&digits=8&period=30", secrets[algorithm], algorithm)
+		ps, _ := newOTPVault(t, uri)
+
+		for _, v := range vectors {
+			ps.SetClock(func() time.Time { return time.Unix(v.unix, 0) })
+			code, err := ps.OTPCode("example", "alice")
+			if err != nil {
+				t.Fatalf("OTPCode at %d with %s: %v", v.unix, algorithm, err)
+			}
+			if code.Code != v.codes[algorithm] {
+				t.Errorf("OTPCode at %d with %s = %s, want %s", v.unix, algorithm, code.Code, v.codes[algorithm])
+			}
+			if want := 30 - int(v.unix%30); code.Remaining != want {
+				t.Errorf("OTPCode at %d with %s remaining = %d, want %d", v.unix, algorithm, code.Remaining, want)
+			}
+		}
+	}
+}
+
+func TestOTPCodeHOTP(t *testing.T) {
+	// RFC 4226 appendix D, starting from counter 3
+	ps, _ := newOTPVault(t, "otpauth://hotp/alice?secret="+sha1Secret+"&counter=3")
+	want := []string{"969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+
+	for i, code := range want {
+		got, err := ps.OTPCode("example", "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Code != code || got.Counter != uint64(3+i) {
+			t.Errorf("code %d = %s at counter %d, want %s at counter %d", i, got.Code, got.Counter, code, 3+i)
+		}
+	}
+
+	otp, err := ps.GetOTP("example", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otp.Counter != 10 {
+		t.Errorf("counter after 7 codes = %d, want 10", otp.Counter)
+	}
+}
+
+func TestOTPCodeHOTPConcurrent(t *testing.T) {
+	// Each vault opened has its own copy of an encrypted vault file in
+	// memory, as separate processes do; no counter may be handed out twice
+	ps, path := newOTPVault(t, "otpauth://hotp/alice?secret="+sha1Secret+"&counter=0")
+	if err := ps.EncryptVaultFile([]byte("correct horse battery")); err != nil {
+		t.Fatal(err)
+	}
+
+	const vaults, codes = 4, 5
+	var opened []*PasswordService
+	for range vaults {
+		opened = append(opened, openTestVault(t, path))
+	}
+
+	var mu sync.Mutex
+	counters := make(map[uint64]bool)
+	var wg sync.WaitGroup
+	for _, vault := range opened {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range codes {
+				code, err := vault.OTPCode("example", "alice")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				if counters[code.Counter] {
+					t.Errorf("counter %d handed out twice", code.Counter)
+				}
+				counters[code.Counter] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(counters) != vaults*codes {
+		t.Errorf("%d distinct counters, want %d", len(counters), vaults*codes)
+	}
+}
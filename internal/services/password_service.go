@@ -1,125 +1,506 @@
 package services
 
 import (
+	"database/sql"
 	"errors"
 	"password-manager/internal/crypto"
 	"password-manager/internal/database"
 	"password-manager/internal/models"
+	"slices"
+	"sort"
+	"strings"
+	"time"
 )
 
 type PasswordService struct {
 	db        *database.DB
 	encryptor *crypto.Encryptor
+	clock     func() time.Time // the time TOTP codes are generated for
 }
 
-// NewPasswordService creates a new password service
-func NewPasswordService(db *database.DB, encryptor *crypto.Encryptor) *PasswordService {
-	return &PasswordService{
+// NewPasswordService creates a new password service, upgrading stored
+// entries to the current format. That is the only write made on opening, and
+// only to a vault written by an older version; expired entries stay in the
+// trash until PurgeTrash is called.
+func NewPasswordService(db *database.DB, encryptor *crypto.Encryptor) (*PasswordService, error) {
+	ps := &PasswordService{
 		db:        db,
 		encryptor: encryptor,
+		clock:     time.Now,
 	}
+
+	if err := ps.upgradeEntries(); err != nil {
+		return nil, err
+	}
+
+	return ps, nil
 }
 
+// Close locks the vault, wiping its keys from memory, and closes the
+// database. The service cannot be used afterwards.
+func (ps *PasswordService) Close() error {
+	ps.encryptor.Lock()
+	return ps.db.Close()
+}
+
+// transaction runs fn with a copy of the service bound to one database
+// transaction. What an operation reads then still holds when it writes, and
+// its writes are committed together or not at all.
+func (ps *PasswordService) transaction(fn func(tx *PasswordService) error) error {
+	return ps.db.Transaction(func(db *database.DB) error {
+		return fn(&PasswordService{db: db, encryptor: ps.encryptor, clock: ps.clock})
+	})
+}
+
+// ErrNotFound is returned when no entry exists for a service and username
+var ErrNotFound = errors.New("password entry not found")
+
+// maskedPassword replaces passwords in list and search results
+const maskedPassword = "••••••••"
+
 // CreatePassword creates a new password entry
 func (ps *PasswordService) CreatePassword(req *models.PasswordRequest) error {
-	if req.Service == "" || req.Username == "" || req.Password == "" {
-		return errors.New("service, username, and password are required")
+	entryType := req.Type
+	if entryType == "" {
+		entryType = models.EntryLogin
+	}
+	if err := validateEntry(entryType, req); err != nil {
+		return err
+	}
+
+	return ps.transaction(func(tx *PasswordService) error {
+		_, err := tx.createEntry(entryType, req)
+		return err
+	})
+}
+
+// createEntry stores a new entry from a validated request. It must run in a
+// transaction, as the row is written before its ciphertexts.
+func (ps *PasswordService) createEntry(entryType models.EntryType, req *models.PasswordRequest) (*models.Password, error) {
+	lookupHash, err := ps.encryptor.BlindIndex(req.Service, req.Username)
+	if err != nil {
+		return nil, err
 	}
 
 	// Check if password already exists
-	existing, _ := ps.db.GetPassword(req.Service, req.Username)
+	existing, _ := ps.db.GetPassword(lookupHash)
+	if existing != nil && existing.DeletedAt != nil {
+		return nil, errors.New("password entry for this service and username is in the trash; restore it or empty the trash first")
+	}
 	if existing != nil {
-		return errors.New("password entry already exists for this service and username")
+		return nil, errors.New("password entry already exists for this service and username")
 	}
 
-	// Encrypt the password
-	encryptedPassword, err := ps.encryptor.Encrypt(req.Password)
-	if err != nil {
-		return err
+	// Ciphertexts are bound to the entry ID, so they are written once the row exists
+	placeholder := &models.Password{LookupHash: lookupHash}
+	if err := ps.db.CreatePassword(placeholder); err != nil {
+		return nil, err
 	}
 
 	password := &models.Password{
-		Service:  req.Service,
-		Username: req.Username,
-		Password: encryptedPassword,
-		URL:      req.URL,
-		Notes:    req.Notes,
+		ID:         placeholder.ID,
+		Type:       entryType,
+		Service:    req.Service,
+		Username:   req.Username,
+		Password:   req.Password,
+		URL:        req.URL,
+		Notes:      req.Notes,
+		Fields:     req.Fields,
+		LookupHash: lookupHash,
 	}
+	setDetails(password, req)
 
-	return ps.db.CreatePassword(password)
+	if err := ps.sealEntry(password); err != nil {
+		return nil, err
+	}
+	return password, ps.db.UpdatePassword(password.ID, password)
 }
 
-// GetPassword retrieves and decrypts a password
+// GetPassword retrieves and decrypts a password. Call Wipe on the result once
+// the password has been used.
 func (ps *PasswordService) GetPassword(service, username string) (*models.Password, error) {
-	password, err := ps.db.GetPassword(service, username)
+	password, err := ps.findEntry(service, username)
 	if err != nil {
 		return nil, err
 	}
 
-	// Decrypt the password
-	decryptedPassword, err := ps.encryptor.Decrypt(password.Password)
+	// Decrypt the entry including the password
+	if err := ps.openEntry(password, true); err != nil {
+		return nil, err
+	}
+
+	l, err := ps.loadLabels()
+	if err != nil {
+		password.Wipe()
+		return nil, err
+	}
+	entryTags, err := ps.db.ListPasswordTags()
 	if err != nil {
+		password.Wipe()
 		return nil, err
 	}
+	l.labelEntry(password, entryTags)
 
-	password.Password = decryptedPassword
 	return password, nil
 }
 
-// ListPasswords retrieves all passwords (without decrypting them for security)
-func (ps *PasswordService) ListPasswords() ([]*models.Password, error) {
-	passwords, err := ps.db.ListPasswords()
+// ListPasswords retrieves the passwords selected by filter. Passwords and
+// other secrets are masked for security unless the filter reveals them.
+func (ps *PasswordService) ListPasswords(filter models.PasswordFilter) ([]*models.Password, error) {
+	stored, err := ps.db.ListPasswords()
 	if err != nil {
 		return nil, err
 	}
 
-	// Don't decrypt passwords in list view for security
-	for _, password := range passwords {
-		password.Password = "••••••••"
+	l, err := ps.loadLabels()
+	if err != nil {
+		return nil, err
+	}
+	var folder *models.Folder
+	if filter.Folder != "" {
+		if folder = l.folder(filter.Folder); folder == nil {
+			return nil, errors.New("folder not found")
+		}
+	}
+	var tag *models.Tag
+	if filter.Tag != "" {
+		if tag = l.tag(filter.Tag); tag == nil {
+			return nil, errors.New("tag not found")
+		}
+	}
+	entryTags, err := ps.db.ListPasswordTags()
+	if err != nil {
+		return nil, err
 	}
 
+	var passwords []*models.Password
+	for _, password := range stored {
+		if password.DeletedAt != nil && !filter.IncludeTrashed {
+			continue
+		}
+		if tag != nil && !slices.Contains(entryTags[password.ID], tag.ID) {
+			continue
+		}
+		if err := ps.openEntry(password, filter.Reveal); err != nil {
+			return nil, err
+		}
+		l.labelEntry(password, entryTags)
+		if folder != nil && !inFolder(password, folder.Path) {
+			continue
+		}
+		passwords = append(passwords, password)
+	}
+
+	sort.Slice(passwords, func(i, j int) bool {
+		if passwords[i].Service != passwords[j].Service {
+			return passwords[i].Service < passwords[j].Service
+		}
+		return passwords[i].Username < passwords[j].Username
+	})
+
 	return passwords, nil
 }
 
-// SearchPasswords searches for passwords
-func (ps *PasswordService) SearchPasswords(searchTerm string) ([]*models.Password, error) {
-	passwords, err := ps.db.SearchPasswords(searchTerm)
+// SearchPasswords searches the passwords selected by filter by service,
+// username or URL
+func (ps *PasswordService) SearchPasswords(searchTerm string, filter models.PasswordFilter) ([]*models.Password, error) {
+	// Entries are encrypted, so the search runs over the decrypted list
+	passwords, err := ps.ListPasswords(filter)
 	if err != nil {
 		return nil, err
 	}
 
-	// Don't decrypt passwords in search results for security
+	term := strings.ToLower(searchTerm)
+	var matches []*models.Password
 	for _, password := range passwords {
-		password.Password = "••••••••"
+		if strings.Contains(strings.ToLower(password.Service), term) ||
+			strings.Contains(strings.ToLower(password.Username), term) ||
+			strings.Contains(strings.ToLower(password.URL), term) {
+			matches = append(matches, password)
+		}
 	}
 
-	return passwords, nil
+	return matches, nil
 }
 
 // UpdatePassword updates an existing password
 func (ps *PasswordService) UpdatePassword(service, username string, req *models.PasswordRequest) error {
-	// Check if password exists
-	_, err := ps.db.GetPassword(service, username)
+	return ps.transaction(func(tx *PasswordService) error {
+		// Check if password exists
+		existing, err := tx.findEntry(service, username)
+		if err != nil {
+			return err
+		}
+		previous := string(existing.Password)
+		if err := tx.openEntry(existing, false); err != nil {
+			return err
+		}
+
+		if req.Type != "" && req.Type != existing.Type {
+			return errors.New("entry type cannot be changed")
+		}
+		if err := validateEntry(existing.Type, &models.PasswordRequest{
+			Service:  existing.Service,
+			Username: existing.Username,
+			Password: req.Password,
+			Notes:    req.Notes,
+			Fields:   req.Fields,
+			Card:     req.Card,
+			Identity: req.Identity,
+			SSHKey:   req.SSHKey,
+		}); err != nil {
+			return err
+		}
+
+		// Keep the replaced password in the history
+		replaced, err := tx.historyVersion(existing, previous, req.Password)
+		if err != nil {
+			return err
+		}
+
+		existing.Password = req.Password
+		existing.URL = req.URL
+		existing.Notes = req.Notes
+		existing.Fields = req.Fields
+		setDetails(existing, req)
+
+		// Encrypt the updated entry
+		if err := tx.sealEntry(existing); err != nil {
+			return err
+		}
+
+		if err := tx.addHistory(tx.db, existing.ID, replaced); err != nil {
+			return err
+		}
+		return tx.db.UpdatePassword(existing.ID, existing)
+	})
+}
+
+// ChangeMasterPassword re-encrypts the whole vault under a new master password
+func (ps *PasswordService) ChangeMasterPassword(currentPassword, newPassword []byte) error {
+	if len(newPassword) == 0 {
+		return errors.New("new master password cannot be empty")
+	}
+
+	if err := ps.verifyMasterPassword(currentPassword); err != nil {
+		return err
+	}
+
+	return ps.encryptor.ChangeMasterPassword(newPassword)
+}
+
+// RequireKeyFile makes unlocking the vault require the key file with the
+// given digest in addition to the master password
+func (ps *PasswordService) RequireKeyFile(currentPassword, keyFile []byte) error {
+	if keyFile == nil {
+		return errors.New("key file is required")
+	}
+	if err := ps.verifyMasterPassword(currentPassword); err != nil {
+		return err
+	}
+
+	return ps.encryptor.SetKeyFile(currentPassword, keyFile)
+}
+
+// RemoveKeyFile removes the key file requirement from the vault
+func (ps *PasswordService) RemoveKeyFile(currentPassword []byte) error {
+	if !ps.encryptor.KeyFileRequired() {
+		return errors.New("vault does not use a key file")
+	}
+	if err := ps.verifyMasterPassword(currentPassword); err != nil {
+		return err
+	}
+
+	return ps.encryptor.SetKeyFile(currentPassword, nil)
+}
+
+// KeyFileRequired reports whether unlocking the vault requires a key file
+func (ps *PasswordService) KeyFileRequired() bool {
+	return ps.encryptor.KeyFileRequired()
+}
+
+// EncryptVaultFile encrypts the whole vault file, hiding the schema, row
+// counts and timestamps that the column encryption leaves visible
+func (ps *PasswordService) EncryptVaultFile(currentPassword []byte) error {
+	if ps.encryptor.VaultFileEncrypted() {
+		return errors.New("vault file is already encrypted")
+	}
+	if err := ps.verifyMasterPassword(currentPassword); err != nil {
+		return err
+	}
+
+	return ps.encryptor.EncryptVaultFile()
+}
+
+// DecryptVaultFile turns an encrypted vault file back into a plain SQLite
+// file with encrypted entries
+func (ps *PasswordService) DecryptVaultFile(currentPassword []byte) error {
+	if !ps.encryptor.VaultFileEncrypted() {
+		return errors.New("vault file is not encrypted")
+	}
+	if err := ps.verifyMasterPassword(currentPassword); err != nil {
+		return err
+	}
+
+	return ps.encryptor.DecryptVaultFile()
+}
+
+// VaultFileEncrypted reports whether the whole vault file is encrypted
+func (ps *PasswordService) VaultFileEncrypted() bool {
+	return ps.encryptor.VaultFileEncrypted()
+}
+
+// VaultRevision returns the vault revision counter, incremented by every
+// write and covered by the integrity root
+func (ps *PasswordService) VaultRevision() (int64, error) {
+	return ps.encryptor.IntegrityRevision()
+}
+
+// verifyMasterPassword returns an error unless password is the current
+// master password
+func (ps *PasswordService) verifyMasterPassword(password []byte) error {
+	verified, err := ps.encryptor.VerifyMasterPassword(password)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return errors.New("incorrect master password")
+	}
+	return nil
+}
+
+// DeletePassword moves a password entry to the trash
+func (ps *PasswordService) DeletePassword(service, username string) error {
+	return ps.transaction(func(tx *PasswordService) error {
+		existing, err := tx.findEntry(service, username)
+		if err != nil {
+			return err
+		}
+		return tx.db.TrashPassword(existing.ID)
+	})
+}
+
+// findEntry returns the stored, still encrypted entry for a service and
+// username. Entries in the trash are not found.
+func (ps *PasswordService) findEntry(service, username string) (*models.Password, error) {
+	entry, err := ps.lookupEntry(service, username)
+	if err == nil && entry.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+	return entry, err
+}
+
+// lookupEntry returns the stored entry for a service and username, whether
+// or not it is in the trash
+func (ps *PasswordService) lookupEntry(service, username string) (*models.Password, error) {
+	lookupHash, err := ps.encryptor.BlindIndex(service, username)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := ps.db.GetPassword(lookupHash)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return entry, err
+}
+
+// sealEntry encrypts the plaintext fields of an entry in place and sets its
+// lookup hash. The entry ID must be set, as every ciphertext is bound to it.
+func (ps *PasswordService) sealEntry(entry *models.Password) error {
+	lookupHash, err := ps.encryptor.BlindIndex(entry.Service, entry.Username)
 	if err != nil {
-		return errors.New("password entry not found")
+		return err
 	}
+	entry.LookupHash = lookupHash
 
-	// Encrypt the new password
-	encryptedPassword, err := ps.encryptor.Encrypt(req.Password)
+	aad := ps.encryptor.EntryAAD(entry.ID, entry.Service, entry.Username)
+	password, err := ps.encryptor.EncryptWithAAD(entry.Password, aad)
 	if err != nil {
 		return err
 	}
+	entry.Password = []byte(password)
 
-	updates := &models.Password{
-		Password: encryptedPassword,
-		URL:      req.URL,
-		Notes:    req.Notes,
+	for field, value := range entryFields(entry) {
+		ciphertext, err := ps.encryptor.EncryptWithAAD([]byte(*value), ps.encryptor.FieldAAD(entry.ID, field))
+		if err != nil {
+			return err
+		}
+		*value = ciphertext
 	}
 
-	return ps.db.UpdatePassword(service, username, updates)
+	if err := ps.sealFields(entry); err != nil {
+		return err
+	}
+	return ps.sealDetails(entry)
 }
 
-// DeletePassword deletes a password entry
-func (ps *PasswordService) DeletePassword(service, username string) error {
-	return ps.db.DeletePassword(service, username)
+// openEntry decrypts the fields of an entry in place. The password,
+// concealed custom fields and secret details such as card numbers are only
+// decrypted if withPassword is set and are masked otherwise.
+func (ps *PasswordService) openEntry(entry *models.Password, withPassword bool) error {
+	for field, value := range entryFields(entry) {
+		plaintext, err := ps.encryptor.DecryptWithAAD(*value, ps.encryptor.FieldAAD(entry.ID, field))
+		if err != nil {
+			return err
+		}
+		*value = string(plaintext)
+	}
+	if err := ps.openFields(entry, withPassword); err != nil {
+		return err
+	}
+	if err := ps.openDetails(entry, withPassword); err != nil {
+		return err
+	}
+
+	// The lookup hash is not encrypted, so check it still matches the entry
+	lookupHash, err := ps.encryptor.BlindIndex(entry.Service, entry.Username)
+	if err != nil {
+		return err
+	}
+	if lookupHash != entry.LookupHash {
+		return crypto.ErrTampered
+	}
+
+	if !withPassword {
+		entry.Password = nil
+		if entry.Type == models.EntryLogin {
+			entry.Password = []byte(maskedPassword)
+		}
+		return nil
+	}
+
+	aad := ps.encryptor.EntryAAD(entry.ID, entry.Service, entry.Username)
+	password, err := ps.encryptor.DecryptWithAAD(string(entry.Password), aad)
+	if err != nil {
+		return err
+	}
+	entry.Password = password
+	return nil
+}
+
+// MaskSecrets replaces the password, concealed custom fields and secret
+// details of a decrypted entry with placeholders, as in listings
+func MaskSecrets(entry *models.Password) {
+	if len(entry.Password) > 0 {
+		crypto.Wipe(entry.Password)
+		entry.Password = []byte(maskedPassword)
+	}
+	for i := range entry.Fields {
+		if entry.Fields[i].Concealed() {
+			entry.Fields[i].Value.Wipe()
+			entry.Fields[i].Value = models.Secret(maskedPassword)
+		}
+	}
+	maskDetails(entry)
+}
+
+// entryFields returns the encrypted metadata fields of an entry by name
+func entryFields(entry *models.Password) map[string]*string {
+	return map[string]*string{
+		"service":  &entry.Service,
+		"username": &entry.Username,
+		"url":      &entry.URL,
+		"notes":    &entry.Notes,
+	}
 }
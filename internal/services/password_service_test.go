@@ -0,0 +1,158 @@
+package services
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"password-manager/internal/models"
+)
+
+func TestCreatePasswordDuplicate(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	ps := openTestVault(t, filepath.Join(dir, "vault.db"))
+
+	create := func(service, username string) error {
+		return ps.CreatePassword(&models.PasswordRequest{Service: service, Username: username, Password: []byte("secret")})
+	}
+	if err := create("example", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := create("example", "alice"); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("duplicate entry: got error %v, want already exists", err)
+	}
+	for _, other := range [][2]string{{"example", "bob"}, {"other", "alice"}} {
+		if err := create(other[0], other[1]); err != nil {
+			t.Errorf("entry %s/%s: %v", other[0], other[1], err)
+		}
+	}
+
+	if err := ps.DeletePassword("example", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := create("example", "alice"); err == nil || !strings.Contains(err.Error(), "in the trash") {
+		t.Errorf("duplicate of a trashed entry: got error %v, want in the trash", err)
+	}
+}
+
+func TestLookupHashUnique(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	ps := openTestVault(t, filepath.Join(dir, "vault.db"))
+
+	hash, err := ps.encryptor.BlindIndex("example", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ps.encryptor.BlindIndex("example", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rows with the same stored service and username are kept apart by their
+	// lookup hash alone, which the database itself keeps unique
+	if err := ps.db.CreatePassword(&models.Password{Service: "same", Username: "same", LookupHash: hash}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.db.CreatePassword(&models.Password{Service: "same", Username: "same", LookupHash: other}); err != nil {
+		t.Errorf("same service and username with another lookup hash: %v", err)
+	}
+	if err := ps.db.CreatePassword(&models.Password{Service: "other", Username: "other", LookupHash: hash}); err == nil {
+		t.Error("duplicate lookup hash was accepted")
+	}
+}
+
+func TestEntryOperations(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		t.Run(map[bool]string{false: "plain", true: "encrypted"}[encrypted], func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("XDG_CONFIG_HOME", dir)
+			ps := openTestVault(t, filepath.Join(dir, "vault.db"))
+			if encrypted {
+				if err := ps.EncryptVaultFile([]byte("correct horse battery")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			steps := []struct {
+				name string
+				run  func() error
+			}{
+				{"create", func() error {
+					return ps.CreatePassword(&models.PasswordRequest{Service: "example", Username: "alice", Password: []byte("secret")})
+				}},
+				{"update", func() error {
+					return ps.UpdatePassword("example", "alice", &models.PasswordRequest{Password: []byte("newer"),
+						Fields: []models.CustomField{{Name: "PIN", Type: models.FieldConcealed, Value: models.Secret("1234")}}})
+				}},
+				{"restore version", func() error {
+					versions, err := ps.PasswordHistory("example", "alice")
+					if err != nil || len(versions) != 1 {
+						return fmt.Errorf("history %v: %v", versions, err)
+					}
+					return ps.RestorePasswordVersion("example", "alice", versions[0].ID)
+				}},
+				{"create folder", func() error { return ps.CreateFolder("Work/Mail") }},
+				{"rename folder", func() error { return ps.RenameFolder("Work/Mail", "Email") }},
+				{"move", func() error { return ps.MovePassword("example", "alice", "Work/Email") }},
+				{"tag", func() error { return ps.TagPassword("example", "alice", "important") }},
+				{"rename tag", func() error { return ps.RenameTag("important", "urgent") }},
+				{"set OTP", func() error { return ps.SetOTP("example", "alice", sha1Secret) }},
+				{"attach", func() error {
+					_, err := ps.AddAttachment("example", "alice", "notes.txt", strings.NewReader("attached"))
+					return err
+				}},
+				{"delete", func() error { return ps.DeletePassword("example", "alice") }},
+				{"restore", func() error { return ps.RestorePassword("example", "alice") }},
+			}
+			for _, step := range steps {
+				if err := step.run(); err != nil {
+					t.Fatalf("%s: %v", step.name, err)
+				}
+			}
+
+			entry, err := ps.GetPassword("example", "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer entry.Wipe()
+			if string(entry.Password) != "secret" || entry.Folder != "Work/Email" ||
+				len(entry.Tags) != 1 || entry.Tags[0] != "urgent" || len(entry.Fields) != 1 {
+				t.Errorf("entry after the operations: %+v", entry)
+			}
+			attachments, err := ps.ListAttachments("example", "alice")
+			if err != nil || len(attachments) != 1 {
+				t.Errorf("attachments %v: %v", attachments, err)
+			}
+
+			for _, step := range []struct {
+				name string
+				run  func() error
+			}{
+				{"remove attachment", func() error { return ps.RemoveAttachment("example", "alice", "notes.txt") }},
+				{"remove OTP", func() error { return ps.RemoveOTP("example", "alice") }},
+				{"untag", func() error { return ps.UntagPassword("example", "alice", "urgent") }},
+				{"delete tag", func() error { return ps.DeleteTag("urgent") }},
+				{"delete folder", func() error { return ps.DeleteFolder("Work/Email") }},
+				{"delete", func() error { return ps.DeletePassword("example", "alice") }},
+			} {
+				if err := step.run(); err != nil {
+					t.Fatalf("%s: %v", step.name, err)
+				}
+			}
+
+			// The entry went to the parent folder; emptying the trash removes it
+			if n, err := ps.EmptyTrash(); err != nil || n != 1 {
+				t.Errorf("EmptyTrash = %d, %v; want 1", n, err)
+			}
+			if n, err := ps.EmptyTrash(); err != nil || n != 0 {
+				t.Errorf("EmptyTrash of an empty trash = %d, %v; want 0", n, err)
+			}
+			if _, err := ps.GetPassword("example", "alice"); err != ErrNotFound {
+				t.Errorf("entry after emptying the trash: %v", err)
+			}
+		})
+	}
+}
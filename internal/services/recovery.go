@@ -0,0 +1,138 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"password-manager/internal/crypto"
+)
+
+// CreateRecoveryKey generates the first recovery key of the vault and returns
+// it formatted for the emergency kit
+func (ps *PasswordService) CreateRecoveryKey() (string, error) {
+	exists, err := ps.encryptor.HasRecoveryKey()
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return "", errors.New("vault already has a recovery key")
+	}
+
+	return ps.newRecoveryKey()
+}
+
+// RotateRecoveryKey replaces the recovery key with a new one, revoking the
+// old key, and returns it formatted for the emergency kit
+func (ps *PasswordService) RotateRecoveryKey(currentPassword []byte) (string, error) {
+	if err := ps.verifyMasterPassword(currentPassword); err != nil {
+		return "", err
+	}
+
+	return ps.newRecoveryKey()
+}
+
+// SplitRecoveryKey replaces the recovery key with a new one and splits it into
+// shares, any threshold of which can recover the vault. Only the formatted
+// shares are returned; the recovery key itself is never shown.
+func (ps *PasswordService) SplitRecoveryKey(currentPassword []byte, shares, threshold int) ([]string, error) {
+	if err := ps.verifyMasterPassword(currentPassword); err != nil {
+		return nil, err
+	}
+
+	recoveryKey, err := crypto.GenerateRecoveryKey()
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.Wipe(recoveryKey)
+
+	split, err := crypto.SplitSecret(recoveryKey, shares, threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ps.encryptor.SetRecoveryKey(recoveryKey); err != nil {
+		return nil, err
+	}
+
+	formatted := make([]string, len(split))
+	for i, share := range split {
+		formatted[i] = crypto.FormatShare(share)
+		crypto.Wipe(share.Value)
+	}
+	return formatted, nil
+}
+
+// RevokeRecoveryKey removes the recovery key from the vault
+func (ps *PasswordService) RevokeRecoveryKey(currentPassword []byte) error {
+	exists, err := ps.encryptor.HasRecoveryKey()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return crypto.ErrNoRecoveryKey
+	}
+	if err := ps.verifyMasterPassword(currentPassword); err != nil {
+		return err
+	}
+
+	return ps.encryptor.RemoveRecoveryKey()
+}
+
+// HasRecoveryKey reports whether the vault has a recovery key
+func (ps *PasswordService) HasRecoveryKey() (bool, error) {
+	return ps.encryptor.HasRecoveryKey()
+}
+
+// IsNewVault reports whether the vault was created by this unlock
+func (ps *PasswordService) IsNewVault() bool {
+	return ps.encryptor.IsNew()
+}
+
+// EmergencyKit returns the printable emergency kit for a recovery key
+func (ps *PasswordService) EmergencyKit(recoveryKey string) string {
+	var kit strings.Builder
+	kit.WriteString("PASSWORD MANAGER EMERGENCY KIT\n")
+	kit.WriteString("==============================\n\n")
+	fmt.Fprintf(&kit, "Vault ID:  %s\n", ps.encryptor.VaultID())
+	fmt.Fprintf(&kit, "Created:   %s\n\n", time.Now().Format("2006-01-02 15:04:05"))
+	kit.WriteString("Recovery key:\n\n")
+	fmt.Fprintf(&kit, "    %s\n\n", recoveryKey)
+	kit.WriteString("If you forget your master password, run:\n\n")
+	kit.WriteString("    password-manager recover\n\n")
+	kit.WriteString("and enter the recovery key above to set a new master password.\n\n")
+	kit.WriteString("Anyone holding this key can open your vault. Print this page, keep it\n")
+	kit.WriteString("somewhere safe and offline, and never store it next to the vault file.\n")
+	return kit.String()
+}
+
+// ShareKit returns the printable kit for one recovery key share
+func (ps *PasswordService) ShareKit(share string, index, shares, threshold int) string {
+	var kit strings.Builder
+	kit.WriteString("PASSWORD MANAGER RECOVERY SHARE\n")
+	kit.WriteString("===============================\n\n")
+	fmt.Fprintf(&kit, "Vault ID:  %s\n", ps.encryptor.VaultID())
+	fmt.Fprintf(&kit, "Share:     %d of %d (any %d recover the vault)\n", index, shares, threshold)
+	fmt.Fprintf(&kit, "Created:   %s\n\n", time.Now().Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(&kit, "    %s\n\n", share)
+	kit.WriteString("To recover the vault, bring together the required shares and run:\n\n")
+	kit.WriteString("    password-manager recover --shares\n\n")
+	kit.WriteString("Keep this share safe. It reveals nothing on its own.\n")
+	return kit.String()
+}
+
+// newRecoveryKey wraps the data key under a fresh recovery key
+func (ps *PasswordService) newRecoveryKey() (string, error) {
+	recoveryKey, err := crypto.GenerateRecoveryKey()
+	if err != nil {
+		return "", err
+	}
+	defer crypto.Wipe(recoveryKey)
+
+	if err := ps.encryptor.SetRecoveryKey(recoveryKey); err != nil {
+		return "", err
+	}
+
+	return crypto.FormatRecoveryKey(recoveryKey), nil
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// idleTimeoutKey is the vault metadata key holding the minutes without input
+// after which the interactive menu locks the vault
+const idleTimeoutKey = "idle_timeout_minutes"
+
+// sessionLengthKey is the vault metadata key holding the minutes after
+// which the interactive menu locks the vault, however active it is
+const sessionLengthKey = "max_session_minutes"
+
+// Session limits unless configured
+const (
+	defaultIdleTimeout   = 5 * time.Minute
+	defaultSessionLength = 8 * time.Hour
+)
+
+// maxSessionLimit bounds the configurable session limits
+const maxSessionLimit = 7 * 24 * time.Hour
+
+// IdleTimeout returns how long the interactive menu waits for input before
+// it locks the vault. 0 means it never locks for inactivity.
+func (ps *PasswordService) IdleTimeout() (time.Duration, error) {
+	return ps.sessionLimit(idleTimeoutKey, defaultIdleTimeout)
+}
+
+// SetIdleTimeout sets how long the interactive menu waits for input before it
+// locks the vault, in whole minutes. 0 turns the idle lock off.
+func (ps *PasswordService) SetIdleTimeout(timeout time.Duration) error {
+	return ps.setSessionLimit(idleTimeoutKey, "idle timeout", timeout)
+}
+
+// SessionLength returns how long the interactive menu stays unlocked before
+// it locks the vault, even while in use. 0 means sessions are not limited.
+func (ps *PasswordService) SessionLength() (time.Duration, error) {
+	return ps.sessionLimit(sessionLengthKey, defaultSessionLength)
+}
+
+// SetSessionLength sets how long the interactive menu stays unlocked, in
+// whole minutes. 0 removes the limit.
+func (ps *PasswordService) SetSessionLength(length time.Duration) error {
+	return ps.setSessionLimit(sessionLengthKey, "session length", length)
+}
+
+// sessionLimit reads a session limit stored in minutes. An invalid stored
+// value is reported together with the default, so that a damaged setting
+// never leaves the session unlimited.
+func (ps *PasswordService) sessionLimit(key string, defaultLimit time.Duration) (time.Duration, error) {
+	value, found, err := ps.db.GetMetadata(key)
+	if err != nil || !found {
+		return defaultLimit, err
+	}
+
+	minutes, err := strconv.Atoi(value)
+	if err != nil || minutes < 0 {
+		return defaultLimit, fmt.Errorf("invalid %s in vault: %q", key, value)
+	}
+	return time.Duration(minutes) * time.Minute, nil
+}
+
+// setSessionLimit stores a session limit in minutes
+func (ps *PasswordService) setSessionLimit(key, name string, limit time.Duration) error {
+	if limit < 0 || limit > maxSessionLimit || limit%time.Minute != 0 {
+		return fmt.Errorf("%s must be a whole number of minutes up to %d", name, int(maxSessionLimit.Minutes()))
+	}
+	return ps.db.SetMetadata(key, strconv.Itoa(int(limit.Minutes())))
+}
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"password-manager/internal/database"
+	"password-manager/internal/models"
+)
+
+// trashRetentionKey is the vault metadata key holding the number of days
+// entries stay in the trash
+const trashRetentionKey = "trash_retention_days"
+
+// defaultTrashRetention is the number of days entries stay in the trash
+const defaultTrashRetention = 30
+
+// ListTrash lists the entries in the trash, most recently deleted first,
+// without decrypting their passwords
+func (ps *PasswordService) ListTrash() ([]*models.Password, error) {
+	passwords, err := ps.ListPasswords(models.PasswordFilter{IncludeTrashed: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var trashed []*models.Password
+	for _, password := range passwords {
+		if password.DeletedAt != nil {
+			trashed = append(trashed, password)
+		}
+	}
+
+	sort.SliceStable(trashed, func(i, j int) bool {
+		return trashed[i].DeletedAt.After(*trashed[j].DeletedAt)
+	})
+	return trashed, nil
+}
+
+// RestorePassword moves a password entry out of the trash
+func (ps *PasswordService) RestorePassword(service, username string) error {
+	return ps.transaction(func(tx *PasswordService) error {
+		existing, err := tx.lookupEntry(service, username)
+		if err != nil {
+			return err
+		}
+		if existing.DeletedAt == nil {
+			return errors.New("password entry is not in the trash")
+		}
+		return tx.db.RestorePassword(existing.ID)
+	})
+}
+
+// EmptyTrash permanently deletes every entry in the trash and returns how
+// many were deleted
+func (ps *PasswordService) EmptyTrash() (int, error) {
+	return ps.purgeTrash(time.Now())
+}
+
+// PurgeTrash permanently deletes entries that have been in the trash longer
+// than the retention period and returns how many were deleted
+func (ps *PasswordService) PurgeTrash() (int, error) {
+	days, err := ps.TrashRetention()
+	if err != nil || days == 0 {
+		return 0, err
+	}
+	return ps.purgeTrash(time.Now().AddDate(0, 0, -days))
+}
+
+// TrashRetention returns the number of days entries stay in the trash before
+// they are purged. 0 means they stay until the trash is emptied.
+func (ps *PasswordService) TrashRetention() (int, error) {
+	value, found, err := ps.db.GetMetadata(trashRetentionKey)
+	if err != nil || !found {
+		return defaultTrashRetention, err
+	}
+
+	days, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid trash retention in vault: %q", value)
+	}
+	return days, nil
+}
+
+// SetTrashRetention sets the number of days entries stay in the trash and
+// purges those past it. 0 keeps them until the trash is emptied.
+func (ps *PasswordService) SetTrashRetention(days int) error {
+	if days < 0 {
+		return errors.New("trash retention cannot be negative")
+	}
+	return ps.transaction(func(tx *PasswordService) error {
+		if err := tx.db.SetMetadata(trashRetentionKey, strconv.Itoa(days)); err != nil {
+			return err
+		}
+		_, err := tx.PurgeTrash()
+		return err
+	})
+}
+
+// purgeTrash permanently deletes entries moved to the trash before cutoff
+func (ps *PasswordService) purgeTrash(cutoff time.Time) (int, error) {
+	// Every transaction records a new revision, so none is started unless
+	// there is something to purge
+	expired, err := expiredEntries(ps.db, cutoff)
+	if err != nil || len(expired) == 0 {
+		return 0, err
+	}
+
+	err = ps.transaction(func(tx *PasswordService) error {
+		// Entries may have been restored since they were listed
+		if expired, err = expiredEntries(tx.db, cutoff); err != nil {
+			return err
+		}
+		for _, id := range expired {
+			if err := tx.db.DeletePassword(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+// expiredEntries returns the IDs of entries moved to the trash before cutoff
+func expiredEntries(db *database.DB, cutoff time.Time) ([]int, error) {
+	passwords, err := db.ListPasswords()
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []int
+	for _, password := range passwords {
+		if password.DeletedAt != nil && !password.DeletedAt.After(cutoff) {
+			expired = append(expired, password.ID)
+		}
+	}
+	return expired, nil
+}